@@ -0,0 +1,318 @@
+package routes
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Argument types
+const (
+	ArgString   = "string"   // A single word or quoted string
+	ArgText     = "text"     // The rest of the input, as typed
+	ArgMention  = "user"     // A username, with or without @
+	ArgDuration = "duration" // 90s, 5m, 1h30m or seconds
+	ArgColour   = "colour"   // See ParseColour
+	ArgNumber   = "number"
+	ArgInteger  = "integer" // A whole number, e.g. an ID or amount
+	ArgEnum     = "enum"    // One of Choices
+	ArgBool     = "bool"    // Flags without a value
+)
+
+// ArgSpec declares an argument of a command. Positional arguments are
+// matched in order; flags are given anywhere as --name value, --name=value,
+// or --name alone for ArgBool flags. An ArgText argument must be the last
+// positional argument and takes everything after it.
+type ArgSpec struct {
+	Name     string
+	Type     string
+	Optional bool
+	Flag     bool
+	Choices  []string // Values of an ArgEnum (case insensitive)
+}
+
+// ArgValue is a parsed argument.
+type ArgValue struct {
+	Present  bool
+	Raw      string
+	Text     string // Strings, text, enums (lowercase) and usernames (without @)
+	Number   float64
+	Integer  int64
+	Duration time.Duration
+	Colour   RGB
+}
+
+// ErrUsage reports invalid command arguments with the usage of the command.
+type ErrUsage struct {
+	Reason string
+	Usage  string
+}
+
+func (e *ErrUsage) Error() string {
+	return fmt.Sprintf("%s. %s", e.Reason, e.Usage)
+}
+
+// Usage describes the arguments of a command, e.g.
+//
+//	Usage: !deaths [add|set] [amount] [--silent]
+func Usage(name string, specs []ArgSpec) string {
+	sb := strings.Builder{}
+	sb.WriteString("Usage: !")
+	sb.WriteString(name)
+	for _, spec := range specs {
+		placeholder := spec.Name
+		if spec.Type == ArgEnum {
+			placeholder = strings.Join(spec.Choices, "|")
+		}
+		if spec.Flag {
+			placeholder = "--" + spec.Name
+			if spec.Type == ArgEnum {
+				placeholder += " " + strings.Join(spec.Choices, "|")
+			} else if spec.Type != ArgBool {
+				placeholder += " " + spec.Type
+			}
+		}
+		if spec.Optional || spec.Flag {
+			fmt.Fprintf(&sb, " [%s]", placeholder)
+		} else {
+			fmt.Fprintf(&sb, " <%s>", placeholder)
+		}
+	}
+	return sb.String()
+}
+
+type argWord struct {
+	Text  string
+	Start int // Byte offset in the input
+}
+
+// scanArg reads the word of s starting at or after byte i. Double or
+// single quotes at the start of a word group words, and a backslash escapes
+// the next character inside double quotes. Quotes inside a word, as in
+// "don't", are kept as typed. ok is false once s has no more words.
+func scanArg(s string, i int) (word argWord, next int, ok bool, err error) {
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		i += size
+	}
+	if i == len(s) {
+		return argWord{}, i, false, nil
+	}
+
+	var sb strings.Builder
+	word.Start = i
+	var quote rune
+	escaped := false
+	for j, r := range s[i:] {
+		switch {
+		case escaped:
+			sb.WriteRune(r)
+			escaped = false
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' {
+				escaped = true
+			} else {
+				sb.WriteRune(r)
+			}
+		case unicode.IsSpace(r):
+			word.Text = sb.String()
+			return word, i + j, true, nil
+		case j == 0 && (r == '"' || r == '\''):
+			quote = r
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	if quote != 0 || escaped {
+		return argWord{}, len(s), false, fmt.Errorf("unterminated quote")
+	}
+	word.Text = sb.String()
+	return word, len(s), true, nil
+}
+
+// splitArgs splits s into words separated by whitespace (see scanArg).
+func splitArgs(s string) ([]argWord, error) {
+	var words []argWord
+	for i := 0; ; {
+		word, next, ok, err := scanArg(s, i)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return words, nil
+		}
+		words = append(words, word)
+		i = next
+	}
+}
+
+// parseArgValue converts a word to the type of spec.
+func parseArgValue(spec ArgSpec, raw string) (ArgValue, error) {
+	v := ArgValue{Present: true, Raw: raw, Text: raw}
+	invalid := func(what string) (ArgValue, error) {
+		return v, fmt.Errorf("%s: %q is not %s", spec.Name, raw, what)
+	}
+
+	switch spec.Type {
+	case ArgMention:
+		name := strings.TrimPrefix(raw, "@")
+		if name == "" {
+			return invalid("a username")
+		}
+		for _, r := range name {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_-.·", r) {
+				return invalid("a username")
+			}
+		}
+		v.Text = name
+	case ArgDuration:
+		if seconds, err := strconv.Atoi(raw); err == nil && seconds >= 0 {
+			v.Duration = time.Duration(seconds) * time.Second
+			break
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return invalid("a duration")
+		}
+		v.Duration = d
+	case ArgColour:
+		c, err := ParseColour(raw)
+		if err != nil {
+			return invalid("a colour")
+		}
+		v.Colour = c
+	case ArgNumber:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return invalid("a number")
+		}
+		v.Number = n
+	case ArgInteger:
+		n, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			return invalid("a whole number")
+		}
+		v.Integer = n
+		v.Number = float64(n)
+	case ArgEnum:
+		v.Text = strings.ToLower(raw)
+		if !slices.Contains(spec.Choices, v.Text) {
+			return invalid("one of " + strings.Join(spec.Choices, ", "))
+		}
+	}
+	return v, nil
+}
+
+// isFlag reports whether s starts with one of flags.
+func isFlag(s string, flags map[string]ArgSpec) bool {
+	name, ok := strings.CutPrefix(s, "--")
+	if !ok {
+		return false
+	}
+	if end := strings.IndexFunc(name, unicode.IsSpace); end >= 0 {
+		name = name[:end]
+	}
+	name, _, _ = strings.Cut(name, "=")
+	_, ok = flags[name]
+	return ok
+}
+
+// ParseArgs parses the input of the named command against its declared
+// arguments. Errors are *ErrUsage.
+func ParseArgs(name string, specs []ArgSpec, input string) (map[string]ArgValue, error) {
+	usageError := func(format string, a ...any) (map[string]ArgValue, error) {
+		return nil, &ErrUsage{Reason: fmt.Sprintf(format, a...), Usage: Usage(name, specs)}
+	}
+
+	var positional []ArgSpec
+	flags := make(map[string]ArgSpec)
+	for _, spec := range specs {
+		if spec.Flag {
+			flags[spec.Name] = spec
+		} else {
+			positional = append(positional, spec)
+		}
+	}
+
+	// Words are read one at a time, so the text argument is taken as typed
+	// without being split, whatever quotes it contains.
+	values := make(map[string]ArgValue)
+	next := 0
+	for i := 0; ; {
+		rest := strings.TrimSpace(input[i:])
+		if next < len(positional) && positional[next].Type == ArgText && rest != "" && !isFlag(rest, flags) {
+			spec := positional[next]
+			next++
+			values[spec.Name] = ArgValue{Present: true, Raw: rest, Text: rest}
+			break
+		}
+
+		word, end, ok, err := scanArg(input, i)
+		if err != nil {
+			return usageError("%v", err)
+		}
+		if !ok {
+			break
+		}
+		i = end
+
+		if flag, ok := strings.CutPrefix(word.Text, "--"); ok && flag != "" {
+			flag, value, hasValue := strings.Cut(flag, "=")
+			spec, ok := flags[flag]
+			if !ok {
+				return usageError("unknown option --%s", flag)
+			}
+			if spec.Type == ArgBool {
+				if hasValue {
+					return usageError("--%s takes no value", flag)
+				}
+				values[flag] = ArgValue{Present: true, Raw: word.Text}
+				continue
+			}
+			if !hasValue {
+				valueWord, end, ok, err := scanArg(input, i)
+				if err != nil {
+					return usageError("%v", err)
+				}
+				if !ok {
+					return usageError("--%s needs a value", flag)
+				}
+				i = end
+				value = valueWord.Text
+			}
+			v, err := parseArgValue(spec, value)
+			if err != nil {
+				return usageError("%v", err)
+			}
+			values[flag] = v
+			continue
+		}
+
+		if next == len(positional) {
+			return usageError("too many arguments")
+		}
+		spec := positional[next]
+		next++
+		v, err := parseArgValue(spec, word.Text)
+		if err != nil {
+			return usageError("%v", err)
+		}
+		values[spec.Name] = v
+	}
+
+	for _, spec := range positional[next:] {
+		if !spec.Optional {
+			return usageError("missing %s", spec.Name)
+		}
+	}
+	return values, nil
+}
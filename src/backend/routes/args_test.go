@@ -0,0 +1,149 @@
+package routes
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSplitArgs(t *testing.T) {
+	words, err := splitArgs(`  add  "two words" 'single quoted' it's don't"  "say \"hi\""`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"add", "two words", "single quoted", "it's", `don't"`, `say "hi"`}
+	if len(words) != len(expected) {
+		t.Fatalf("Expected %q, got %+v", expected, words)
+	}
+	for i, w := range words {
+		if w.Text != expected[i] {
+			t.Errorf("Word %d: expected %q, got %q", i, expected[i], w.Text)
+		}
+	}
+	if _, err := splitArgs(`"open`); err == nil {
+		t.Error("Expected unterminated quote error")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	specs := []ArgSpec{
+		{Name: "target", Type: ArgMention},
+		{Name: "length", Type: ArgDuration},
+		{Name: "times", Type: ArgNumber, Optional: true},
+		{Name: "mode", Type: ArgEnum, Choices: []string{"soft", "hard"}, Flag: true},
+		{Name: "colour", Type: ArgColour, Flag: true},
+		{Name: "silent", Type: ArgBool, Flag: true},
+		{Name: "reason", Type: ArgText, Optional: true},
+	}
+	const usage = "Usage: !timeout <target> <length> [times] [--mode soft|hard] [--colour colour] [--silent] [reason]"
+	if got := Usage("timeout", specs); got != usage {
+		t.Errorf("Expected %q, got %q", usage, got)
+	}
+
+	values, err := ParseArgs("timeout", specs, `@dayo 5m --mode=HARD 2 --silent --colour "#ff0000"  spamming  "links"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := values["target"]; v.Text != "dayo" {
+		t.Errorf("Unexpected target: %+v", v)
+	}
+	if v := values["length"]; v.Duration != 5*time.Minute {
+		t.Errorf("Unexpected length: %+v", v)
+	}
+	if v := values["times"]; v.Number != 2 {
+		t.Errorf("Unexpected times: %+v", v)
+	}
+	if v := values["mode"]; v.Text != "hard" {
+		t.Errorf("Unexpected mode: %+v", v)
+	}
+	if v := values["colour"]; v.Colour != (RGB{255, 0, 0}) {
+		t.Errorf("Unexpected colour: %+v", v)
+	}
+	if !values["silent"].Present {
+		t.Error("Expected silent flag")
+	}
+	if v := values["reason"]; v.Text != `spamming  "links"` {
+		t.Errorf("Expected text as typed, got %q", v.Text)
+	}
+
+	errorTests := map[string]string{
+		"dayo":             "missing length",
+		"dayo soon":        `length: "soon" is not a duration`,
+		"dayo 90 x":        `times: "x" is not a number`,
+		"dayo 90 --mode":   "--mode needs a value",
+		"dayo 90 --mode x": `mode: "x" is not one of soft, hard`,
+		"dayo 90 --what":   "unknown option --what",
+		"@ 90":             `target: "@" is not a username`,
+		`dayo "90`:         "unterminated quote",
+	}
+	for input, reason := range errorTests {
+		_, err := ParseArgs("timeout", specs, input)
+		var usageErr *ErrUsage
+		if !errors.As(err, &usageErr) || usageErr.Reason != reason || usageErr.Usage != usage {
+			t.Errorf("%s: expected %q, got %v", input, reason, err)
+		}
+	}
+
+	if _, err := ParseArgs("help", []ArgSpec{{Name: "command", Type: ArgString, Optional: true}}, "a b"); err == nil {
+		t.Error("Expected too many arguments")
+	}
+}
+
+func TestParseArgsApostrophes(t *testing.T) {
+	specs := []ArgSpec{
+		{Name: "author", Type: ArgMention, Flag: true},
+		{Name: "game", Type: ArgString, Flag: true},
+		{Name: "text", Type: ArgText},
+	}
+	tests := []struct {
+		input  string
+		author string
+		game   string
+		text   string
+	}{
+		{"I'm here", "", "", "I'm here"},
+		{"don't stop me now", "", "", "don't stop me now"},
+		{"'tis the season", "", "", "'tis the season"},
+		{`it's "fine`, "", "", `it's "fine`},
+		{`--author dayo --game "Baldur's Gate" it's me`, "dayo", "Baldur's Gate", "it's me"},
+		{"--game=Portal --unknown don't", "", "Portal", "--unknown don't"},
+	}
+	for _, test := range tests {
+		values, err := ParseArgs("addquote", specs, test.input)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if values["author"].Text != test.author || values["game"].Text != test.game || values["text"].Text != test.text {
+			t.Errorf("%s: unexpected values %+v", test.input, values)
+		}
+	}
+
+	values, err := ParseArgs("addcom", customCommandArgs, "hi it's me")
+	if err != nil || values["name"].Text != "hi" || values["response"].Text != "it's me" {
+		t.Errorf("Unexpected addcom values %+v: %v", values, err)
+	}
+	if _, err := ParseArgs("addcom", customCommandArgs, "'hi there"); err == nil {
+		t.Error("Expected unterminated quote in the name")
+	}
+}
+
+func TestCommandUsageErrors(t *testing.T) {
+	r := NewCommandRegistry()
+	r.Register(CommandFunc{
+		CommandInfo: CommandInfo{Name: "so", Args: []ArgSpec{{Name: "user", Type: ArgMention}}},
+		Handler: func(c *CommandContext) (Message, error) {
+			return c.Parser.CreateResponse("Go follow " + c.Arg("user").Text), nil
+		},
+	})
+	parser := CommandParser{Commands: r}
+
+	msg := Message{Author: "dayo", Tokens: []Token{{Type: TokenTypeCommand, Text: "so"}}}
+	if got, _ := parser.Parse(msg); got.Message != "@dayo missing user. Usage: !so <user>" {
+		t.Errorf("Unexpected usage error: %q", got.Message)
+	}
+	msg.Tokens[0].Text = "so @hp_az"
+	if got, _ := parser.Parse(msg); got.Message != "Go follow hp_az" {
+		t.Errorf("Unexpected response: %q", got.Message)
+	}
+}
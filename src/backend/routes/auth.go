@@ -326,6 +326,39 @@ func SessionMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// isModerator reports whether username is listed in WS_MOD_USERS.
+func isModerator(username string) bool {
+	if username == "" {
+		return false
+	}
+	for _, mod := range strings.Split(os.Getenv("WS_MOD_USERS"), ",") {
+		if mod = strings.TrimSpace(mod); mod != "" && strings.EqualFold(mod, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireModerator writes an error response unless the session user is a
+// moderator.
+func requireModerator(w http.ResponseWriter, r *http.Request) bool {
+	sessionToken, err := getSessionTokenFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: No session token", http.StatusUnauthorized)
+		return false
+	}
+	username, err := getUsernameFromSession(sessionToken)
+	if err != nil {
+		http.Error(w, "Failed to get username from session", http.StatusInternalServerError)
+		return false
+	}
+	if !isModerator(username) {
+		http.Error(w, "Forbidden: Not a moderator", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func sessionCheckHandler(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("session_token")
 	if err != nil {
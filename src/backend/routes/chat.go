@@ -17,8 +17,6 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
-
-	"github.com/jdavasligil/emodl"
 )
 
 // Initialize a Redis client as a global variable.
@@ -41,24 +39,35 @@ func (m *CmdMap) Range(f func(key string, cmd *exec.Cmd) bool) {
 
 var chatFetchCmds CmdMap
 
+var wsGuard = NewWSGuard(WSGuardOptions{})
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for simplicity; adjust as needed for security
+		return wsGuard.CheckOrigin(r)
 	},
 }
 
 var tokenizer Tokenizer
 
+// Server default used to order emote images
+var emoteImagePreference = DefaultImagePreference
+
+var sevenTVEvents *SevenTVEvents
+
 var commandParser CommandParser
 
-// TODO: replace with table in SQLite
-var userColorMap map[string]string = make(map[string]string)
+var colourPreferences = NewColourPreferences()
 
 type Image struct {
 	URL    string `json:"url"`
 	Width  int    `json:"width"`
 	Height int    `json:"height"`
 	ID     string `json:"id"`
+
+	// Variant of third party emote images (see emoteimage.go)
+	Scale    string `json:"scale,omitempty"`
+	Format   string `json:"format,omitempty"`
+	Animated bool   `json:"animated,omitempty"`
 }
 
 type Emote struct {
@@ -66,6 +75,12 @@ type Emote struct {
 	Name      string   `json:"name"`
 	Locations []string `json:"locations"`
 	Images    []Image  `json:"images"`
+
+	// Third party provider (see emote.go), empty for native emotes
+	Provider string `json:"provider,omitempty"`
+
+	// Zero-width emotes are drawn over the preceding emote
+	ZeroWidth bool `json:"zeroWidth,omitempty"`
 }
 
 type Badge struct {
@@ -77,6 +92,7 @@ type Badge struct {
 }
 
 type Message struct {
+	ID      string  `json:"id,omitempty"`
 	Author  string  `json:"author"` // Adjusted to directly receive the author's name as a string
 	Message string  `json:"message"`
 	Tokens  []Token `json:"fragments"`
@@ -84,6 +100,18 @@ type Message struct {
 	Badges  []Badge `json:"badges"`
 	Source  string  `json:"source"`
 	Colour  string  `json:"colour"`
+
+	// Username colour chosen with !color (Colour holds its first stop)
+	ColourPreference *ColourPreference `json:"colourPreference,omitempty"`
+
+	// Normalized role of the author, derived from the badges
+	Role Role `json:"role"`
+
+	// Created by EloraChat, and delivered to the platforms by the responder
+	Response bool `json:"-"`
+
+	// Set per client when the message mentions the logged in user
+	MentionsMe bool `json:"mentionsMe,omitempty"`
 }
 
 func InitRoutes(timeout time.Duration) {
@@ -118,49 +146,91 @@ func InitRoutes(timeout time.Duration) {
 		}
 	}
 
+	// Initialize websocket guard
+	wsGuard = NewWSGuard(WSGuardOptionsFromEnv())
+
+	// Initialize presence tracking shared with other instances
+	instanceID, err := generateState()
+	if err != nil {
+		log.Fatalf("presence: Failed to generate instance ID: %v", err)
+	}
+	presence = NewPresence(instanceID)
+	go presence.Run(presenceTTL / 3)
+
+	// Initialize link policy
+	linkPolicy = LinkPolicyFromEnv()
+
 	// Initialize tokenizer
 	tokenizer.TextEffectSep = ':'
 	tokenizer.TextCommandPrefix = '!'
-
-	// Initialize command parser
-	// TODO: Replace hardcoded timer duration with config setting
+	tokenizer.Authors = NewAuthorCache()
+	tokenizer.EmojiURLTemplate = os.Getenv("EMOJI_URL_TEMPLATE")
+	tokenizer.EffectRoles = EffectRolesFromEnv()
+	tokenizer.Emotes = NewEmoteRegistry(nil)
+	tokenizer.Commands = DefaultCommands()
+	emoteImagePreference = ImagePreferenceFromEnv()
+
+	// Initialize command parser. Cooldowns are shared through Redis.
 	commandParser = CommandParser{
-		HelpTimer:         time.NewTimer(10 * time.Second),
-		HelpResetDuration: 10 * time.Second,
-	}
-
-	// Load third party emotes
-	downloader := emodl.NewDownloader(emodl.DownloaderOptions{
-		// TEMP: (Dayoman ID hard coded)
-		SevenTV: &emodl.SevenTVOptions{
-			Platform:   "twitch",
-			PlatformID: "39226538",
-		},
-		BTTV: &emodl.BTTVOptions{
-			Platform:   "twitch",
-			PlatformID: "39226538",
-		},
-		FFZ: &emodl.FFZOptions{
-			Platform:   "twitch",
-			PlatformID: "39226538",
-		},
+		Commands:     tokenizer.Commands,
+		Cooldowns:    NewCooldownManager(redisClient),
+		Colours:      colourPreferences,
+		ColourPolicy: ColourPolicyFromEnv(),
+	}
+	if err := colourPreferences.Load(); err != nil {
+		log.Printf("redis: Failed to load colour preferences: %v", err)
+	}
+
+	// Deliver command responses back to the platform chats
+	responder = ResponderFromEnv()
+
+	// Recurring announcements
+	timers = NewTimers(announceTimer)
+	if err := timers.Load(); err != nil {
+		log.Printf("redis: Failed to load timers: %v", err)
+	}
+	go timers.Run()
+	customCommands = NewCustomCommands(tokenizer.Commands)
+	if err := customCommands.Load(); err != nil {
+		log.Printf("redis: Failed to load custom commands: %v", err)
+	}
+	streamInfo = StreamInfoFromEnv()
+	quotes = NewQuoteBook(tokenizer.Commands)
+	quotes.Game = streamInfo.Game
+	if err := quotes.Load(); err != nil {
+		log.Printf("redis: Failed to load quotes: %v", err)
+	}
+	counters = NewCounters(tokenizer.Commands, publishCounterChange)
+	if err := counters.Load(); err != nil {
+		log.Printf("redis: Failed to load counters: %v", err)
+	}
+	go syncState(map[string]func() error{
+		StateCustomCommands: customCommands.Load,
+		StateCounters:       counters.Load,
+		StateQuotes:         quotes.Load,
+		StateTimers:         timers.Load,
+		StateColours:        colourPreferences.Load,
 	})
-	emoteCacheTmp, err := downloader.Load()
-	if err != nil {
-		log.Printf("emodl: Failed to load third party emotes: %v", err)
+
+	// Load global third party emotes. Channel emotes are loaded as chat
+	// fetches start.
+	if err := loadEmoteAdmin(tokenizer.Emotes); err != nil {
+		log.Printf("redis: Failed to load custom emotes: %v", err)
 	}
-	tokenizer.EmoteCache = make(map[string]Emote, len(emoteCacheTmp))
-	for name, emote := range emoteCacheTmp {
-		tokenizer.EmoteCache[name] = Emote{
-			ID:        emote.ID,
-			Name:      emote.Name,
-			Locations: emote.Locations,
-			Images:    []Image{Image(emote.Images[0])},
-		}
+	emoteSets = EmoteSetsFromEnv(tokenizer.Emotes)
+	emoteSets.OnChange = publishEmoteSetChange
+	if err := emoteSets.RefreshGlobal(); err != nil {
+		log.Printf("emodl: Failed to load third party emotes: %v", err)
 	}
+	go emoteSets.Run()
+
+	// Live channel emote updates
+	sevenTVEvents = NewSevenTVEvents(emoteSets)
+	sevenTVEvents.OnChange = publishEmoteSetChange
+	emoteSets.OnAdd = sevenTVEvents.Follow
 	// DEBUG
 	// log.Println("3P EMOTES SUPPORTED")
-	// for _, e := range tokenizer.EmoteCache {
+	// for _, e := range tokenizer.Emotes.Snapshot().Global {
 	// 	log.Println(e.Name)
 	// }
 }
@@ -170,8 +240,12 @@ func StartChatFetch(urls []string) {
 	fetchChatScript := "/app/python/fetch_chat.py"
 
 	for _, url := range urls {
+		emoteSets.AddChannel(url)
+		responder.AddChannel(url)
+		streamInfo.AddChannel(url)
 		go monitorAndRestartChatFetch(url, pythonExecPath, fetchChatScript)
 	}
+	go sevenTVEvents.Run()
 }
 
 func monitorAndRestartChatFetch(url, pythonExecPath, fetchChatScript string) {
@@ -212,7 +286,6 @@ func processChatOutput(stdout io.ReadCloser, url string) {
 	scanner := bufio.NewScanner(stdout)
 	for scanner.Scan() {
 		var msg Message
-		var err error
 		rawMessage := scanner.Bytes()
 		if err := json.Unmarshal(rawMessage, &msg); err != nil {
 			log.Printf("chat: Failed to unmarshal message: %v, Raw message: %s\n", err, string(rawMessage))
@@ -224,64 +297,210 @@ func processChatOutput(stdout io.ReadCloser, url string) {
 			msg.Source = "YouTube"
 		}
 
-		// Add unknown emotes to the emote cache for tokenization
-		for _, e := range msg.Emotes {
-			tokenizer.EmoteCache[e.Name] = e
+		// Skip responses of the bot accounts, already shown as EloraChat
+		if responder.IsBot(msg.Author) {
+			continue
 		}
 
-		// Tokenize message
+		msg.Role = messageRole(msg)
+
+		// Tokenize message. Platform emotes are matched by position in
+		// this message, and learned by name for later messages of the
+		// channel.
 		msg.Tokens = make([]Token, 0)
-		for token := range tokenizer.Iter(msg.Message) {
+		for token := range tokenizer.IterMessage(msg, url) {
 			msg.Tokens = append(msg.Tokens, token)
 		}
+		for _, e := range msg.Emotes {
+			tokenizer.Emotes.Learn(url, e)
+		}
 
-		// Process command
-		if len(msg.Tokens) > 0 && msg.Tokens[0].Type == TokenTypeCommand {
-			msg, err = commandParser.Parse(msg, userColorMap)
-			if err != nil {
-				log.Printf("chat: Failed to process command: %v, Message: %#v\n", err, msg)
+		// Apply link policy before commands can store or repeat the links
+		msg, ok := linkPolicy.Apply(msg)
+		if !ok {
+			if linkPolicy.Mode == LinkPolicyApproval {
+				if err := holdForApproval(msg, url); err != nil {
+					log.Printf("redis: Failed to hold message for approval: %v\n", err)
+				}
 			}
+			continue
 		}
 
-		// Apply user preferences
-		// TODO: Replace map lookup with db query
-		if _, ok := userColorMap[msg.Author]; ok {
-			msg.Colour = userColorMap[msg.Author]
+		if err := deliverMessage(msg, url); err != nil {
+			log.Printf("chat: Failed to deliver message: %v, Message: %#v\n", err, msg)
 		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Println("chat: Error reading standard output:", err)
+	}
+}
 
-		// Prevent nil slices
-		if msg.Emotes == nil {
-			msg.Emotes = []Emote{}
-		}
-		if msg.Badges == nil {
-			msg.Badges = []Badge{}
+// deliverMessage runs the command of a message from url that passed the link
+// policy, publishes it with its responses, and sends the responses back to
+// the chat. It fails if the message could not be published.
+func deliverMessage(msg Message, url string) error {
+	// Process command
+	if len(msg.Tokens) > 0 && msg.Tokens[0].Type == TokenTypeCommand {
+		var err error
+		msg, err = commandParser.Parse(msg)
+		if err != nil {
+			log.Printf("chat: Failed to process command: %v, Message: %#v\n", err, msg)
 		}
+	}
+
+	// Report invalid effects back to the author
+	var responses []Message
+	if response, ok := effectErrorResponse(msg); ok {
+		responses = append(responses, response)
+	}
 
-		// Re-marshal the message with the Source set.
-		modifiedMessage, err := json.Marshal(msg)
+	// Apply user preferences
+	if pref, ok := colourPreferences.Get(msg.Author); ok {
+		msg.Colour = pref.Colour()
+		msg.ColourPreference = &pref
+	}
+
+	// Remember the author for cross-platform mentions
+	tokenizer.Authors.Seen(msg.Author, msg.Source, msg.Colour)
+
+	// Prevent nil slices
+	if msg.Emotes == nil {
+		msg.Emotes = []Emote{}
+	}
+	if msg.Badges == nil {
+		msg.Badges = []Badge{}
+	}
+
+	// Re-marshal the message with the Source set.
+	modifiedMessage, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal message: %w", err)
+	}
+
+	// Add the modified message to Redis Stream.
+	publishErr := publishMessage(modifiedMessage)
+	if publishErr != nil {
+		publishErr = fmt.Errorf("add message to stream: %w", publishErr)
+	}
+	timers.Line()
+	if msg.Response {
+		responder.Respond(url, msg.Message)
+	}
+	for _, response := range responses {
+		responder.Respond(url, response.Message)
+		data, err := json.Marshal(response)
 		if err != nil {
-			log.Printf("chat: Failed to marshal message: %v, Message: %#v\n", err, msg)
+			log.Printf("chat: Failed to marshal response: %v, Response: %#v\n", err, response)
 			continue
 		}
+		if err := publishMessage(data); err != nil {
+			log.Printf("redis: Failed to add response to stream: %v\n", err)
+		}
+	}
+	return publishErr
+}
 
-		// Add the modified message to Redis Stream.
-		_, err = redisClient.XAdd(ctx, &redis.XAddArgs{
-			Stream: "chatMessages",
-			Values: map[string]any{"message": string(modifiedMessage)},
-			MaxLen: 100,
-			Approx: true,
-		}).Result()
-		if err != nil {
-			log.Printf("redis: Failed to add message to stream: %v, Modified message: %s\n", err, string(modifiedMessage))
+// Cooldown of effect error replies, so that repeating an invalid effect does
+// not make the bot spam the chat
+var effectErrorCooldown = Cooldown{User: 30 * time.Second, Exempt: RoleModerator}
+
+// effectErrorResponse answers the first invalid effect of msg, unless its
+// author was answered recently.
+func effectErrorResponse(msg Message) (Message, bool) {
+	for _, tok := range msg.Tokens {
+		if tok.Error == "" {
+			continue
+		}
+		if commandParser.Cooldowns != nil && !commandParser.Cooldowns.Allow("effect-error", cooldownUser(msg), msg.Role, effectErrorCooldown) {
+			return Message{}, false
 		}
+		return commandParser.CreateResponse(fmt.Sprintf("@%s %s", msg.Author, tok.Error)), true
 	}
-	if err := scanner.Err(); err != nil {
-		log.Println("chat: Error reading standard output:", err)
+	return Message{}, false
+}
+
+// publishMessage adds a marshaled message to the public chat stream.
+func publishMessage(message []byte) error {
+	return redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: "chatMessages",
+		Values: map[string]any{"message": string(message)},
+		MaxLen: 100,
+		Approx: true,
+	}).Err()
+}
+
+// publishEvent broadcasts a typed event to the websocket clients of every
+// instance. Events are not kept in the message history.
+func publishEvent(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return redisClient.Publish(ctx, chatEventsChannel, data).Err()
+}
+
+// Redis pub/sub channel naming the state that changed on one instance and is
+// reloaded by every instance
+const stateChangesChannel = "stateChanges"
+
+// Kinds of state published on stateChangesChannel
+const (
+	StateCustomCommands = "commands"
+	StateCounters       = "counters"
+	StateQuotes         = "quotes"
+	StateTimers         = "timers"
+	StateColours        = "colours"
+)
+
+// notifyStateChange asks every instance, this one included, to reload state.
+func notifyStateChange(state string) {
+	if redisClient == nil {
+		return
+	}
+	if err := redisClient.Publish(ctx, stateChangesChannel, state).Err(); err != nil {
+		log.Printf("redis: Failed to publish %s change: %v", state, err)
+	}
+}
+
+// syncState reloads the state changed by any instance until the process
+// exits.
+func syncState(reload map[string]func() error) {
+	changes := redisClient.Subscribe(ctx, stateChangesChannel)
+	defer changes.Close()
+	for msg := range changes.Channel() {
+		if f, ok := reload[msg.Payload]; ok {
+			if err := f(); err != nil {
+				log.Printf("redis: Failed to reload %s: %v", msg.Payload, err)
+			}
+		}
+	}
+}
+
+func publishEmoteSetChange(change EmoteSetChange) {
+	if err := publishEvent(Event{Event: EventEmoteSetChanged, Data: change}); err != nil {
+		log.Printf("redis: Failed to publish emote set change: %v", err)
 	}
 }
 
 // StreamChat initializes a WebSocket connection and streams chat messages
 func StreamChat(w http.ResponseWriter, r *http.Request) {
+	streamMessages(w, r, "chatMessages", ScopePublic)
+}
+
+// StreamModChat streams the private moderator feed. Requires a mod token.
+func StreamModChat(w http.ResponseWriter, r *http.Request) {
+	streamMessages(w, r, "modMessages", ScopeMod)
+}
+
+// streamMessages upgrades the connection after the guard admits it and
+// forwards every message added to the given Redis stream.
+func streamMessages(w http.ResponseWriter, r *http.Request, stream string, scope string) {
+	_, release, ok := wsGuard.Admit(w, r, scope)
+	if !ok {
+		return
+	}
+	defer release()
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Print("ws: WebSocket upgrade error:", err)
@@ -289,14 +508,60 @@ func StreamChat(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
+	// Track presence by room (defaults to the route scope) and client type
+	room := NormalizeRoom(r.URL.Query().Get("room"), scope)
+	leave := presence.Join(room, r.URL.Query().Get("client"))
+	defer leave()
+
+	// Logged in clients get their mentions highlighted
+	var username string
+	if cookie, err := r.Cookie("session_token"); err == nil {
+		username, _ = getUsernameFromSession(cookie.Value)
+	}
+
+	// Clients may ask for a single emote image of a given scale and format
+	imagePreference, hasImagePreference := ImagePreferenceFromQuery(r.URL.Query(), emoteImagePreference)
+
+	// Adapt a stored message for this client
+	prepare := func(m []byte) []byte {
+		var msg Message
+		if err := json.Unmarshal(m, &msg); err != nil {
+			log.Println("json: ", err)
+			return m
+		}
+		if msg.Tokens == nil {
+			msg.Tokens = []Token{}
+		}
+		if msg.Emotes == nil {
+			msg.Emotes = []Emote{}
+		}
+		if msg.Badges == nil {
+			msg.Badges = []Badge{}
+		}
+		msg.MentionsMe = msg.MentionsUser(username)
+		if hasImagePreference {
+			msg = imagePreference.Apply(msg)
+		}
+		prepared, err := json.Marshal(msg)
+		if err != nil {
+			log.Println("json: ", err)
+			return m
+		}
+		return prepared
+	}
+
 	// Channel to signal closure of WebSocket connection
 	done := make(chan struct{})
 	messageChan := make(chan []byte, 8)
 
+	// Typed events shared by all streams
+	events := redisClient.Subscribe(ctx, chatEventsChannel)
+	defer events.Close()
+
 	lastID := "0" // Start from the beginning of the stream
 
 	// Read the last 100 messages from the stream to send to the client immediately.
-	streams, err := redisClient.XRevRangeN(ctx, "chatMessages", "+", "-", 100).Result()
+	streams, err := redisClient.XRevRangeN(ctx, stream, "+", "-", 100).Result()
 	if err != nil {
 		log.Printf("redis: Failed to read messages from stream: %v\n", err)
 		return
@@ -305,7 +570,7 @@ func StreamChat(w http.ResponseWriter, r *http.Request) {
 	// Send the messages in reverse order so the newest will be at the bottom
 	for i := len(streams) - 1; i >= 0; i-- {
 		message := streams[i]
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(message.Values["message"].(string))); err != nil {
+		if err := conn.WriteMessage(websocket.TextMessage, prepare([]byte(message.Values["message"].(string)))); err != nil {
 			log.Println("ws: WebSocket write error:", err)
 			return
 		}
@@ -318,7 +583,7 @@ func StreamChat(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		for {
 			streams, err := redisClient.XRead(ctx, &redis.XReadArgs{
-				Streams: []string{"chatMessages", lastID},
+				Streams: []string{stream, lastID},
 				Block:   0,
 			}).Result()
 
@@ -344,28 +609,14 @@ func StreamChat(w http.ResponseWriter, r *http.Request) {
 		ticker := time.NewTicker(20 * time.Second)
 		defer ticker.Stop()
 
+		// Presence event ticker
+		presenceTicker := time.NewTicker(15 * time.Second)
+		defer presenceTicker.Stop()
+
 		for {
 			select {
 			case m := <-messageChan:
-				var msg Message
-				err := json.Unmarshal(m, &msg)
-				if err != nil {
-					log.Println("json: ", err)
-				}
-				if msg.Tokens == nil {
-					msg.Tokens = []Token{}
-				}
-				if msg.Emotes == nil {
-					msg.Emotes = []Emote{}
-				}
-				if msg.Badges == nil {
-					msg.Badges = []Badge{}
-				}
-				m, err = json.Marshal(msg)
-				if err != nil {
-					log.Println("json: ", err)
-				}
-				if err := conn.WriteMessage(websocket.TextMessage, m); err != nil {
+				if err := conn.WriteMessage(websocket.TextMessage, prepare(m)); err != nil {
 					log.Println("ws: WebSocket write error:", err)
 					return
 				}
@@ -374,6 +625,16 @@ func StreamChat(w http.ResponseWriter, r *http.Request) {
 					log.Println("ws: Failed to send keep-alive message:", err)
 					return
 				}
+			case e := <-events.Channel():
+				if err := conn.WriteMessage(websocket.TextMessage, []byte(e.Payload)); err != nil {
+					log.Println("ws: Failed to send event:", err)
+					return
+				}
+			case <-presenceTicker.C:
+				if err := conn.WriteJSON(presence.PresenceEvent(room)); err != nil {
+					log.Println("ws: Failed to send presence event:", err)
+					return
+				}
 			case <-done:
 				return
 			}
@@ -399,6 +660,12 @@ func ImageProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Uploaded emotes are served directly
+	if id, ok := strings.CutPrefix(imageURL, customEmotePath); ok {
+		serveCustomEmoteImage(w, id)
+		return
+	}
+
 	resp, err := http.Get(imageURL)
 	if err != nil || resp.StatusCode == 404 {
 		// Log error and serve a default placeholder image
@@ -432,11 +699,69 @@ func StopChatFetches(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "Chat fetch commands stopped. Restarting...")
 }
 
+// IssueStreamToken signs a websocket token for the logged in user.
+// Mod scope is only granted to users listed in WS_MOD_USERS.
+func IssueStreamToken(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if requestBody.Scope == "" {
+		requestBody.Scope = ScopePublic
+	}
+
+	sessionToken, err := getSessionTokenFromRequest(r)
+	if err != nil {
+		http.Error(w, "Unauthorized: No session token", http.StatusUnauthorized)
+		return
+	}
+	username, err := getUsernameFromSession(sessionToken)
+	if err != nil {
+		http.Error(w, "Failed to get username from session", http.StatusInternalServerError)
+		return
+	}
+
+	switch requestBody.Scope {
+	case ScopePublic:
+	case ScopeMod:
+		if !isModerator(username) {
+			http.Error(w, "Forbidden: Not a moderator", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "Unknown scope", http.StatusBadRequest)
+		return
+	}
+
+	token, err := wsGuard.SignToken(WSClaims{
+		Subject: username,
+		Scope:   requestBody.Scope,
+		Expiry:  time.Now().Add(12 * time.Hour).Unix(),
+	})
+	if err != nil {
+		http.Error(w, "Failed to sign token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
 // SetupChatRoutes sets up WebSocket routes
 func SetupChatRoutes(router *mux.Router) {
 	// Public routes
 	router.HandleFunc("/ws/chat", StreamChat).Methods("GET")
+	router.HandleFunc("/ws/mod", StreamModChat).Methods("GET")
 	router.HandleFunc("/imageproxy", ImageProxy).Methods("GET")
+	router.HandleFunc("/presence", GetPresence).Methods("GET")
+	router.HandleFunc(customEmotePath+"{id}", GetCustomEmoteImage).Methods("GET")
+	router.HandleFunc("/quotes", ListQuotes).Methods("GET")
+	router.HandleFunc("/quotes/export", ExportQuotes).Methods("GET")
+	router.HandleFunc("/quotes/{id:[0-9]+}", GetQuote).Methods("GET")
+	router.HandleFunc("/counters", ListCounters).Methods("GET")
 
 	// Subrouter for chat routes that require authentication
 	protectedRoutes := router.PathPrefix("").Subrouter()
@@ -444,4 +769,24 @@ func SetupChatRoutes(router *mux.Router) {
 
 	// Add protected chat routes to protectedRoutes
 	protectedRoutes.HandleFunc("/restart-server", StopChatFetches).Methods("POST")
+	protectedRoutes.HandleFunc("/ws/token", IssueStreamToken).Methods("POST")
+	protectedRoutes.HandleFunc("/links/approve", ApprovePendingMessage).Methods("POST")
+	protectedRoutes.HandleFunc("/emotes", ListEmotes).Methods("GET")
+	protectedRoutes.HandleFunc("/emotes/refresh", RefreshEmotes).Methods("POST")
+	protectedRoutes.HandleFunc("/emotes/disable", SetEmoteDisabled).Methods("POST")
+	protectedRoutes.HandleFunc("/emotes/custom", UploadCustomEmote).Methods("POST")
+	protectedRoutes.HandleFunc(customEmotePath+"{id}", DeleteCustomEmote).Methods("DELETE")
+	protectedRoutes.HandleFunc("/commands/custom", ListCustomCommands).Methods("GET")
+	protectedRoutes.HandleFunc("/commands/custom", CreateCustomCommand).Methods("POST")
+	protectedRoutes.HandleFunc("/commands/custom/{name}", UpdateCustomCommand).Methods("PUT")
+	protectedRoutes.HandleFunc("/commands/custom/{name}", DeleteCustomCommand).Methods("DELETE")
+	protectedRoutes.HandleFunc("/timers", ListTimers).Methods("GET")
+	protectedRoutes.HandleFunc("/timers", CreateTimer).Methods("POST")
+	protectedRoutes.HandleFunc("/timers/{id}", UpdateTimer).Methods("PUT")
+	protectedRoutes.HandleFunc("/timers/{id}", DeleteTimer).Methods("DELETE")
+	protectedRoutes.HandleFunc("/quotes", CreateQuote).Methods("POST")
+	protectedRoutes.HandleFunc("/quotes/{id:[0-9]+}", DeleteQuote).Methods("DELETE")
+	protectedRoutes.HandleFunc("/counters", CreateCounter).Methods("POST")
+	protectedRoutes.HandleFunc("/counters/{name}", UpdateCounter).Methods("PUT")
+	protectedRoutes.HandleFunc("/counters/{name}", DeleteCounter).Methods("DELETE")
 }
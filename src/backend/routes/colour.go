@@ -0,0 +1,307 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	colourPreferencesKey = "colours"
+
+	// Gradient stops accepted by !color
+	maxGradientStops = 4
+
+	// WCAG AA contrast for normal text
+	DefaultMinContrast = 4.5
+)
+
+var ErrInvalidColour = errors.New("invalid colour")
+
+type RGB struct {
+	R, G, B uint8
+}
+
+func (c RGB) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// luminance returns the WCAG relative luminance of c.
+func (c RGB) luminance() float64 {
+	channel := func(v uint8) float64 {
+		s := float64(v) / 255
+		if s <= 0.03928 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	return 0.2126*channel(c.R) + 0.7152*channel(c.G) + 0.0722*channel(c.B)
+}
+
+// Contrast returns the WCAG contrast ratio of c and bg (1 to 21).
+func (c RGB) Contrast(bg RGB) float64 {
+	a, b := c.luminance(), bg.luminance()
+	return (max(a, b) + 0.05) / (min(a, b) + 0.05)
+}
+
+// mix returns c moved towards target by t (0 to 1).
+func (c RGB) mix(target RGB, t float64) RGB {
+	lerp := func(a uint8, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + (float64(b)-float64(a))*t))
+	}
+	return RGB{lerp(c.R, target.R), lerp(c.G, target.G), lerp(c.B, target.B)}
+}
+
+// ParseColour parses a colour name, #RGB, #RRGGBB or rgb(r, g, b).
+func ParseColour(s string) (RGB, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if hex, ok := NameColors[s]; ok {
+		s = hex
+	}
+
+	if hex, ok := strings.CutPrefix(s, "#"); ok {
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if len(hex) != 6 || err != nil {
+			return RGB{}, fmt.Errorf("%w: %q", ErrInvalidColour, s)
+		}
+		return RGB{uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+	}
+
+	if args, ok := strings.CutPrefix(s, "rgb("); ok && strings.HasSuffix(args, ")") {
+		parts := strings.Split(strings.TrimSuffix(args, ")"), ",")
+		if len(parts) == 3 {
+			var c [3]uint8
+			for i, part := range parts {
+				v, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+				if err != nil {
+					return RGB{}, fmt.Errorf("%w: %q", ErrInvalidColour, s)
+				}
+				c[i] = uint8(v)
+			}
+			return RGB{c[0], c[1], c[2]}, nil
+		}
+	}
+
+	return RGB{}, fmt.Errorf("%w: %q", ErrInvalidColour, s)
+}
+
+// splitColourArgs splits s at the commas outside parentheses.
+func splitColourArgs(s string) []string {
+	var args []string
+	level, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			level++
+		case ')':
+			level--
+		case ',':
+			if level == 0 {
+				args = append(args, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+// ColourPreference is the username colour chosen by a user. A single stop
+// is a solid colour, more stops are a linear gradient.
+type ColourPreference struct {
+	Stops []string `json:"stops"`           // #rrggbb
+	Angle int      `json:"angle,omitempty"` // Gradient direction in degrees
+
+	// Some stops were changed to be readable on the chat background
+	Adjusted bool `json:"adjusted,omitempty"`
+}
+
+// Colour returns the first stop, used where a single colour is needed.
+func (p ColourPreference) Colour() string {
+	if len(p.Stops) == 0 {
+		return ""
+	}
+	return p.Stops[0]
+}
+
+// ParseColourPreference parses a colour (see ParseColour) or a gradient:
+//
+//	gradient(red, #00ff00, rgb(0, 0, 255))
+//	gradient(90deg, red, blue)
+func ParseColourPreference(s string) ([]RGB, int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	args, ok := strings.CutPrefix(s, "gradient(")
+	if !ok {
+		c, err := ParseColour(s)
+		return []RGB{c}, 0, err
+	}
+	if !strings.HasSuffix(args, ")") {
+		return nil, 0, fmt.Errorf("%w: unclosed gradient", ErrInvalidColour)
+	}
+
+	stops := splitColourArgs(strings.TrimSuffix(args, ")"))
+	angle := 0
+	if deg, ok := strings.CutSuffix(stops[0], "deg"); ok {
+		v, err := strconv.Atoi(deg)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: angle %q", ErrInvalidColour, stops[0])
+		}
+		angle = ((v % 360) + 360) % 360
+		stops = stops[1:]
+	}
+	if len(stops) < 2 || len(stops) > maxGradientStops {
+		return nil, 0, fmt.Errorf("%w: gradients have 2 to %d colours", ErrInvalidColour, maxGradientStops)
+	}
+
+	colours := make([]RGB, len(stops))
+	for i, stop := range stops {
+		c, err := ParseColour(stop)
+		if err != nil {
+			return nil, 0, err
+		}
+		colours[i] = c
+	}
+	return colours, angle, nil
+}
+
+// ColourPolicy keeps chosen colours readable on the chat background.
+type ColourPolicy struct {
+	Background  RGB
+	MinContrast float64
+	Adjust      bool // Adjust illegible colours instead of rejecting them
+}
+
+// ColourPolicyFromEnv reads the colour policy from the environment.
+//
+//	CHAT_BACKGROUND      background colour (default #000000)
+//	COLOUR_MIN_CONTRAST  minimum WCAG contrast ratio (default 4.5)
+//	COLOUR_CONTRAST      adjust (default) or reject
+func ColourPolicyFromEnv() ColourPolicy {
+	policy := ColourPolicy{MinContrast: DefaultMinContrast, Adjust: true}
+	if v := os.Getenv("CHAT_BACKGROUND"); v != "" {
+		bg, err := ParseColour(v)
+		if err != nil {
+			log.Printf("config: CHAT_BACKGROUND: %v", err)
+		}
+		policy.Background = bg
+	}
+	if v := os.Getenv("COLOUR_MIN_CONTRAST"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 1 || ratio > 21 {
+			log.Printf("config: COLOUR_MIN_CONTRAST must be between 1 and 21")
+		} else {
+			policy.MinContrast = ratio
+		}
+	}
+	policy.Adjust = strings.ToLower(os.Getenv("COLOUR_CONTRAST")) != "reject"
+	return policy
+}
+
+// Readable returns c, moved towards white or black, whichever contrasts more
+// with the background, if needed to reach the minimum contrast. ok is false
+// if c is illegible and cannot be adjusted.
+func (cp ColourPolicy) Readable(c RGB) (readable RGB, adjusted bool, ok bool) {
+	if c.Contrast(cp.Background) >= cp.MinContrast {
+		return c, false, true
+	}
+	target := RGB{255, 255, 255}
+	if black := (RGB{}); black.Contrast(cp.Background) > target.Contrast(cp.Background) {
+		target = black
+	}
+	if !cp.Adjust || target.Contrast(cp.Background) < cp.MinContrast {
+		return c, false, false
+	}
+
+	// Find the smallest change reaching the minimum contrast
+	lo, hi := 0.0, 1.0
+	for range 16 {
+		mid := (lo + hi) / 2
+		if c.mix(target, mid).Contrast(cp.Background) >= cp.MinContrast {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return c.mix(target, hi), true, true
+}
+
+// Preference builds the preference of the parsed colours, enforcing the
+// minimum contrast.
+func (cp ColourPolicy) Preference(colours []RGB, angle int) (ColourPreference, error) {
+	p := ColourPreference{Stops: make([]string, len(colours)), Angle: angle}
+	for i, c := range colours {
+		readable, adjusted, ok := cp.Readable(c)
+		if !ok {
+			return p, fmt.Errorf("%w: %s is hard to read on the chat background", ErrInvalidColour, c.Hex())
+		}
+		p.Stops[i] = readable.Hex()
+		p.Adjusted = p.Adjusted || adjusted
+	}
+	return p, nil
+}
+
+// ColourPreferences holds the colour preference of each user, kept in Redis.
+type ColourPreferences struct {
+	mu    sync.RWMutex
+	users map[string]ColourPreference
+}
+
+func NewColourPreferences() *ColourPreferences {
+	return &ColourPreferences{users: make(map[string]ColourPreference)}
+}
+
+// Load replaces the preferences with those stored in Redis.
+func (cp *ColourPreferences) Load() error {
+	stored, err := redisClient.HGetAll(ctx, colourPreferencesKey).Result()
+	if err != nil {
+		return err
+	}
+	users := make(map[string]ColourPreference, len(stored))
+	for user, data := range stored {
+		var p ColourPreference
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			log.Printf("colours: Invalid preference of %s: %v", user, err)
+			continue
+		}
+		users[user] = p
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.users = users
+	return nil
+}
+
+func (cp *ColourPreferences) Get(user string) (ColourPreference, bool) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	p, ok := cp.users[user]
+	return p, ok
+}
+
+// Set stores the preference of user, in Redis if available.
+func (cp *ColourPreferences) Set(user string, p ColourPreference) error {
+	cp.mu.Lock()
+	cp.users[user] = p
+	cp.mu.Unlock()
+
+	if redisClient == nil {
+		return nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if err := redisClient.HSet(ctx, colourPreferencesKey, user, data).Err(); err != nil {
+		return err
+	}
+	notifyStateChange(StateColours)
+	return nil
+}
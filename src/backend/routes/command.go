@@ -3,8 +3,13 @@ package routes
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // ----------------------------------------------------------------------------
@@ -29,42 +34,254 @@ func (e *ErrNotACommand) Error() string {
 }
 
 type CommandParser struct {
-	HelpTimer         *time.Timer
-	HelpResetDuration time.Duration
+	Commands     *CommandRegistry
+	Cooldowns    *CooldownManager
+	Colours      *ColourPreferences
+	ColourPolicy ColourPolicy
 }
 
 // ----------------------------------------------------------------------------
 // COMMANDS
 // ----------------------------------------------------------------------------
 //
-// When creating a new command, be sure to create a help message function.
+// A command is added with a single registration in DefaultCommands. Commands
+// declare their arguments, from which usage errors and default help
+// messages are generated.
 
-// Names for all valid text commands
-var TextCommand = map[string]struct{}{
-	"color": {},
-	"help":  {},
+type CommandInfo struct {
+	Name     string
+	Aliases  []string      // Alternative names converted by the tokenizer
+	Help     func() string // Usage and options (defaults to the usage of Args)
+	Role     Role          // Minimum role allowed to run the command
+	Cooldown Cooldown
+
+	// Arguments validated before the command runs. Commands without
+	// arguments declared accept any input.
+	Args []ArgSpec
+}
+
+// HelpText returns the help message of the command.
+func (info CommandInfo) HelpText() string {
+	if info.Help != nil {
+		return info.Help()
+	}
+	return Usage(info.Name, info.Args)
+}
+
+// CommandContext is a single run of a command.
+type CommandContext struct {
+	Parser  *CommandParser
+	Message Message  // The message holding the command
+	Args    []string // Words following the command name (quotes removed)
+	ArgText string   // Text following the command name
+	Role    Role     // Role of the message author (see Message.Role)
+
+	// Declared arguments by name
+	Values map[string]ArgValue
+}
+
+// Arg returns the value of a declared argument. Missing arguments have
+// Present false.
+func (c *CommandContext) Arg(name string) ArgValue {
+	return c.Values[name]
+}
+
+// Command handlers return the message to publish in place of the command
+// message, usually the message itself or a response.
+type Command interface {
+	Info() CommandInfo
+	Run(c *CommandContext) (Message, error)
+}
+
+// CommandFunc is a Command running a handler function.
+type CommandFunc struct {
+	CommandInfo
+	Handler func(c *CommandContext) (Message, error)
+}
+
+func (f CommandFunc) Info() CommandInfo {
+	return f.CommandInfo
+}
+
+func (f CommandFunc) Run(c *CommandContext) (Message, error) {
+	return f.Handler(c)
+}
+
+var ErrCommandExists = errors.New("command name already taken")
+
+// CommandRegistry holds the commands by name and alias. It is safe for
+// concurrent use.
+type CommandRegistry struct {
+	mu       sync.RWMutex
+	commands map[string]Command
+	names    map[string]string // Command name by name or alias
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{
+		commands: make(map[string]Command),
+		names:    make(map[string]string),
+	}
+}
+
+// DefaultCommands returns a registry of the built-in commands.
+func DefaultCommands() *CommandRegistry {
+	r := NewCommandRegistry()
+	r.Register(colorCommand)
+	r.Register(helpCommand(r))
+	return r
+}
+
+// Register adds a command. It fails if the name or an alias is taken, in
+// any case.
+func (r *CommandRegistry) Register(cmd Command) error {
+	info := cmd.Info()
+	if info.Name == "" {
+		return errors.New("command has no name")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := append([]string{info.Name}, info.Aliases...)
+	for _, name := range names {
+		if _, ok := r.names[strings.ToLower(name)]; ok {
+			return fmt.Errorf("%w: %s", ErrCommandExists, name)
+		}
+	}
+	r.commands[info.Name] = cmd
+	for _, name := range names {
+		r.names[strings.ToLower(name)] = info.Name
+	}
+	return nil
+}
+
+// Unregister removes a command and its aliases by name.
+func (r *CommandRegistry) Unregister(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cmd, ok := r.commands[name]
+	if !ok {
+		return false
+	}
+	delete(r.commands, name)
+	delete(r.names, strings.ToLower(name))
+	for _, alias := range cmd.Info().Aliases {
+		delete(r.names, strings.ToLower(alias))
+	}
+	return true
+}
+
+// Resolve returns the command name of a name or alias, in any case.
+func (r *CommandRegistry) Resolve(name string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	official, ok := r.names[strings.ToLower(name)]
+	return official, ok
+}
+
+// Lookup finds a command by name or alias, in any case.
+func (r *CommandRegistry) Lookup(name string) (Command, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.commands[r.names[strings.ToLower(name)]]
+	return cmd, ok
 }
 
-// Aliases are alternative names for commands which get converted by the tokenizer
-var TextCommandAlias = map[string]string{
-	"colour": "color",
-	"h":      "help",
+// Commands lists every command sorted by name.
+func (r *CommandRegistry) Commands() []Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmds := slices.Collect(maps.Values(r.commands))
+	slices.SortFunc(cmds, func(a Command, b Command) int {
+		return strings.Compare(a.Info().Name, b.Info().Name)
+	})
+	return cmds
+}
+
+var colorCommand = CommandFunc{
+	CommandInfo: CommandInfo{
+		Name:     "color",
+		Aliases:  []string{"colour"},
+		Help:     ColorHelp,
+		Cooldown: Cooldown{User: 10 * time.Second, Exempt: RoleModerator},
+		Args:     []ArgSpec{{Name: "colour", Type: ArgText, Optional: true}},
+	},
+	Handler: func(c *CommandContext) (Message, error) {
+		colour := c.Arg("colour")
+		if !colour.Present {
+			return c.Parser.CreateResponse(ColorHelp()), nil
+		}
+		author := c.Message.Author
+		colours, angle, err := ParseColourPreference(colour.Text)
+		if err != nil {
+			return c.Parser.CreateResponse(fmt.Sprintf("@%s %v", author, err)), nil
+		}
+		pref, err := c.Parser.ColourPolicy.Preference(colours, angle)
+		if err != nil {
+			return c.Parser.CreateResponse(fmt.Sprintf("@%s %v", author, err)), nil
+		}
+		if err := c.Parser.Colours.Set(author, pref); err != nil {
+			return c.Message, err
+		}
+		return c.Message, nil
+	},
+}
+
+func helpCommand(r *CommandRegistry) Command {
+	usage := func() string {
+		sb := strings.Builder{}
+
+		sb.WriteString("Usage: !help [command]. Commands: ")
+		for _, cmd := range r.Commands() {
+			sb.WriteString(cmd.Info().Name)
+			sb.WriteByte(' ')
+		}
+
+		return sb.String()
+	}
+
+	return CommandFunc{
+		CommandInfo: CommandInfo{
+			Name:    "help",
+			Aliases: []string{"h"},
+			Help:    usage,
+			Cooldown: Cooldown{
+				Global: 3 * time.Second,
+				User:   10 * time.Second,
+				Exempt: RoleModerator,
+			},
+			Args: []ArgSpec{{Name: "command", Type: ArgString, Optional: true}},
+		},
+		Handler: func(c *CommandContext) (Message, error) {
+			name := c.Arg("command")
+			if !name.Present {
+				return c.Parser.CreateResponse(usage()), nil
+			}
+			if cmd, ok := r.Lookup(strings.TrimPrefix(name.Text, "!")); ok {
+				return c.Parser.CreateResponse(cmd.Info().HelpText()), nil
+			}
+			return c.Message, nil
+		},
+	}
 }
 
 // ----------------------------------------------------------------------------
 // HELP MESSAGES
 // ----------------------------------------------------------------------------
 //
-// Every command must have a corresponding help message function detailing
-// the Usage and Options.
-//
-// Help messages are only sent when the parser's help timer is finished.
+// Help messages are subject to the cooldown of the command sending them.
 
 func ColorHelp() string {
 	sb := strings.Builder{}
 
-	sb.WriteString("Usage: !color [color]. Colors: ")
-	for color := range NameColors {
+	sb.WriteString("Usage: !color [color], #RRGGBB, rgb(r, g, b) or gradient([angle]deg, color, color...). Colors: ")
+	for _, color := range slices.Sorted(maps.Keys(NameColors)) {
 		sb.WriteString(color)
 		sb.WriteByte(' ')
 	}
@@ -72,43 +289,25 @@ func ColorHelp() string {
 	return sb.String()
 }
 
-func HelpHelp() string {
-	sb := strings.Builder{}
-
-	sb.WriteString("Usage: !help [command]. Commands: ")
-	for cmd := range TextCommand {
-		sb.WriteString(cmd)
-		sb.WriteByte(' ')
-	}
-
-	return sb.String()
-}
-
-// Maps each command to a help function.
-var CommandHelp = map[string]func() string{
-	"color": ColorHelp,
-	"help":  HelpHelp,
-}
-
 // ----------------------------------------------------------------------------
 // CONSTANTS
 // ----------------------------------------------------------------------------
 
-// Names of colors defined by the frontend.
-var NameColors = map[string]struct{}{
-	"red":       {},
-	"orange":    {},
-	"yellow":    {},
-	"green":     {},
-	"lightblue": {},
-	"blue":      {},
-	"violet":    {},
-	"pink":      {},
-	"tan":       {},
-	"olive":     {},
-	"lime":      {},
-	"sky":       {},
-	"purple":    {},
+// Names of colors, matching validNameColors in the frontend.
+var NameColors = map[string]string{
+	"red":       "#df5858",
+	"orange":    "#f96708",
+	"yellow":    "#fabd40",
+	"green":     "#2ddd6a",
+	"lightblue": "#6ad7d6",
+	"blue":      "#2bb5f3",
+	"violet":    "#ba29e0",
+	"pink":      "#e94079",
+	"tan":       "#ebb369",
+	"olive":     "#def169",
+	"lime":      "#73df5c",
+	"sky":       "#64d1fb",
+	"purple":    "#8e73ef",
 }
 
 // ----------------------------------------------------------------------------
@@ -116,67 +315,82 @@ var NameColors = map[string]struct{}{
 // ----------------------------------------------------------------------------
 
 // Creates a response message directly from EloraChat for all to see.
-func (cp CommandParser) CreateResponse(r string) Message {
+func (cp *CommandParser) CreateResponse(r string) Message {
 	var m Message
 
 	m.Author = "EloraChat"
 	m.Colour = "#FFCD05"
 	m.Message = r
 	m.Tokens = []Token{{
-		Type: TokenTypeText,
-		Text: r,
+		Type:    TokenTypeText,
+		Text:    r,
+		End:     len(r),
+		RuneEnd: utf8.RuneCountInString(r),
 	}}
 	// TODO: Create custom elora badge and link
 	m.Badges = []Badge{}
 	m.Emotes = []Emote{}
+	m.Response = true
 
 	return m
 }
 
+// Cooldown of usage error replies, so that repeating a mistyped command does
+// not make the bot spam the chat
+var usageErrorCooldown = Cooldown{User: 30 * time.Second, Exempt: RoleModerator}
+
 // Parse commands from message, potentially transforming the message.
-// TODO: Replace userSetting with database ptr and update table instead of map.
-func (cp CommandParser) Parse(m Message, userSetting map[string]string) (Message, error) {
+// Commands the author may not run, or that are cooling down, leave the
+// message unchanged. Invalid arguments are answered with the usage of the
+// command, without starting its cooldown.
+func (cp *CommandParser) Parse(m Message) (Message, error) {
 	if m.Tokens == nil || len(m.Tokens) < 1 {
 		return m, &ErrEmptyMessage{m.Author}
 	} else if m.Tokens[0].Type != TokenTypeCommand {
 		return m, &ErrNotACommand{m.Author, m.Message}
-	} else if userSetting == nil {
-		return m, errors.New("userSetting map is nil")
 	}
 
-	cmd, optsStr, _ := strings.Cut(m.Tokens[0].Text, " ")
-	opts := strings.Split(optsStr, " ")
+	// The tokenizer keeps the whitespace following the name as typed
+	name, args := m.Tokens[0].Text, ""
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, args = name[:i], name[i:]
+	}
+	cmd, ok := cp.Commands.Lookup(name)
+	if !ok {
+		return m, &ErrNotACommand{m.Author, m.Message}
+	}
+
+	c := &CommandContext{
+		Parser:  cp,
+		Message: m,
+		ArgText: strings.TrimSpace(args),
+		Role:    m.Role,
+	}
+	info := cmd.Info()
+	if c.Role < info.Role {
+		return m, nil
+	}
 
-	switch cmd {
-	case "color":
-		if len(opts) == 0 || (len(opts) == 1 && opts[0] == "") {
-			select {
-			case <-cp.HelpTimer.C:
-				cp.HelpTimer.Reset(cp.HelpResetDuration)
-				return cp.CreateResponse(ColorHelp()), nil
-			default:
-				return m, nil
-			}
+	if words, err := splitArgs(args); err == nil {
+		for _, word := range words {
+			c.Args = append(c.Args, word.Text)
 		}
-		color := opts[0]
-		if _, ok := NameColors[color]; ok {
-			userSetting[m.Author] = color
-		}
-	case "help":
-		select {
-		case <-cp.HelpTimer.C:
-			cp.HelpTimer.Reset(cp.HelpResetDuration)
-			if len(opts) == 0 || (len(opts) == 1 && opts[0] == "") {
-				return cp.CreateResponse(HelpHelp()), nil
-			}
-			helpCmd := opts[0]
-			if _, ok := CommandHelp[helpCmd]; ok {
-				return cp.CreateResponse(CommandHelp[helpCmd]()), nil
+	} else {
+		c.Args = strings.Fields(args)
+	}
+	if info.Args != nil {
+		values, err := ParseArgs(info.Name, info.Args, args)
+		if err != nil {
+			if cp.Cooldowns != nil && !cp.Cooldowns.Allow("usage-error", cooldownUser(m), c.Role, usageErrorCooldown) {
+				return m, nil
 			}
-		default:
-			return m, nil
+			return cp.CreateResponse(fmt.Sprintf("@%s %v", m.Author, err)), nil
 		}
+		c.Values = values
 	}
 
-	return m, nil
+	if cp.Cooldowns != nil && !cp.Cooldowns.Allow(info.Name, cooldownUser(m), c.Role, info.Cooldown) {
+		return m, nil
+	}
+	return cmd.Run(c)
 }
@@ -0,0 +1,234 @@
+package routes
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandRegistry(t *testing.T) {
+	r := DefaultCommands()
+	if name, ok := r.Resolve("colour"); !ok || name != "color" {
+		t.Errorf("Expected colour to resolve to color, got %q", name)
+	}
+
+	echo := CommandFunc{
+		CommandInfo: CommandInfo{Name: "echo", Aliases: []string{"e"}, Role: RoleModerator},
+		Handler: func(c *CommandContext) (Message, error) {
+			return c.Parser.CreateResponse(c.Args[0]), nil
+		},
+	}
+	if err := r.Register(echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(CommandFunc{CommandInfo: CommandInfo{Name: "other", Aliases: []string{"e"}}}); !errors.Is(err, ErrCommandExists) {
+		t.Errorf("Expected alias conflict, got %v", err)
+	}
+
+	parser := CommandParser{Commands: r}
+	msg := Message{Author: "viewer", Tokens: []Token{{Type: TokenTypeCommand, Text: "echo hi"}}}
+	if got, _ := parser.Parse(msg); got.Author != "viewer" {
+		t.Errorf("Viewer ran a moderator command: %+v", got)
+	}
+	msg.Author, msg.Role = "mod", RoleModerator
+	if got, _ := parser.Parse(msg); got.Author != "EloraChat" || got.Message != "hi" {
+		t.Errorf("Expected response, got %+v", got)
+	}
+
+	if !r.Unregister("echo") {
+		t.Error("Expected echo to be removed")
+	}
+	if _, ok := r.Lookup("e"); ok {
+		t.Error("Alias outlived its command")
+	}
+}
+
+func TestCooldowns(t *testing.T) {
+	cm := NewCooldownManager(nil)
+	cd := Cooldown{Global: time.Hour, User: time.Hour, Exempt: RoleModerator}
+	if !cm.Allow("help", "a", RoleViewer, cd) {
+		t.Fatal("First run refused")
+	}
+	if cm.Allow("help", "a", RoleViewer, cd) || cm.Allow("help", "b", RoleViewer, cd) {
+		t.Error("Global window not enforced")
+	}
+	if !cm.Allow("help", "mod", RoleModerator, cd) {
+		t.Error("Moderator not exempt")
+	}
+	if !cm.Allow("color", "a", RoleViewer, cd) {
+		t.Error("Cooldown leaked across commands")
+	}
+
+	perUser := Cooldown{User: time.Hour}
+	if !cm.Allow("quote", "a", RoleViewer, perUser) || !cm.Allow("quote", "b", RoleViewer, perUser) {
+		t.Error("Per-user window blocked another user")
+	}
+	if cm.Allow("quote", "a", RoleViewer, perUser) {
+		t.Error("Per-user window not enforced")
+	}
+
+	// Parse leaves the message as is while a command is cooling down
+	parser := CommandParser{Commands: DefaultCommands(), Cooldowns: NewCooldownManager(nil)}
+	msg := Message{Author: "viewer", Tokens: []Token{{Type: TokenTypeCommand, Text: "help"}}}
+	if got, _ := parser.Parse(msg); got.Author != "EloraChat" {
+		t.Errorf("Expected help response, got %+v", got)
+	}
+	if got, _ := parser.Parse(msg); got.Author != "viewer" {
+		t.Errorf("Expected cooldown, got %+v", got)
+	}
+
+	// Usage errors do not start the cooldown, and are rate limited apart
+	parser.Cooldowns = NewCooldownManager(nil)
+	for i, text := range []string{"help a b", "help c d", "help"} {
+		msg.Tokens[0].Text = text
+		got, _ := parser.Parse(msg)
+		if want := []string{"EloraChat", "viewer", "EloraChat"}[i]; got.Author != want {
+			t.Errorf("%s: expected message by %s, got %+v", text, want, got)
+		}
+	}
+}
+
+func TestCustomCommand(t *testing.T) {
+	vars := map[string]string{"user": "dayo", "args": "a b"}
+	got := expandCommandVars("hi ${user}: ${args} ${unknown} $5 ${", vars)
+	if want := "hi dayo: a b ${unknown} $5 ${"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	r := DefaultCommands()
+	r.Register(&customCommand{def: CustomCommandDef{Name: "lurk", Response: "${user} lurks on ${source} (${count})"}})
+	parser := CommandParser{Commands: r}
+	msg := Message{Author: "dayo", Source: "YouTube", Tokens: []Token{{Type: TokenTypeCommand, Text: "lurk"}}}
+	for i, want := range []string{"dayo lurks on YouTube (1)", "dayo lurks on YouTube (2)"} {
+		if got, _ := parser.Parse(msg); got.Message != want {
+			t.Errorf("Run %d: expected %q, got %q", i, want, got.Message)
+		}
+	}
+
+	// Any whitespace ends the command name
+	msg.Tokens[0].Text = "lurk\ta  b"
+	if got, _ := parser.Parse(msg); got.Message != "dayo lurks on YouTube (3)" {
+		t.Errorf("Expected the command after a tab, got %q", got.Message)
+	}
+
+	if _, err := normalizeCommandDef(CustomCommandDef{Name: "!Bad Name", Response: "x"}); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("Expected invalid name, got %v", err)
+	}
+	if def, err := normalizeCommandDef(CustomCommandDef{Name: "!Lurk", Response: "x"}); err != nil || def.Name != "lurk" {
+		t.Errorf("Expected lurk, got %+v %v", def, err)
+	}
+
+	// Names are case insensitive
+	cc := NewCustomCommands(r)
+	if err := cc.Add(CustomCommandDef{Name: "COLOUR", Response: "x"}); !errors.Is(err, ErrCommandExists) {
+		t.Errorf("Expected clash with the !colour alias, got %v", err)
+	}
+	if err := cc.Add(CustomCommandDef{Name: "Hug", Response: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"hug", "HUG", "Lurk"} {
+		if _, ok := r.Lookup(name); !ok {
+			t.Errorf("Expected %q to resolve", name)
+		}
+	}
+}
+
+func TestColourCommand(t *testing.T) {
+	parser := CommandParser{
+		Commands:     DefaultCommands(),
+		Colours:      NewColourPreferences(),
+		ColourPolicy: ColourPolicy{MinContrast: DefaultMinContrast, Adjust: true},
+	}
+	run := func(args string) Message {
+		msg := Message{Author: "dayo", Tokens: []Token{{Type: TokenTypeCommand, Text: "color " + args}}}
+		got, err := parser.Parse(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	tests := []struct {
+		Args     string
+		Expected ColourPreference
+	}{
+		{"purple", ColourPreference{Stops: []string{"#8e73ef"}}},
+		{"#FA0", ColourPreference{Stops: []string{"#ffaa00"}}},
+		{"rgb(255, 0, 128)", ColourPreference{Stops: []string{"#ff0080"}}},
+		{"gradient(90deg, red, rgb(0,255,0), #2bb5f3)", ColourPreference{Stops: []string{"#df5858", "#00ff00", "#2bb5f3"}, Angle: 90}},
+	}
+	for _, test := range tests {
+		run(test.Args)
+		got, _ := parser.Colours.Get("dayo")
+		if !slices.Equal(got.Stops, test.Expected.Stops) || got.Angle != test.Expected.Angle || got.Adjusted {
+			t.Errorf("%s: expected %+v, got %+v", test.Args, test.Expected, got)
+		}
+	}
+
+	// Dark colours are lightened on the default black background
+	run("#000080")
+	got, _ := parser.Colours.Get("dayo")
+	c, _ := ParseColour(got.Colour())
+	if !got.Adjusted || c.Contrast(RGB{}) < DefaultMinContrast {
+		t.Errorf("Expected readable colour, got %+v", got)
+	}
+
+	parser.ColourPolicy.Adjust = false
+	if got := run("#000080"); got.Author != "EloraChat" || !strings.Contains(got.Message, "hard to read") {
+		t.Errorf("Expected rejection, got %+v", got)
+	}
+	for _, invalid := range []string{"#12345", "rgb(256, 0, 0)", "gradient(red)", "gradient(red, blue", "mauve"} {
+		if got := run(invalid); got.Author != "EloraChat" || !strings.Contains(got.Message, "invalid colour") {
+			t.Errorf("%s: expected error response, got %+v", invalid, got.Message)
+		}
+	}
+}
+
+func TestColourPolicyReadable(t *testing.T) {
+	tests := []struct {
+		Background RGB
+		Colour     RGB
+		Adjusted   bool
+	}{
+		{RGB{}, RGB{255, 170, 0}, false},
+		{RGB{}, RGB{0, 0, 128}, true},
+		{RGB{255, 255, 255}, RGB{255, 255, 0}, true},
+		// White only reaches 4.48:1 on mid-grey, black reaches 4.69:1
+		{RGB{0x77, 0x77, 0x77}, RGB{0x80, 0x80, 0x80}, true},
+		{RGB{0x77, 0x77, 0x77}, RGB{0x66, 0x00, 0x99}, true},
+	}
+	for _, test := range tests {
+		cp := ColourPolicy{Background: test.Background, MinContrast: DefaultMinContrast, Adjust: true}
+		got, adjusted, ok := cp.Readable(test.Colour)
+		if !ok || adjusted != test.Adjusted || got.Contrast(test.Background) < DefaultMinContrast {
+			t.Errorf("%s on %s: got %s (contrast %.2f), adjusted %v, ok %v",
+				test.Colour.Hex(), test.Background.Hex(), got.Hex(), got.Contrast(test.Background), adjusted, ok)
+		}
+	}
+}
+
+func TestEffectErrorResponse(t *testing.T) {
+	saved := commandParser
+	defer func() { commandParser = saved }()
+	commandParser = CommandParser{Cooldowns: NewCooldownManager(nil)}
+
+	msg := Message{Author: "dayo", Source: "Twitch", Tokens: []Token{
+		{Type: TokenTypeText, Text: "pattern0r:hi", Error: "invalid pattern"},
+		{Type: TokenTypeText, Text: "pattern0r:again", Error: "invalid pattern"},
+	}}
+	if got, ok := effectErrorResponse(msg); !ok || got.Message != "@dayo invalid pattern" {
+		t.Errorf("Expected one error response, got %q %v", got.Message, ok)
+	}
+	if _, ok := effectErrorResponse(msg); ok {
+		t.Error("Expected repeated errors to cool down")
+	}
+	msg.Role = RoleModerator
+	if _, ok := effectErrorResponse(msg); !ok {
+		t.Error("Expected moderators to be exempt")
+	}
+	if _, ok := effectErrorResponse(Message{Author: "other", Tokens: []Token{{Text: "fine"}}}); ok {
+		t.Error("Expected no response without errors")
+	}
+}
@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	cooldownKeyPrefix = "cooldown:"
+
+	// In-memory windows kept before expired ones are pruned
+	maxCooldownEntries = 1024
+)
+
+// Cooldown limits how often a command runs. A zero window is no limit.
+type Cooldown struct {
+	Global time.Duration // Between runs by anyone
+	User   time.Duration // Between runs by the same user
+
+	// Roles at or above Exempt skip the cooldown (RoleViewer exempts nobody)
+	Exempt Role
+}
+
+// CooldownManager tracks command cooldowns by command and user. With a Redis
+// client the windows are shared by every instance using the same store,
+// otherwise they are kept in memory.
+type CooldownManager struct {
+	Redis *redis.Client
+
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func NewCooldownManager(client *redis.Client) *CooldownManager {
+	return &CooldownManager{
+		Redis: client,
+		until: make(map[string]time.Time),
+	}
+}
+
+// Claims every key of the arguments unless one is already claimed.
+// ARGV holds the window in milliseconds of each key.
+var claimCooldownScript = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+	if redis.call("EXISTS", key) == 1 then
+		return 0
+	end
+end
+for i, key in ipairs(KEYS) do
+	redis.call("SET", key, 1, "PX", ARGV[i])
+end
+return 1
+`)
+
+// cooldownUser identifies a chat user across platforms.
+func cooldownUser(m Message) string {
+	return m.Source + ":" + strings.ToLower(m.Author)
+}
+
+// Allow reports whether user may run command now, starting its cooldown
+// windows if so. If the store fails the windows are kept in memory.
+func (cm *CooldownManager) Allow(command string, user string, role Role, cd Cooldown) bool {
+	if cd.Exempt > RoleViewer && role >= cd.Exempt {
+		return true
+	}
+
+	var keys []string
+	var windows []time.Duration
+	if cd.Global > 0 {
+		keys = append(keys, cooldownKeyPrefix+command)
+		windows = append(windows, cd.Global)
+	}
+	if cd.User > 0 {
+		keys = append(keys, cooldownKeyPrefix+command+":"+user)
+		windows = append(windows, cd.User)
+	}
+	if len(keys) == 0 {
+		return true
+	}
+
+	if cm.Redis != nil {
+		args := make([]any, len(windows))
+		for i, w := range windows {
+			args[i] = w.Milliseconds()
+		}
+		ok, err := claimCooldownScript.Run(ctx, cm.Redis, keys, args...).Int()
+		if err == nil {
+			return ok == 1
+		}
+	}
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	now := time.Now()
+	if len(cm.until) >= maxCooldownEntries {
+		for key, until := range cm.until {
+			if !now.Before(until) {
+				delete(cm.until, key)
+			}
+		}
+	}
+	for _, key := range keys {
+		if now.Before(cm.until[key]) {
+			return false
+		}
+	}
+	for i, key := range keys {
+		cm.until[key] = now.Add(windows[i])
+	}
+	return true
+}
@@ -0,0 +1,481 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	countersKey      = "counters"
+	counterValuesKey = "counters:values"
+)
+
+var (
+	ErrUnknownCounter = errors.New("no such counter")
+	ErrInvalidCounter = errors.New("invalid counter")
+)
+
+var counters *Counters
+
+// Cooldown of !name+ and !name-, so two moderators do not count the same
+// death twice
+var counterStepCooldown = Cooldown{Global: 2 * time.Second}
+
+// Arguments of !name
+var counterArgs = []ArgSpec{
+	{Name: "action", Type: ArgEnum, Optional: true, Choices: []string{"add", "set", "reset"}},
+	{Name: "amount", Type: ArgInteger, Optional: true},
+}
+
+// Counter is a named number kept across streams, such as deaths or wins.
+type Counter struct {
+	Name  string `json:"name"`
+	Value int64  `json:"value"`
+	Role  Role   `json:"role"` // Minimum role allowed to change the counter
+}
+
+// CounterChange is the data of EventCounter.
+type CounterChange struct {
+	Counter
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// counterCommand runs !name (step 0), !name+ or !name-.
+type counterCommand struct {
+	counters *Counters
+	counter  Counter
+	step     int64
+}
+
+func (c *counterCommand) Info() CommandInfo {
+	name := c.counter.Name
+	switch {
+	case c.step > 0:
+		return CommandInfo{
+			Name:     name + "+",
+			Help:     func() string { return Usage(name+"+", counterArgs[1:]) + ". Adds to " + name },
+			Role:     c.counter.Role,
+			Cooldown: counterStepCooldown,
+			Args:     counterArgs[1:],
+		}
+	case c.step < 0:
+		return CommandInfo{
+			Name:     name + "-",
+			Help:     func() string { return Usage(name+"-", counterArgs[1:]) + ". Subtracts from " + name },
+			Role:     c.counter.Role,
+			Cooldown: counterStepCooldown,
+			Args:     counterArgs[1:],
+		}
+	}
+	return CommandInfo{
+		Name:     name,
+		Cooldown: Cooldown{Global: 5 * time.Second, Exempt: RoleModerator},
+		Args:     counterArgs,
+	}
+}
+
+func (c *counterCommand) Run(cc *CommandContext) (Message, error) {
+	name := c.counter.Name
+	amount := int64(1)
+	if v := cc.Arg("amount"); v.Present {
+		amount = v.Integer
+	}
+
+	var value int64
+	var err error
+	switch action := cc.Arg("action").Text; {
+	case c.step != 0:
+		value, err = c.counters.Increment(name, c.step*amount)
+	case action == "":
+		counter, ok := c.counters.Get(name)
+		if !ok {
+			return cc.Message, nil
+		}
+		value = counter.Value
+	case cc.Role < c.counter.Role:
+		return cc.Message, nil
+	case action == "add":
+		value, err = c.counters.Increment(name, amount)
+	case action == "set":
+		if !cc.Arg("amount").Present {
+			return cc.Parser.CreateResponse(fmt.Sprintf("@%s missing amount. %s", cc.Message.Author, Usage(name, counterArgs))), nil
+		}
+		value, err = amount, c.counters.Set(name, amount)
+	case action == "reset":
+		value, err = 0, c.counters.Set(name, 0)
+	}
+	if err != nil {
+		return cc.Parser.CreateResponse(fmt.Sprintf("@%s %v", cc.Message.Author, err)), nil
+	}
+	return cc.Parser.CreateResponse(fmt.Sprintf("%s: %d", name, value)), nil
+}
+
+// Counters manages the counters and their commands, kept in Redis.
+type Counters struct {
+	Commands *CommandRegistry
+
+	// Called after a counter is created, changed or deleted
+	OnChange func(CounterChange)
+
+	mu       sync.Mutex
+	counters map[string]Counter
+}
+
+func NewCounters(r *CommandRegistry, onChange func(CounterChange)) *Counters {
+	return &Counters{
+		Commands: r,
+		OnChange: onChange,
+		counters: make(map[string]Counter),
+	}
+}
+
+// register adds the commands of c. Must be called with the lock held.
+func (cs *Counters) register(c Counter) error {
+	for _, step := range []int64{0, 1, -1} {
+		if err := cs.Commands.Register(&counterCommand{counters: cs, counter: c, step: step}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unregister removes the commands of the counter name. Must be called with
+// the lock held.
+func (cs *Counters) unregister(name string) {
+	for _, suffix := range []string{"", "+", "-"} {
+		cs.Commands.Unregister(name + suffix)
+	}
+}
+
+// Load restores the counters stored in Redis and registers their commands,
+// replacing those changed and removing those deleted since the last load.
+func (cs *Counters) Load() error {
+	data, err := redisClient.HGetAll(ctx, countersKey).Result()
+	if err != nil {
+		return err
+	}
+	values, err := redisClient.HGetAll(ctx, counterValuesKey).Result()
+	if err != nil {
+		return err
+	}
+	defs := make(map[string]Counter, len(data))
+	for name, d := range data {
+		var c Counter
+		if err := json.Unmarshal([]byte(d), &c); err != nil {
+			log.Printf("counters: Invalid counter %s: %v", name, err)
+			continue
+		}
+		c.Value, _ = strconv.ParseInt(values[c.Name], 10, 64)
+		defs[c.Name] = c
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for name, old := range cs.counters {
+		if c, ok := defs[name]; ok && c.Role == old.Role {
+			cs.counters[name] = c
+			delete(defs, name)
+			continue
+		}
+		cs.unregister(name)
+		delete(cs.counters, name)
+	}
+	for name, c := range defs {
+		if err := cs.register(c); err != nil {
+			log.Printf("counters: Failed to register counter %s: %v", name, err)
+			cs.unregister(name)
+			continue
+		}
+		cs.counters[c.Name] = c
+	}
+	return nil
+}
+
+func (cs *Counters) changed(c Counter, deleted bool) {
+	if cs.OnChange != nil {
+		cs.OnChange(CounterChange{Counter: c, Deleted: deleted})
+	}
+}
+
+// Add creates a counter. Its commands must not clash with other commands.
+func (cs *Counters) Add(c Counter) error {
+	c.Name = strings.ToLower(strings.TrimPrefix(c.Name, "!"))
+	if !validCommandName(c.Name) || len(c.Name) == maxCommandNameLen {
+		return fmt.Errorf("%w: names use a-z, 0-9, _ and - (up to %d)", ErrInvalidCounter, maxCommandNameLen-1)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, suffix := range []string{"", "+", "-"} {
+		if _, ok := cs.Commands.Resolve(c.Name + suffix); ok {
+			return fmt.Errorf("%w: %s", ErrCommandExists, c.Name+suffix)
+		}
+	}
+	if err := cs.register(c); err != nil {
+		cs.unregister(c.Name)
+		return err
+	}
+	if redisClient != nil {
+		data, err := json.Marshal(Counter{Name: c.Name, Role: c.Role})
+		if err == nil {
+			pipe := redisClient.TxPipeline()
+			pipe.HSet(ctx, countersKey, c.Name, data)
+			pipe.HSet(ctx, counterValuesKey, c.Name, c.Value)
+			_, err = pipe.Exec(ctx)
+		}
+		if err != nil {
+			cs.unregister(c.Name)
+			return err
+		}
+	}
+	cs.counters[c.Name] = c
+	cs.changed(c, false)
+	notifyStateChange(StateCounters)
+	return nil
+}
+
+// SetRole changes the role allowed to change a counter.
+func (cs *Counters) SetRole(name string, role Role) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.counters[name]
+	if !ok {
+		return ErrUnknownCounter
+	}
+	c.Role = role
+	if redisClient != nil {
+		data, err := json.Marshal(Counter{Name: c.Name, Role: c.Role})
+		if err != nil {
+			return err
+		}
+		if err := redisClient.HSet(ctx, countersKey, c.Name, data).Err(); err != nil {
+			return err
+		}
+	}
+	cs.unregister(name)
+	cs.counters[name] = c
+	if err := cs.register(c); err != nil {
+		return err
+	}
+	notifyStateChange(StateCounters)
+	return nil
+}
+
+// Increment adds delta to a counter and returns its new value.
+func (cs *Counters) Increment(name string, delta int64) (int64, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.counters[name]
+	if !ok {
+		return 0, ErrUnknownCounter
+	}
+	if redisClient != nil {
+		value, err := redisClient.HIncrBy(ctx, counterValuesKey, name, delta).Result()
+		if err != nil {
+			return 0, err
+		}
+		c.Value = value
+	} else {
+		c.Value += delta
+	}
+	cs.counters[name] = c
+	cs.changed(c, false)
+	return c.Value, nil
+}
+
+// Set replaces the value of a counter.
+func (cs *Counters) Set(name string, value int64) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.counters[name]
+	if !ok {
+		return ErrUnknownCounter
+	}
+	if redisClient != nil {
+		if err := redisClient.HSet(ctx, counterValuesKey, name, value).Err(); err != nil {
+			return err
+		}
+	}
+	c.Value = value
+	cs.counters[name] = c
+	cs.changed(c, false)
+	return nil
+}
+
+// Delete removes a counter and its commands.
+func (cs *Counters) Delete(name string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.counters[name]
+	if !ok {
+		return ErrUnknownCounter
+	}
+	if redisClient != nil {
+		pipe := redisClient.TxPipeline()
+		pipe.HDel(ctx, countersKey, name)
+		pipe.HDel(ctx, counterValuesKey, name)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	cs.unregister(name)
+	delete(cs.counters, name)
+	cs.changed(c, true)
+	notifyStateChange(StateCounters)
+	return nil
+}
+
+// Get returns a counter with its value read from Redis, where every
+// instance counts.
+func (cs *Counters) Get(name string) (Counter, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.counters[name]
+	if ok && redisClient != nil {
+		value, err := redisClient.HGet(ctx, counterValuesKey, name).Int64()
+		if err != nil {
+			log.Printf("redis: Failed to read counter %s: %v", name, err)
+		} else {
+			c.Value = value
+		}
+	}
+	return c, ok
+}
+
+// List returns the counters sorted by name, with their values read from
+// Redis.
+func (cs *Counters) List() []Counter {
+	var values map[string]string
+	if redisClient != nil {
+		var err error
+		if values, err = redisClient.HGetAll(ctx, counterValuesKey).Result(); err != nil {
+			log.Printf("redis: Failed to read counters: %v", err)
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	list := make([]Counter, 0, len(cs.counters))
+	for _, c := range cs.counters {
+		if v, ok := values[c.Name]; ok {
+			c.Value, _ = strconv.ParseInt(v, 10, 64)
+		}
+		list = append(list, c)
+	}
+	slices.SortFunc(list, func(a Counter, b Counter) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+func publishCounterChange(change CounterChange) {
+	if err := publishEvent(Event{Event: EventCounter, Data: change}); err != nil {
+		log.Printf("redis: Failed to publish counter change: %v", err)
+	}
+}
+
+// writeCounterError maps a counter error to an HTTP response.
+func writeCounterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidCounter), errors.Is(err, ErrCommandExists):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrUnknownCounter):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, "Failed to save counter", http.StatusInternalServerError)
+	}
+}
+
+// ListCounters lists the counters, for overlays to show before the first
+// counter event.
+func ListCounters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counters.List())
+}
+
+// CreateCounter adds a counter from a JSON body with a name, and optionally
+// a starting value and the role allowed to change it (moderator by
+// default). Moderators only.
+func CreateCounter(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Name  string `json:"name"`
+		Value int64  `json:"value"`
+		Role  *Role  `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	c := Counter{Name: requestBody.Name, Value: requestBody.Value, Role: RoleModerator}
+	if requestBody.Role != nil {
+		c.Role = *requestBody.Role
+	}
+	if err := counters.Add(c); err != nil {
+		writeCounterError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UpdateCounter sets the value and/or the role of a counter. Moderators
+// only.
+func UpdateCounter(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Value *int64 `json:"value"`
+		Role  *Role  `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if requestBody.Role != nil {
+		if err := counters.SetRole(name, *requestBody.Role); err != nil {
+			writeCounterError(w, err)
+			return
+		}
+	}
+	if requestBody.Value != nil {
+		if err := counters.Set(name, *requestBody.Value); err != nil {
+			writeCounterError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteCounter removes a counter. Moderators only.
+func DeleteCounter(w http.ResponseWriter, r *http.Request) {
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	if err := counters.Delete(mux.Vars(r)["name"]); err != nil {
+		writeCounterError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,96 @@
+package routes
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestCounters(t *testing.T) {
+	r := DefaultCommands()
+	var changes []CounterChange
+	cs := NewCounters(r, func(change CounterChange) {
+		changes = append(changes, change)
+	})
+	tokenizer := Tokenizer{TextCommandPrefix: '!', Commands: r}
+	parser := CommandParser{Commands: r, Cooldowns: NewCooldownManager(nil)}
+	run := func(role Role, text string) string {
+		msg := Message{Author: "dayo", Role: role, Message: text}
+		msg.Tokens = slices.Collect(tokenizer.IterMessage(msg, ""))
+		got, err := parser.Parse(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Response {
+			return ""
+		}
+		return got.Message
+	}
+
+	if err := cs.Add(Counter{Name: "help"}); !errors.Is(err, ErrCommandExists) {
+		t.Errorf("Expected clash with !help, got %v", err)
+	}
+	if err := cs.Add(Counter{Name: "no way"}); !errors.Is(err, ErrInvalidCounter) {
+		t.Errorf("Expected invalid name, got %v", err)
+	}
+	if err := cs.Add(Counter{Name: "!Deaths", Value: 2, Role: RoleModerator}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		role Role
+		text string
+		want string
+	}{
+		{RoleViewer, "!deaths", "deaths: 2"},
+		{RoleViewer, "!deaths+", ""},
+		{RoleViewer, "!deaths set 9", ""},
+		{RoleModerator, "!deaths+", "deaths: 3"},
+		{RoleModerator, "!deaths add 4", "deaths: 7"},
+		{RoleModerator, "!deaths set 5", "deaths: 5"},
+		{RoleModerator, "!deaths set", "@dayo missing amount. Usage: !deaths [add|set|reset] [amount]"},
+		{RoleModerator, "!deaths add 1.5", `@dayo amount: "1.5" is not a whole number. Usage: !deaths [add|set|reset] [amount]`},
+		{RoleModerator, "!deaths reset", "deaths: 0"},
+	}
+	for _, test := range tests {
+		if got := run(test.role, test.text); got != test.want {
+			t.Errorf("%s: expected %q, got %q", test.text, test.want, got)
+		}
+	}
+
+	// Steps have a global cooldown, without exemptions
+	if got := run(RoleBroadcaster, "!deaths+"); got != "" {
+		t.Errorf("Expected cooldown, got %q", got)
+	}
+	if got := run(RoleBroadcaster, "!deaths- 2"); got != "deaths: -2" {
+		t.Errorf("Expected deaths: -2, got %q", got)
+	}
+
+	if err := cs.SetRole("deaths", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	parser.Cooldowns = NewCooldownManager(nil)
+	if got := run(RoleViewer, "!deaths+"); got != "deaths: -1" {
+		t.Errorf("Expected viewers to count, got %q", got)
+	}
+
+	if err := cs.Delete("deaths"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Resolve("deaths+"); ok {
+		t.Error("Expected the commands to be removed")
+	}
+
+	values := []int64{2, 3, 7, 5, 0, -2, -1}
+	if len(changes) != len(values)+1 {
+		t.Fatalf("Expected %d changes, got %+v", len(values)+1, changes)
+	}
+	for i, want := range values {
+		if changes[i].Value != want || changes[i].Deleted {
+			t.Errorf("Change %d: expected %d, got %+v", i, want, changes[i])
+		}
+	}
+	if last := changes[len(changes)-1]; !last.Deleted || last.Name != "deaths" {
+		t.Errorf("Expected deletion, got %+v", last)
+	}
+}
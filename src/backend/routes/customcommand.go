@@ -0,0 +1,447 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	customCommandsKey      = "commands:custom"
+	customCommandCountsKey = "commands:custom:counts"
+
+	maxCommandNameLen     = 32
+	maxCommandResponseLen = 500
+)
+
+var (
+	ErrUnknownCommand = errors.New("no such custom command")
+	ErrInvalidCommand = errors.New("invalid command")
+)
+
+// Cooldown of every custom command
+var customCommandCooldown = Cooldown{Global: 5 * time.Second, User: 15 * time.Second, Exempt: RoleModerator}
+
+var customCommands *CustomCommands
+
+// Arguments of !addcom and !editcom
+var customCommandArgs = []ArgSpec{
+	{Name: "name", Type: ArgString},
+	{Name: "response", Type: ArgText},
+}
+
+// CustomCommandDef is a response command defined at runtime. The response
+// may use the variables ${user}, ${source}, ${count} and ${args}.
+type CustomCommandDef struct {
+	Name      string    `json:"name"`
+	Response  string    `json:"response"`
+	Role      Role      `json:"role"` // Minimum role allowed to run the command
+	CreatedBy string    `json:"createdBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// Number of runs, filled in when listing
+	Count int64 `json:"count"`
+}
+
+// customCommand runs a CustomCommandDef.
+type customCommand struct {
+	def CustomCommandDef
+
+	// Run count when Redis is unavailable
+	uses atomic.Int64
+}
+
+func (c *customCommand) Info() CommandInfo {
+	return CommandInfo{
+		Name: c.def.Name,
+		Help: func() string {
+			return fmt.Sprintf("Usage: !%s. Custom command.", c.def.Name)
+		},
+		Role:     c.def.Role,
+		Cooldown: customCommandCooldown,
+	}
+}
+
+// count increments and returns the number of runs.
+func (c *customCommand) count() int64 {
+	if redisClient != nil {
+		n, err := redisClient.HIncrBy(ctx, customCommandCountsKey, c.def.Name, 1).Result()
+		if err == nil {
+			return n
+		}
+		log.Printf("redis: Failed to count command %s: %v", c.def.Name, err)
+	}
+	return c.uses.Add(1)
+}
+
+func (c *customCommand) Run(cc *CommandContext) (Message, error) {
+	vars := map[string]string{
+		"user":   cc.Message.Author,
+		"source": cc.Message.Source,
+		"args":   cc.ArgText,
+	}
+	if strings.Contains(c.def.Response, "${count}") {
+		vars["count"] = fmt.Sprint(c.count())
+	}
+	return cc.Parser.CreateResponse(expandCommandVars(c.def.Response, vars)), nil
+}
+
+// expandCommandVars replaces every ${name} in s with vars[name]. Unknown
+// variables are kept as is.
+func expandCommandVars(s string, vars map[string]string) string {
+	sb := strings.Builder{}
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			break
+		}
+		sb.WriteString(s[:i])
+		if v, ok := vars[s[i+2:i+j]]; ok {
+			sb.WriteString(v)
+		} else {
+			sb.WriteString(s[i : i+j+1])
+		}
+		s = s[i+j+1:]
+	}
+	sb.WriteString(s)
+	return sb.String()
+}
+
+// validCommandName reports whether name can be typed as a command.
+func validCommandName(name string) bool {
+	if name == "" || len(name) > maxCommandNameLen {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// CustomCommands manages the custom commands of a registry, kept in Redis.
+type CustomCommands struct {
+	Commands *CommandRegistry
+
+	mu sync.Mutex
+}
+
+// NewCustomCommands registers the moderator commands !addcom, !editcom and
+// !delcom in r.
+func NewCustomCommands(r *CommandRegistry) *CustomCommands {
+	cc := &CustomCommands{Commands: r}
+	r.Register(CommandFunc{
+		CommandInfo: CommandInfo{
+			Name: "addcom",
+			Help: func() string {
+				return Usage("addcom", customCommandArgs) + ". Variables: ${user} ${source} ${count} ${args}"
+			},
+			Role: RoleModerator,
+			Args: customCommandArgs,
+		},
+		Handler: func(c *CommandContext) (Message, error) {
+			name := c.Arg("name").Text
+			err := cc.Add(CustomCommandDef{Name: name, Response: c.Arg("response").Text, CreatedBy: c.Message.Author})
+			return cc.respond(c, "added", name, err)
+		},
+	})
+	r.Register(CommandFunc{
+		CommandInfo: CommandInfo{
+			Name: "editcom",
+			Role: RoleModerator,
+			Args: customCommandArgs,
+		},
+		Handler: func(c *CommandContext) (Message, error) {
+			name := c.Arg("name").Text
+			err := cc.Edit(name, c.Arg("response").Text, nil)
+			return cc.respond(c, "updated", name, err)
+		},
+	})
+	r.Register(CommandFunc{
+		CommandInfo: CommandInfo{
+			Name: "delcom",
+			Role: RoleModerator,
+			Args: []ArgSpec{{Name: "name", Type: ArgString}},
+		},
+		Handler: func(c *CommandContext) (Message, error) {
+			name := c.Arg("name").Text
+			err := cc.Delete(name)
+			return cc.respond(c, "deleted", name, err)
+		},
+	})
+	return cc
+}
+
+// respond reports the outcome of a management command to its author.
+func (cc *CustomCommands) respond(c *CommandContext, done string, name string, err error) (Message, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "!"))
+	text := fmt.Sprintf("@%s Command !%s %s", c.Message.Author, name, done)
+	if err != nil {
+		text = fmt.Sprintf("@%s %v", c.Message.Author, err)
+	}
+	return c.Parser.CreateResponse(text), nil
+}
+
+// Load registers the custom commands stored in Redis, replacing those
+// changed and removing those deleted since the last load.
+func (cc *CustomCommands) Load() error {
+	data, err := redisClient.HGetAll(ctx, customCommandsKey).Result()
+	if err != nil {
+		return err
+	}
+	defs := make(map[string]CustomCommandDef, len(data))
+	for name, d := range data {
+		var def CustomCommandDef
+		if err := json.Unmarshal([]byte(d), &def); err != nil {
+			log.Printf("commands: Invalid custom command %s: %v", name, err)
+			continue
+		}
+		defs[def.Name] = def
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for _, cmd := range cc.Commands.Commands() {
+		custom, ok := cmd.(*customCommand)
+		if !ok {
+			continue
+		}
+		def, ok := defs[custom.def.Name]
+		if ok && def.Response == custom.def.Response && def.Role == custom.def.Role && def.UpdatedAt.Equal(custom.def.UpdatedAt) {
+			delete(defs, def.Name)
+			continue
+		}
+		cc.Commands.Unregister(custom.def.Name)
+	}
+	for name, def := range defs {
+		if err := cc.Commands.Register(&customCommand{def: def}); err != nil {
+			log.Printf("commands: Failed to register custom command %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func normalizeCommandDef(def CustomCommandDef) (CustomCommandDef, error) {
+	def.Name = strings.ToLower(strings.TrimPrefix(def.Name, "!"))
+	if !validCommandName(def.Name) {
+		return def, fmt.Errorf("%w: names use a-z, 0-9, _ and - (up to %d)", ErrInvalidCommand, maxCommandNameLen)
+	}
+	if def.Response == "" || len(def.Response) > maxCommandResponseLen {
+		return def, fmt.Errorf("%w: responses are 1 to %d bytes", ErrInvalidCommand, maxCommandResponseLen)
+	}
+	def.UpdatedAt = time.Now().UTC()
+	def.Count = 0
+	return def, nil
+}
+
+func saveCommandDef(def CustomCommandDef) error {
+	if redisClient == nil {
+		return nil
+	}
+	data, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	return redisClient.HSet(ctx, customCommandsKey, def.Name, data).Err()
+}
+
+// Add creates a custom command. Names of existing commands and aliases are
+// refused.
+func (cc *CustomCommands) Add(def CustomCommandDef) error {
+	def, err := normalizeCommandDef(def)
+	if err != nil {
+		return err
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if err := cc.Commands.Register(&customCommand{def: def}); err != nil {
+		return err
+	}
+	if err := saveCommandDef(def); err != nil {
+		cc.Commands.Unregister(def.Name)
+		return err
+	}
+	notifyStateChange(StateCustomCommands)
+	return nil
+}
+
+// lookup finds a custom command by name. Must be called with the lock held.
+func (cc *CustomCommands) lookup(name string) (*customCommand, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "!"))
+	cmd, ok := cc.Commands.Lookup(name)
+	custom, isCustom := cmd.(*customCommand)
+	if !ok || !isCustom || custom.def.Name != name {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+	}
+	return custom, nil
+}
+
+// Edit replaces the response of a custom command, and its role if role is
+// not nil.
+func (cc *CustomCommands) Edit(name string, response string, role *Role) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	old, err := cc.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	def := old.def
+	def.Response = response
+	if role != nil {
+		def.Role = *role
+	}
+	if def, err = normalizeCommandDef(def); err != nil {
+		return err
+	}
+	if err := saveCommandDef(def); err != nil {
+		return err
+	}
+
+	cmd := &customCommand{def: def}
+	cmd.uses.Store(old.uses.Load())
+	cc.Commands.Unregister(def.Name)
+	if err := cc.Commands.Register(cmd); err != nil {
+		return err
+	}
+	notifyStateChange(StateCustomCommands)
+	return nil
+}
+
+// Delete removes a custom command and its run count.
+func (cc *CustomCommands) Delete(name string) error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cmd, err := cc.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.HDel(ctx, customCommandsKey, cmd.def.Name)
+	pipe.HDel(ctx, customCommandCountsKey, cmd.def.Name)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	cc.Commands.Unregister(cmd.def.Name)
+	notifyStateChange(StateCustomCommands)
+	return nil
+}
+
+// List returns every custom command with its run count, sorted by name.
+func (cc *CustomCommands) List() []CustomCommandDef {
+	counts, err := redisClient.HGetAll(ctx, customCommandCountsKey).Result()
+	if err != nil {
+		log.Printf("redis: Failed to read command counts: %v", err)
+	}
+
+	defs := []CustomCommandDef{}
+	for _, cmd := range cc.Commands.Commands() {
+		if custom, ok := cmd.(*customCommand); ok {
+			def := custom.def
+			fmt.Sscan(counts[def.Name], &def.Count)
+			defs = append(defs, def)
+		}
+	}
+	slices.SortFunc(defs, func(a CustomCommandDef, b CustomCommandDef) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return defs
+}
+
+// writeCommandError maps a custom command error to an HTTP response.
+func writeCommandError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidCommand):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrCommandExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrUnknownCommand):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, "Failed to save command", http.StatusInternalServerError)
+	}
+}
+
+// ListCustomCommands lists the custom commands.
+func ListCustomCommands(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customCommands.List())
+}
+
+// CreateCustomCommand adds a custom command from a JSON body with name,
+// response and role. Moderators only.
+func CreateCustomCommand(w http.ResponseWriter, r *http.Request) {
+	var def CustomCommandDef
+	if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	if sessionToken, err := getSessionTokenFromRequest(r); err == nil {
+		def.CreatedBy, _ = getUsernameFromSession(sessionToken)
+	}
+	if err := customCommands.Add(def); err != nil {
+		writeCommandError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UpdateCustomCommand replaces the response, and optionally the role, of a
+// custom command. Moderators only.
+func UpdateCustomCommand(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Response string `json:"response"`
+		Role     *Role  `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	if err := customCommands.Edit(mux.Vars(r)["name"], requestBody.Response, requestBody.Role); err != nil {
+		writeCommandError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteCustomCommand removes a custom command. Moderators only.
+func DeleteCustomCommand(w http.ResponseWriter, r *http.Request) {
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	if err := customCommands.Delete(mux.Vars(r)["name"]); err != nil {
+		writeCommandError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
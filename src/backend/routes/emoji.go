@@ -0,0 +1,320 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Default image template (Twemoji). {codepoints} is replaced by the
+// Emoji.Codepoints of the token.
+const DefaultEmojiURLTemplate = "https://cdn.jsdelivr.net/gh/jdecked/twemoji@latest/assets/72x72/{codepoints}.png"
+
+const (
+	runeZWJ            = 0x200D
+	runeVS15           = 0xFE0E // text presentation
+	runeVS16           = 0xFE0F // emoji presentation
+	runeKeycap         = 0x20E3
+	runeTagCancel      = 0xE007F
+	runeRegionalFirst  = 0x1F1E6
+	runeRegionalLast   = 0x1F1FF
+	runeSkinToneFirst  = 0x1F3FB
+	runeSkinToneLast   = 0x1F3FF
+	runeTagFirst       = 0xE0020
+	runeTagLast        = 0xE007E
+	runeSupplementBase = 0x1F000
+)
+
+type Emoji struct {
+	// Lowercase hex code points joined by '-' following Twemoji file naming
+	// (U+FE0F is dropped unless the sequence contains a ZWJ).
+	Codepoints string `json:"codepoints"`
+	Shortcode  string `json:"shortcode,omitempty"`
+	URL        string `json:"url"`
+}
+
+// BMP symbols which render as emoji without a U+FE0F selector
+// (Emoji_Presentation=Yes below U+1F000).
+var emojiPresentationBMP = map[rune]struct{}{
+	0x231A: {}, 0x231B: {}, 0x23E9: {}, 0x23EA: {}, 0x23EB: {}, 0x23EC: {},
+	0x23F0: {}, 0x23F3: {}, 0x25FD: {}, 0x25FE: {}, 0x2614: {}, 0x2615: {},
+	0x2648: {}, 0x2649: {}, 0x264A: {}, 0x264B: {}, 0x264C: {}, 0x264D: {},
+	0x264E: {}, 0x264F: {}, 0x2650: {}, 0x2651: {}, 0x2652: {}, 0x2653: {},
+	0x267F: {}, 0x2693: {}, 0x26A1: {}, 0x26AA: {}, 0x26AB: {}, 0x26BD: {},
+	0x26BE: {}, 0x26C4: {}, 0x26C5: {}, 0x26CE: {}, 0x26D4: {}, 0x26EA: {},
+	0x26F2: {}, 0x26F3: {}, 0x26F5: {}, 0x26FA: {}, 0x26FD: {}, 0x2705: {},
+	0x270A: {}, 0x270B: {}, 0x2728: {}, 0x274C: {}, 0x274E: {}, 0x2753: {},
+	0x2754: {}, 0x2755: {}, 0x2757: {}, 0x2795: {}, 0x2796: {}, 0x2797: {},
+	0x27B0: {}, 0x27BF: {}, 0x2B1B: {}, 0x2B1C: {}, 0x2B50: {}, 0x2B55: {},
+}
+
+// Common gemoji style shortcodes.
+var EmojiShortcodes = map[string]string{
+	"+1":                       "👍",
+	"thumbsup":                 "👍",
+	"-1":                       "👎",
+	"thumbsdown":               "👎",
+	"joy":                      "😂",
+	"rofl":                     "🤣",
+	"smile":                    "😄",
+	"smiley":                   "😃",
+	"grin":                     "😁",
+	"laughing":                 "😆",
+	"sweat_smile":              "😅",
+	"wink":                     "😉",
+	"blush":                    "😊",
+	"slightly_smiling_face":    "🙂",
+	"upside_down_face":         "🙃",
+	"heart_eyes":               "😍",
+	"kissing_heart":            "😘",
+	"yum":                      "😋",
+	"stuck_out_tongue":         "😛",
+	"sunglasses":               "😎",
+	"nerd_face":                "🤓",
+	"thinking":                 "🤔",
+	"neutral_face":             "😐",
+	"expressionless":           "😑",
+	"unamused":                 "😒",
+	"roll_eyes":                "🙄",
+	"grimacing":                "😬",
+	"relieved":                 "😌",
+	"pensive":                  "😔",
+	"sleepy":                   "😪",
+	"sleeping":                 "😴",
+	"mask":                     "😷",
+	"exploding_head":           "🤯",
+	"cowboy_hat_face":          "🤠",
+	"partying_face":            "🥳",
+	"confused":                 "😕",
+	"worried":                  "😟",
+	"open_mouth":               "😮",
+	"astonished":               "😲",
+	"flushed":                  "😳",
+	"pleading_face":            "🥺",
+	"cry":                      "😢",
+	"sob":                      "😭",
+	"scream":                   "😱",
+	"angry":                    "😠",
+	"rage":                     "😡",
+	"skull":                    "💀",
+	"poop":                     "💩",
+	"clown_face":               "🤡",
+	"ghost":                    "👻",
+	"alien":                    "👽",
+	"robot":                    "🤖",
+	"see_no_evil":              "🙈",
+	"wave":                     "👋",
+	"ok_hand":                  "👌",
+	"v":                        "✌️",
+	"crossed_fingers":          "🤞",
+	"point_up":                 "☝️",
+	"point_down":               "👇",
+	"clap":                     "👏",
+	"raised_hands":             "🙌",
+	"pray":                     "🙏",
+	"muscle":                   "💪",
+	"eyes":                     "👀",
+	"brain":                    "🧠",
+	"heart":                    "❤️",
+	"orange_heart":             "🧡",
+	"yellow_heart":             "💛",
+	"green_heart":              "💚",
+	"blue_heart":               "💙",
+	"purple_heart":             "💜",
+	"black_heart":              "🖤",
+	"broken_heart":             "💔",
+	"sparkling_heart":          "💖",
+	"100":                      "💯",
+	"fire":                     "🔥",
+	"sparkles":                 "✨",
+	"star":                     "⭐",
+	"zap":                      "⚡",
+	"boom":                     "💥",
+	"tada":                     "🎉",
+	"gift":                     "🎁",
+	"trophy":                   "🏆",
+	"crown":                    "👑",
+	"gem":                      "💎",
+	"moneybag":                 "💰",
+	"rocket":                   "🚀",
+	"goat":                     "🐐",
+	"pig":                      "🐷",
+	"dog":                      "🐶",
+	"cat":                      "🐱",
+	"frog":                     "🐸",
+	"snake":                    "🐍",
+	"pizza":                    "🍕",
+	"popcorn":                  "🍿",
+	"cheese":                   "🧀",
+	"beer":                     "🍺",
+	"coffee":                   "☕",
+	"video_game":               "🎮",
+	"musical_note":             "🎵",
+	"check":                    "✔️",
+	"white_check_mark":         "✅",
+	"x":                        "❌",
+	"warning":                  "⚠️",
+	"question":                 "❓",
+	"exclamation":              "❗",
+	"rainbow_flag":             "🏳️‍🌈",
+	"pirate_flag":              "🏴‍☠️",
+	"facepalm":                 "🤦",
+	"shrug":                    "🤷",
+	"man_facepalming":          "🤦‍♂️",
+	"woman_facepalming":        "🤦‍♀️",
+	"salute":                   "🫡",
+	"melting_face":             "🫠",
+	"face_holding_back_tears":  "🥹",
+	"smiling_face_with_tear":   "🥲",
+	"face_with_peeking_eye":    "🫣",
+	"face_with_open_eyes_hand": "🫢",
+}
+
+// isEmojiBase reports whether r can start an emoji element. BMP symbols
+// with text presentation by default only count when selected with U+FE0F.
+func isEmojiBase(r rune, next rune) bool {
+	if r >= runeSupplementBase && r <= 0x1FAFF {
+		return !(r >= runeSkinToneFirst && r <= runeSkinToneLast)
+	}
+	if _, ok := emojiPresentationBMP[r]; ok {
+		return true
+	}
+	if next != runeVS16 {
+		return false
+	}
+	switch {
+	case r == 0xA9, r == 0xAE, r == 0x203C, r == 0x2049, r == 0x2122, r == 0x2139,
+		r == 0x24C2, r == 0x3030, r == 0x303D, r == 0x3297, r == 0x3299:
+		return true
+	case r >= 0x2194 && r <= 0x21AA:
+		return true
+	case r >= 0x2300 && r <= 0x23FF:
+		return true
+	case r >= 0x25AA && r <= 0x25FE:
+		return true
+	case r >= 0x2600 && r <= 0x27BF:
+		return true
+	case r >= 0x2934 && r <= 0x2935:
+		return true
+	case r >= 0x2B05 && r <= 0x2B55:
+		return true
+	}
+	return false
+}
+
+func isKeycapBase(r rune) bool {
+	return ('0' <= r && r <= '9') || r == '#' || r == '*'
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= runeRegionalFirst && r <= runeRegionalLast
+}
+
+// peekRune decodes the rune at i, returning utf8.RuneError at the end.
+func peekRune(s string, i int) (rune, int) {
+	if i >= len(s) {
+		return utf8.RuneError, 0
+	}
+	return utf8.DecodeRuneInString(s[i:])
+}
+
+// scanEmojiElement returns the length of the emoji element at the start of s
+// (base with optional selector, skin tone and tag sequence).
+func scanEmojiElement(s string) int {
+	r, size := peekRune(s, 0)
+	next, nextSize := peekRune(s, size)
+
+	// Keycap: [0-9#*] FE0F? 20E3
+	if isKeycapBase(r) {
+		i := size
+		if next == runeVS16 {
+			i += nextSize
+		}
+		if k, kSize := peekRune(s, i); k == runeKeycap {
+			return i + kSize
+		}
+		return 0
+	}
+
+	// Flag: pair of regional indicators
+	if isRegionalIndicator(r) {
+		if isRegionalIndicator(next) {
+			return size + nextSize
+		}
+		return 0
+	}
+
+	if !isEmojiBase(r, next) {
+		return 0
+	}
+	i := size
+
+	if next == runeVS16 || next == runeVS15 {
+		i += nextSize
+	}
+	if tone, toneSize := peekRune(s, i); tone >= runeSkinToneFirst && tone <= runeSkinToneLast {
+		i += toneSize
+	}
+
+	// Tag sequence (subdivision flags)
+	j := i
+	for {
+		tag, tagSize := peekRune(s, j)
+		if tag >= runeTagFirst && tag <= runeTagLast {
+			j += tagSize
+			continue
+		}
+		if tag == runeTagCancel && j > i {
+			i = j + tagSize
+		}
+		break
+	}
+
+	return i
+}
+
+// ScanEmoji returns the length in bytes of the emoji sequence (including
+// ZWJ sequences) at the start of s, or 0 if s does not start with an emoji.
+func ScanEmoji(s string) int {
+	n := scanEmojiElement(s)
+	if n == 0 {
+		return 0
+	}
+	for {
+		zwj, zwjSize := peekRune(s, n)
+		if zwj != runeZWJ {
+			return n
+		}
+		m := scanEmojiElement(s[n+zwjSize:])
+		if m == 0 {
+			return n
+		}
+		n += zwjSize + m
+	}
+}
+
+// EmojiCodepoints formats an emoji sequence as Twemoji style code points.
+func EmojiCodepoints(emoji string) string {
+	keepVS16 := strings.ContainsRune(emoji, runeZWJ)
+	parts := make([]string, 0, utf8.RuneCountInString(emoji))
+	for _, r := range emoji {
+		if r == runeVS16 && !keepVS16 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%x", r))
+	}
+	return strings.Join(parts, "-")
+}
+
+// NewEmoji builds the emoji token data for sequence using the URL template.
+func NewEmoji(sequence string, shortcode string, urlTemplate string) Emoji {
+	codepoints := EmojiCodepoints(sequence)
+	if urlTemplate == "" {
+		urlTemplate = DefaultEmojiURLTemplate
+	}
+	return Emoji{
+		Codepoints: codepoints,
+		Shortcode:  shortcode,
+		URL:        strings.ReplaceAll(urlTemplate, "{codepoints}", codepoints),
+	}
+}
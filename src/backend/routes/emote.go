@@ -0,0 +1,92 @@
+package routes
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jdavasligil/emodl"
+)
+
+const (
+	EmoteProviderSevenTV = "7tv"
+	EmoteProviderBTTV    = "bttv"
+	EmoteProviderFFZ     = "ffz"
+)
+
+// BTTV global emotes which are zero-width overlays. BTTV flags these on its
+// site rather than in the API, so they are listed here.
+var BTTVZeroWidthEmotes = map[string]struct{}{
+	"SoSnowy":   {},
+	"IceCold":   {},
+	"SantaHat":  {},
+	"TopHat":    {},
+	"ReinDeer":  {},
+	"CandyCane": {},
+	"cvMask":    {},
+	"cvHazmat":  {},
+}
+
+// ZeroWidthEmotesFromEnv reads additional zero-width emote names from
+// ZERO_WIDTH_EMOTES (comma separated).
+//
+// Note: emodl v0.2.1 does not decode the 7TV emote flags, so 7TV zero-width
+// emotes must be listed here until it does.
+func ZeroWidthEmotesFromEnv() map[string]struct{} {
+	names := make(map[string]struct{})
+	for _, name := range strings.Split(os.Getenv("ZERO_WIDTH_EMOTES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}
+
+// emoteProvider reports which provider supplied the emote loaded by d.
+func emoteProvider(d *emodl.Downloader, emote emodl.Emote) string {
+	if e, ok := d.SevenTVEmotes[emote.Name]; ok && e.ID == emote.ID {
+		return EmoteProviderSevenTV
+	}
+	if e, ok := d.BTTVEmotes[emote.Name]; ok && e.ID == emote.ID {
+		return EmoteProviderBTTV
+	}
+	if e, ok := d.FFZEmotes[emote.Name]; ok && strconv.Itoa(e.ID) == emote.ID {
+		return EmoteProviderFFZ
+	}
+	return ""
+}
+
+// convertEmotes builds tokenizer emotes from emotes loaded by d, marking
+// zero-width emotes. Every image of the emote is kept, the one preferred by
+// the server first.
+func convertEmotes(d *emodl.Downloader, loaded map[string]emodl.Emote, zeroWidth map[string]struct{}) map[string]Emote {
+	emotes := make(map[string]Emote, len(loaded))
+	for name, emote := range loaded {
+		if len(emote.Images) == 0 {
+			continue
+		}
+		e := Emote{
+			ID:        emote.ID,
+			Name:      emote.Name,
+			Locations: emote.Locations,
+			Provider:  emoteProvider(d, emote),
+		}
+		e.Images = providerImages(d, e)
+		if len(e.Images) == 0 {
+			e.Images = []Image{{
+				URL:    emote.Images[0].URL,
+				Width:  emote.Images[0].Width,
+				Height: emote.Images[0].Height,
+				ID:     emote.Images[0].ID,
+			}}
+		}
+		emoteImagePreference.Sort(e.Images)
+		if _, ok := zeroWidth[name]; ok {
+			e.ZeroWidth = true
+		} else if _, ok := BTTVZeroWidthEmotes[name]; ok && e.Provider == EmoteProviderBTTV {
+			e.ZeroWidth = true
+		}
+		emotes[name] = e
+	}
+	return emotes
+}
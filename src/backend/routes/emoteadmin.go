@@ -0,0 +1,287 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	EmoteProviderCustom = "custom"
+
+	// Path of uploaded emote images (followed by the emote ID)
+	customEmotePath = "/emotes/custom/"
+
+	disabledEmotesKey    = "emotes:disabled"
+	customEmotesKey      = "emotes:custom"
+	customEmoteImagesKey = "emotes:custom:images"
+
+	maxCustomEmoteSize = 1 << 20
+	maxEmoteNameLen    = 64
+)
+
+// Image types accepted for custom emotes (as sniffed by http.DetectContentType)
+var customEmoteTypes = map[string]struct{}{
+	"image/png":  {},
+	"image/gif":  {},
+	"image/webp": {},
+	"image/jpeg": {},
+}
+
+type customEmote struct {
+	Emote   Emote  `json:"emote"`
+	Channel string `json:"channel"`
+}
+
+// loadEmoteAdmin restores disabled and custom emotes from Redis.
+func loadEmoteAdmin(registry *EmoteRegistry) error {
+	disabled, err := redisClient.SMembers(ctx, disabledEmotesKey).Result()
+	if err != nil {
+		return err
+	}
+	for _, name := range disabled {
+		registry.SetDisabled(name, true)
+	}
+
+	custom, err := redisClient.HGetAll(ctx, customEmotesKey).Result()
+	if err != nil {
+		return err
+	}
+	for id, data := range custom {
+		var c customEmote
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			log.Printf("emotes: Invalid custom emote %s: %v", id, err)
+			continue
+		}
+		registry.SetCustom(c.Channel, c.Emote)
+	}
+	return nil
+}
+
+// validEmoteName reports whether name can be matched by the tokenizer.
+func validEmoteName(name string) bool {
+	if name == "" || len(name) > maxEmoteNameLen {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ListEmotes lists the emotes of every layer. Filters: q (name substring,
+// case insensitive), provider, layer and channel.
+func ListEmotes(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.ToLower(query.Get("q"))
+	provider := query.Get("provider")
+	layer := query.Get("layer")
+	channel := query.Get("channel")
+
+	entries := []EmoteEntry{}
+	for _, entry := range tokenizer.Emotes.Entries() {
+		if q != "" && !strings.Contains(strings.ToLower(entry.Name), q) {
+			continue
+		}
+		if provider != "" && entry.Provider != provider {
+			continue
+		}
+		if layer != "" && entry.Layer != layer {
+			continue
+		}
+		if channel != "" && entry.Channel != channel {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// SetEmoteDisabled disables or re-enables an emote name in every layer.
+// Moderators only.
+func SetEmoteDisabled(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Name     string `json:"name"`
+		Disabled bool   `json:"disabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil || requestBody.Name == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	var err error
+	if requestBody.Disabled {
+		err = redisClient.SAdd(ctx, disabledEmotesKey, requestBody.Name).Err()
+	} else {
+		err = redisClient.SRem(ctx, disabledEmotesKey, requestBody.Name).Err()
+	}
+	if err != nil {
+		http.Error(w, "Failed to save emote", http.StatusInternalServerError)
+		return
+	}
+	tokenizer.Emotes.SetDisabled(requestBody.Name, requestBody.Disabled)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadCustomEmote adds a custom emote from a multipart form with the
+// fields name, channel (optional, chat URL) and image. Moderators only.
+func UploadCustomEmote(w http.ResponseWriter, r *http.Request) {
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCustomEmoteSize+64<<10)
+	if err := r.ParseMultipartForm(maxCustomEmoteSize); err != nil {
+		http.Error(w, "Invalid form or image too large", http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("name")
+	channel := r.FormValue("channel")
+	if !validEmoteName(name) {
+		http.Error(w, "Invalid emote name", http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, "Missing image", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxCustomEmoteSize+1))
+	if err != nil || len(data) > maxCustomEmoteSize {
+		http.Error(w, "Image too large", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	if _, ok := customEmoteTypes[contentType]; !ok {
+		http.Error(w, "Unsupported image type", http.StatusBadRequest)
+		return
+	}
+
+	id, err := generateState()
+	if err != nil {
+		http.Error(w, "Failed to create emote", http.StatusInternalServerError)
+		return
+	}
+	img := Image{ID: id, URL: customEmotePath + id}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		img.Width, img.Height = config.Width, config.Height
+	}
+	c := customEmote{
+		Emote: Emote{
+			ID:        id,
+			Name:      name,
+			Locations: []string{},
+			Images:    []Image{img},
+			Provider:  EmoteProviderCustom,
+		},
+		Channel: channel,
+	}
+	meta, err := json.Marshal(c)
+	if err != nil {
+		http.Error(w, "Failed to create emote", http.StatusInternalServerError)
+		return
+	}
+
+	// Replace any custom emote with the same name in the channel
+	for _, entry := range tokenizer.Emotes.Entries() {
+		if entry.Layer == EmoteLayerCustom && entry.Channel == channel && entry.Name == name {
+			deleteCustomEmote(entry.ID)
+		}
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, customEmoteImagesKey, id, data)
+	pipe.HSet(ctx, customEmotesKey, id, meta)
+	if _, err := pipe.Exec(ctx); err != nil {
+		http.Error(w, "Failed to save emote", http.StatusInternalServerError)
+		return
+	}
+	tokenizer.Emotes.SetCustom(channel, c.Emote)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c.Emote)
+}
+
+// deleteCustomEmote removes a custom emote, returning false if it does not
+// exist.
+func deleteCustomEmote(id string) (bool, error) {
+	data, err := redisClient.HGet(ctx, customEmotesKey, id).Result()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var c customEmote
+	if err := json.Unmarshal([]byte(data), &c); err == nil {
+		tokenizer.Emotes.RemoveCustom(c.Channel, c.Emote.Name)
+	}
+
+	pipe := redisClient.TxPipeline()
+	pipe.HDel(ctx, customEmotesKey, id)
+	pipe.HDel(ctx, customEmoteImagesKey, id)
+	_, err = pipe.Exec(ctx)
+	return true, err
+}
+
+// DeleteCustomEmote removes a custom emote by ID. Moderators only.
+func DeleteCustomEmote(w http.ResponseWriter, r *http.Request) {
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	found, err := deleteCustomEmote(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Failed to delete emote", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Emote not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCustomEmoteImage serves the image of a custom emote.
+func GetCustomEmoteImage(w http.ResponseWriter, r *http.Request) {
+	serveCustomEmoteImage(w, mux.Vars(r)["id"])
+}
+
+func serveCustomEmoteImage(w http.ResponseWriter, id string) {
+	data, err := redisClient.HGet(ctx, customEmoteImagesKey, id).Bytes()
+	if err == redis.Nil {
+		http.Error(w, "Emote not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to read emote", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+}
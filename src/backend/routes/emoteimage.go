@@ -0,0 +1,254 @@
+package routes
+
+import (
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jdavasligil/emodl"
+)
+
+// Image formats in order of preference when the preferred format is missing
+var imageFormatFallbacks = []string{"webp", "avif", "gif", "png", "jpeg"}
+
+// Width of a 1x emote image, used to guess the scale of unlabelled images
+const baseEmoteSize = 28
+
+// ImagePreference selects one image among the scales and formats of an
+// emote. Missing scales fall back to the nearest (larger on ties) and
+// missing formats to imageFormatFallbacks.
+type ImagePreference struct {
+	Scale  string // "1x", "2x", "3x" or "4x"
+	Format string // "webp", "avif", "gif", "png"
+	Static bool   // Prefer still images over animated ones
+}
+
+var DefaultImagePreference = ImagePreference{Scale: "1x", Format: "webp"}
+
+// ImagePreferenceFromEnv reads the server default from EMOTE_IMAGE_SCALE,
+// EMOTE_IMAGE_FORMAT and EMOTE_IMAGE_STATIC.
+func ImagePreferenceFromEnv() ImagePreference {
+	p := DefaultImagePreference
+	if v := os.Getenv("EMOTE_IMAGE_SCALE"); v != "" {
+		p.Scale = v
+	}
+	if v := os.Getenv("EMOTE_IMAGE_FORMAT"); v != "" {
+		p.Format = strings.ToLower(v)
+	}
+	p.Static = os.Getenv("EMOTE_IMAGE_STATIC") == "true"
+	return p
+}
+
+// ImagePreferenceFromQuery reads a client preference from the emoteScale,
+// emoteFormat and emoteStatic query parameters. ok is false if the client
+// sent none of them.
+func ImagePreferenceFromQuery(q url.Values, def ImagePreference) (p ImagePreference, ok bool) {
+	p = def
+	if v := q.Get("emoteScale"); v != "" {
+		p.Scale, ok = v, true
+	}
+	if v := q.Get("emoteFormat"); v != "" {
+		p.Format, ok = strings.ToLower(v), true
+	}
+	if v := q.Get("emoteStatic"); v != "" {
+		p.Static, ok = v == "1" || v == "true", true
+	}
+	return p, ok
+}
+
+// parseScale returns the numeric scale of "Nx".
+func parseScale(scale string) int {
+	n, err := strconv.Atoi(strings.TrimSuffix(scale, "x"))
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+func imageScale(img Image) int {
+	if n := parseScale(img.Scale); n > 0 {
+		return n
+	}
+	if img.Width > 0 {
+		return max(1, (img.Width+baseEmoteSize/2)/baseEmoteSize)
+	}
+	return 1
+}
+
+// compare orders images from most to least preferred.
+func (p ImagePreference) compare(a Image, b Image) int {
+	want := max(parseScale(p.Scale), 1)
+	distance := func(img Image) int {
+		d := 2 * (imageScale(img) - want)
+		if d < 0 {
+			d = -d + 1 // Prefer larger images on ties
+		}
+		return d
+	}
+	if c := distance(a) - distance(b); c != 0 {
+		return c
+	}
+
+	rank := func(img Image) int {
+		if img.Format == p.Format {
+			return -1
+		}
+		if i := slices.Index(imageFormatFallbacks, img.Format); i >= 0 {
+			return i
+		}
+		return len(imageFormatFallbacks)
+	}
+	if c := rank(a) - rank(b); c != 0 {
+		return c
+	}
+
+	mismatch := func(img Image) int {
+		if img.Animated == p.Static {
+			return 1
+		}
+		return 0
+	}
+	return mismatch(a) - mismatch(b)
+}
+
+// Sort orders images from most to least preferred.
+func (p ImagePreference) Sort(images []Image) {
+	slices.SortStableFunc(images, p.compare)
+}
+
+// Best returns the most preferred image.
+func (p ImagePreference) Best(images []Image) (Image, bool) {
+	if len(images) == 0 {
+		return Image{}, false
+	}
+	return slices.MinFunc(images, p.compare), true
+}
+
+// only reduces the images of an emote to the most preferred one.
+func (p ImagePreference) only(e Emote) Emote {
+	if best, ok := p.Best(e.Images); ok {
+		e.Images = []Image{best}
+	}
+	return e
+}
+
+// Apply reduces every emote of the message to its most preferred image.
+func (p ImagePreference) Apply(msg Message) Message {
+	tokens := make([]Token, len(msg.Tokens))
+	for i, tok := range msg.Tokens {
+		tok.Emote = p.only(tok.Emote)
+		if len(tok.Overlays) > 0 {
+			overlays := make([]Emote, len(tok.Overlays))
+			for j, o := range tok.Overlays {
+				overlays[j] = p.only(o)
+			}
+			tok.Overlays = overlays
+		}
+		tokens[i] = tok
+	}
+	msg.Tokens = tokens
+
+	emotes := make([]Emote, len(msg.Emotes))
+	for i, e := range msg.Emotes {
+		emotes[i] = p.only(e)
+	}
+	msg.Emotes = emotes
+	return msg
+}
+
+type sevenTVFile struct {
+	Name       string `json:"name"`
+	StaticName string `json:"static_name"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Format     string `json:"format"`
+}
+
+// sevenTVImages lists every file of a 7TV emote, with a still variant of
+// each file of animated emotes.
+func sevenTVImages(id string, hostURL string, animated bool, files []sevenTVFile) []Image {
+	if strings.HasPrefix(hostURL, "//") {
+		hostURL = "https:" + hostURL
+	}
+	images := make([]Image, 0, 2*len(files))
+	for _, f := range files {
+		scale, _, _ := strings.Cut(f.Name, ".")
+		img := Image{
+			ID:       id + "+" + f.Name,
+			URL:      hostURL + "/" + f.Name,
+			Width:    f.Width,
+			Height:   f.Height,
+			Scale:    scale,
+			Format:   strings.ToLower(f.Format),
+			Animated: animated,
+		}
+		images = append(images, img)
+		if animated && f.StaticName != "" && f.StaticName != f.Name {
+			img.ID = id + "+" + f.StaticName
+			img.URL = hostURL + "/" + f.StaticName
+			img.Animated = false
+			images = append(images, img)
+		}
+	}
+	return images
+}
+
+// bttvImages lists the CDN images of a BTTV emote. Animated emotes are also
+// available as GIF, still emotes as PNG.
+func bttvImages(id string, animated bool) []Image {
+	formats := []string{"webp", "png"}
+	if animated {
+		formats[1] = "gif"
+	}
+	images := make([]Image, 0, 6)
+	for _, scale := range []string{"1x", "2x", "3x"} {
+		for _, format := range formats {
+			images = append(images, Image{
+				ID:       id + "+" + scale + "." + format,
+				URL:      "https://cdn.betterttv.net/emote/" + id + "/" + scale + "." + format,
+				Scale:    scale,
+				Format:   format,
+				Animated: animated,
+			})
+		}
+	}
+	return images
+}
+
+// ffzImages lists the scales of an FFZ emote (FFZ serves still PNG images).
+func ffzImages(e emodl.FFZEmote) []Image {
+	images := make([]Image, 0, len(e.URLs))
+	for scale, url := range e.URLs {
+		n := parseScale(scale)
+		images = append(images, Image{
+			ID:     strconv.Itoa(e.ID) + "+" + scale,
+			URL:    url,
+			Width:  e.Width * n,
+			Height: e.Height * n,
+			Scale:  scale + "x",
+			Format: "png",
+		})
+	}
+	return images
+}
+
+// providerImages lists every image of an emote loaded by d.
+func providerImages(d *emodl.Downloader, emote Emote) []Image {
+	switch emote.Provider {
+	case EmoteProviderSevenTV:
+		e := d.SevenTVEmotes[emote.Name]
+		files := make([]sevenTVFile, len(e.Host.Files))
+		for i, f := range e.Host.Files {
+			files[i] = sevenTVFile{f.Name, f.StaticName, f.Width, f.Height, f.Format}
+		}
+		return sevenTVImages(e.ID, e.Host.Url, e.Animated, files)
+	case EmoteProviderBTTV:
+		e := d.BTTVEmotes[emote.Name]
+		return bttvImages(e.ID, e.Animated)
+	case EmoteProviderFFZ:
+		return ffzImages(d.FFZEmotes[emote.Name])
+	}
+	return nil
+}
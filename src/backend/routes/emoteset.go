@@ -0,0 +1,346 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jdavasligil/emodl"
+)
+
+const (
+	PlatformTwitch  = "twitch"
+	PlatformYouTube = "youtube"
+
+	defaultEmoteRefreshInterval = 30 * time.Minute
+)
+
+var emoteSets *EmoteSets
+
+var ErrUnknownEmoteChannel = errors.New("unknown emote channel")
+
+// EmoteSetChange is sent to clients (as an emote_set_changed event) when the
+// emotes of a channel change.
+type EmoteSetChange struct {
+	Channel string   `json:"channel"`
+	Added   []Emote  `json:"added"`
+	Removed []string `json:"removed"`
+
+	// What caused the change ("refresh" or a provider event stream)
+	Source string `json:"source"`
+}
+
+func (c EmoteSetChange) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0
+}
+
+// diffEmotes returns the emotes added to and removed from old in emotes.
+func diffEmotes(old map[string]Emote, emotes map[string]Emote) (added []Emote, removed []string) {
+	added, removed = []Emote{}, []string{}
+	for name, emote := range emotes {
+		if o, ok := old[name]; !ok || o.ID != emote.ID {
+			added = append(added, emote)
+		}
+	}
+	for name := range old {
+		if _, ok := emotes[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}
+
+// EmoteChannel describes the third party emote set of a chat channel. The
+// channel is identified by its chat fetch URL.
+type EmoteChannel struct {
+	URL        string    `json:"url"`
+	Platform   string    `json:"platform"`
+	PlatformID string    `json:"platformId"`
+	Count      int       `json:"count"`
+	Loaded     time.Time `json:"loaded"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// EmoteLoader downloads the third party emotes of a platform user, or the
+// global emotes when platform is empty.
+type EmoteLoader func(platform string, platformID string) (map[string]Emote, error)
+
+// EmoteSets keeps the global and per-channel third party emotes of the
+// registry up to date.
+type EmoteSets struct {
+	Registry *EmoteRegistry
+	Load     EmoteLoader
+
+	// Called after a refresh changes the emotes of a channel
+	OnChange func(EmoteSetChange)
+
+	// Called when a channel with a known platform ID is added
+	OnAdd func(EmoteChannel)
+
+	// Refresh interval (0 disables scheduled refreshes)
+	Interval time.Duration
+
+	// Platform IDs by chat URL, for channels whose ID cannot be read from
+	// the URL (Twitch logins, YouTube handles and videos)
+	PlatformIDs map[string]string
+
+	mu       sync.Mutex
+	channels map[string]*EmoteChannel
+}
+
+func NewEmoteSets(registry *EmoteRegistry, load EmoteLoader) *EmoteSets {
+	return &EmoteSets{
+		Registry:    registry,
+		Load:        load,
+		Interval:    defaultEmoteRefreshInterval,
+		PlatformIDs: make(map[string]string),
+		channels:    make(map[string]*EmoteChannel),
+	}
+}
+
+// EmoteSetsFromEnv reads the configuration from the environment:
+//
+//	EMOTE_CHANNEL_IDS       Comma separated url=platformID pairs
+//	                        (e.g. https://www.twitch.tv/dayoman=39226538)
+//	EMOTE_REFRESH_INTERVAL  Duration between refreshes, 0 to disable
+func EmoteSetsFromEnv(registry *EmoteRegistry) *EmoteSets {
+	s := NewEmoteSets(registry, LoadThirdPartyEmotes)
+
+	for _, pair := range strings.Split(os.Getenv("EMOTE_CHANNEL_IDS"), ",") {
+		chatURL, id, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && chatURL != "" && id != "" {
+			s.PlatformIDs[chatURL] = id
+		}
+	}
+	if v := os.Getenv("EMOTE_REFRESH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			s.Interval = d
+		} else {
+			log.Printf("emodl: Invalid EMOTE_REFRESH_INTERVAL %q", v)
+		}
+	}
+
+	return s
+}
+
+// ChannelPlatform returns the platform of a chat URL and the platform ID if
+// the URL contains it (YouTube /channel/<id> URLs).
+func ChannelPlatform(chatURL string) (platform string, platformID string) {
+	u, err := url.Parse(chatURL)
+	if err != nil {
+		return "", ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	switch host {
+	case "twitch.tv":
+		return PlatformTwitch, ""
+	case "youtube.com", "m.youtube.com":
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) >= 2 && parts[0] == "channel" {
+			return PlatformYouTube, parts[1]
+		}
+		return PlatformYouTube, ""
+	}
+	return "", ""
+}
+
+// AddChannel starts loading the emotes of the channel fetched from chatURL.
+// Channels without a known platform ID use global emotes only.
+func (s *EmoteSets) AddChannel(chatURL string) {
+	if !s.addChannel(chatURL) {
+		log.Printf("emodl: No platform ID for %s, using global emotes (set EMOTE_CHANNEL_IDS)", chatURL)
+		return
+	}
+	if s.OnAdd != nil {
+		s.mu.Lock()
+		ch := *s.channels[chatURL]
+		s.mu.Unlock()
+		s.OnAdd(ch)
+	}
+	go func() {
+		if err := s.Refresh(chatURL); err != nil {
+			log.Printf("emodl: Failed to load emotes for %s: %v", chatURL, err)
+		}
+	}()
+}
+
+// addChannel registers the channel, returning false if its platform ID is
+// unknown.
+func (s *EmoteSets) addChannel(chatURL string) bool {
+	platform, id := ChannelPlatform(chatURL)
+	if configured, ok := s.PlatformIDs[chatURL]; ok {
+		id = configured
+	}
+	if platform == "" || id == "" {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[chatURL] = &EmoteChannel{
+		URL:        chatURL,
+		Platform:   platform,
+		PlatformID: id,
+	}
+	return true
+}
+
+// Channels returns the state of every channel emote set.
+func (s *EmoteSets) Channels() []EmoteChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]EmoteChannel, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, *ch)
+	}
+	return channels
+}
+
+// RefreshGlobal reloads the global emotes.
+func (s *EmoteSets) RefreshGlobal() error {
+	emotes, err := s.Load("", "")
+	if len(emotes) > 0 {
+		s.Registry.SetGlobal(emotes)
+	}
+	return err
+}
+
+// Refresh reloads the emotes of a channel. Emotes identical to global emotes
+// are left to the global layer.
+func (s *EmoteSets) Refresh(chatURL string) error {
+	s.mu.Lock()
+	ch, ok := s.channels[chatURL]
+	var platform, id string
+	if ok {
+		platform, id = ch.Platform, ch.PlatformID
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrUnknownEmoteChannel
+	}
+
+	base := s.Registry.Snapshot().Channels[chatURL]
+	emotes, err := s.Load(platform, id)
+	global := s.Registry.Snapshot().Global
+	for name, emote := range emotes {
+		if g, ok := global[name]; ok && g.ID == emote.ID {
+			delete(emotes, name)
+		}
+	}
+
+	// Keep the previous set if nothing could be loaded
+	replaced := err == nil || len(emotes) > 0
+	if replaced {
+		if emotes == nil {
+			emotes = map[string]Emote{}
+		}
+		old := s.Registry.RebaseChannel(chatURL, base, emotes)
+		change := EmoteSetChange{Channel: chatURL, Source: "refresh"}
+		change.Added, change.Removed = diffEmotes(old, emotes)
+		if s.OnChange != nil && !change.Empty() {
+			s.OnChange(change)
+		}
+	}
+
+	s.mu.Lock()
+	if replaced {
+		ch.Loaded = time.Now()
+		ch.Count = len(emotes)
+	}
+	ch.Error = ""
+	if err != nil {
+		ch.Error = err.Error()
+	}
+	s.mu.Unlock()
+
+	return err
+}
+
+// RefreshAll reloads the global emotes, then every channel.
+func (s *EmoteSets) RefreshAll() {
+	if err := s.RefreshGlobal(); err != nil {
+		log.Printf("emodl: Failed to refresh global emotes: %v", err)
+	}
+	for _, ch := range s.Channels() {
+		if err := s.Refresh(ch.URL); err != nil {
+			log.Printf("emodl: Failed to refresh emotes for %s: %v", ch.URL, err)
+		}
+	}
+}
+
+// Run refreshes all emote sets every Interval.
+func (s *EmoteSets) Run() {
+	if s.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.RefreshAll()
+	}
+}
+
+// LoadThirdPartyEmotes downloads emotes from 7TV, BTTV and FFZ. The global
+// emotes of every provider are always included. FFZ only supports Twitch.
+func LoadThirdPartyEmotes(platform string, platformID string) (map[string]Emote, error) {
+	var opt emodl.DownloaderOptions
+	if platform != "" {
+		opt.SevenTV = &emodl.SevenTVOptions{
+			Platform:   platform,
+			PlatformID: platformID,
+		}
+		opt.BTTV = &emodl.BTTVOptions{
+			Platform:   platform,
+			PlatformID: platformID,
+		}
+		if platform == PlatformTwitch {
+			opt.FFZ = &emodl.FFZOptions{
+				Platform:   platform,
+				PlatformID: platformID,
+			}
+		}
+	}
+
+	downloader := emodl.NewDownloader(opt)
+	loaded, err := downloader.Load()
+	return convertEmotes(&downloader, loaded, ZeroWidthEmotesFromEnv()), err
+}
+
+// RefreshEmotes reloads the emotes of one channel ({"channel": url}), or of
+// every channel when none is given. Moderators only.
+func RefreshEmotes(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		Channel string `json:"channel"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	if requestBody.Channel == "" {
+		emoteSets.RefreshAll()
+	} else if err := emoteSets.Refresh(requestBody.Channel); errors.Is(err, ErrUnknownEmoteChannel) {
+		http.Error(w, "Channel not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("emodl: Failed to refresh emotes for %s: %v", requestBody.Channel, err)
+		http.Error(w, "Failed to refresh emotes", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(emoteSets.Channels())
+}
@@ -0,0 +1,258 @@
+package routes
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token scopes understood by the websocket routes.
+const (
+	ScopePublic = "public"
+	ScopeMod    = "mod"
+)
+
+var (
+	ErrTooManyConnections      = errors.New("too many connections")
+	ErrTooManyConnectionsForIP = errors.New("too many connections for client")
+	ErrMissingToken            = errors.New("missing token")
+	ErrInvalidToken            = errors.New("invalid token")
+	ErrExpiredToken            = errors.New("token expired")
+	ErrInsufficientScope       = errors.New("token scope insufficient")
+)
+
+type WSGuardOptions struct {
+	// Origins allowed to open a websocket (scheme://host[:port]).
+	// An empty list allows every origin.
+	AllowedOrigins []string
+
+	// Maximum simultaneous connections from one client IP (0 = unlimited)
+	MaxConnsPerIP int
+
+	// Maximum simultaneous connections to this instance (0 = unlimited)
+	MaxConns int
+
+	// Key used to sign and verify websocket tokens. Token auth is disabled
+	// when empty.
+	TokenSecret []byte
+
+	// Reject public connections which do not present a valid token.
+	RequireToken bool
+
+	// Use the last X-Forwarded-For address, added by the trusted proxy, as
+	// the client IP.
+	TrustProxy bool
+}
+
+// WSGuardOptionsFromEnv reads websocket guard settings from the environment.
+//
+//	WS_ALLOWED_ORIGINS   comma separated list of origins
+//	WS_MAX_CONNS_PER_IP  integer
+//	WS_MAX_CONNS         integer
+//	WS_TOKEN_SECRET      signing key for websocket tokens
+//	WS_REQUIRE_TOKEN     "true" to require a token on /ws/chat
+//	WS_TRUST_PROXY       "true" to trust X-Forwarded-For
+//
+// Tokens are issued by /ws/token to users logged in with Twitch, which the
+// web client does automatically. With WS_REQUIRE_TOKEN, other viewers and
+// overlays need a token passed in the page URL (?token=...).
+func WSGuardOptionsFromEnv() WSGuardOptions {
+	opt := WSGuardOptions{
+		TokenSecret:  []byte(os.Getenv("WS_TOKEN_SECRET")),
+		RequireToken: os.Getenv("WS_REQUIRE_TOKEN") == "true",
+		TrustProxy:   os.Getenv("WS_TRUST_PROXY") == "true",
+	}
+	for _, origin := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			opt.AllowedOrigins = append(opt.AllowedOrigins, origin)
+		}
+	}
+	opt.MaxConnsPerIP, _ = strconv.Atoi(os.Getenv("WS_MAX_CONNS_PER_IP"))
+	opt.MaxConns, _ = strconv.Atoi(os.Getenv("WS_MAX_CONNS"))
+	return opt
+}
+
+// WSGuard enforces origin, connection limit and token policies on websocket
+// routes. Connection counts are local to this instance.
+type WSGuard struct {
+	Options WSGuardOptions
+
+	origins   map[string]struct{}
+	mu        sync.Mutex
+	conns     int
+	connsByIP map[string]int
+}
+
+func NewWSGuard(opt WSGuardOptions) *WSGuard {
+	g := &WSGuard{Options: opt}
+	g.origins = make(map[string]struct{}, len(opt.AllowedOrigins))
+	for _, origin := range opt.AllowedOrigins {
+		g.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = struct{}{}
+	}
+	g.connsByIP = make(map[string]int)
+	return g
+}
+
+// CheckOrigin reports whether the request origin is on the allowlist.
+// Requests without an Origin header (non-browser clients) are allowed.
+func (g *WSGuard) CheckOrigin(r *http.Request) bool {
+	if len(g.origins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	_, ok := g.origins[strings.ToLower(u.Scheme+"://"+u.Host)]
+	return ok
+}
+
+// ClientIP returns the address used for per-client connection limits.
+// Behind a trusted proxy this is the last X-Forwarded-For entry, the one the
+// proxy appended; earlier entries are supplied by the client.
+func (g *WSGuard) ClientIP(r *http.Request) string {
+	if g.Options.TrustProxy {
+		fwd := strings.Join(r.Header.Values("X-Forwarded-For"), ",")
+		entries := strings.Split(fwd, ",")
+		if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Acquire reserves a connection slot for ip. The returned release function
+// must be called once the connection closes.
+func (g *WSGuard) Acquire(ip string) (func(), error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.Options.MaxConns > 0 && g.conns >= g.Options.MaxConns {
+		return nil, ErrTooManyConnections
+	}
+	if g.Options.MaxConnsPerIP > 0 && g.connsByIP[ip] >= g.Options.MaxConnsPerIP {
+		return nil, ErrTooManyConnectionsForIP
+	}
+	g.conns++
+	g.connsByIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.conns--
+			if g.connsByIP[ip]--; g.connsByIP[ip] <= 0 {
+				delete(g.connsByIP, ip)
+			}
+		})
+	}, nil
+}
+
+// WSClaims are carried by a signed websocket token.
+type WSClaims struct {
+	Subject string `json:"sub"`
+	Scope   string `json:"scope"`
+	Expiry  int64  `json:"exp"`
+}
+
+func (g *WSGuard) sign(payload string) string {
+	mac := hmac.New(sha256.New, g.Options.TokenSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignToken creates a token of the form payload.signature.
+func (g *WSGuard) SignToken(claims WSClaims) (string, error) {
+	if len(g.Options.TokenSecret) == 0 {
+		return "", errors.New("token secret not configured")
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + g.sign(payload), nil
+}
+
+// VerifyToken checks the token signature and expiry and returns its claims.
+func (g *WSGuard) VerifyToken(token string) (WSClaims, error) {
+	var claims WSClaims
+	if len(g.Options.TokenSecret) == 0 {
+		return claims, ErrInvalidToken
+	}
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(g.sign(payload))) {
+		return claims, ErrInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return claims, ErrInvalidToken
+	}
+	if claims.Expiry != 0 && time.Now().Unix() > claims.Expiry {
+		return claims, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+// Authorize validates the request token against the scope required by the
+// route. Public routes only need a token when RequireToken is set.
+func (g *WSGuard) Authorize(r *http.Request, scope string) (WSClaims, error) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		if scope == ScopePublic && !g.Options.RequireToken {
+			return WSClaims{Scope: ScopePublic}, nil
+		}
+		return WSClaims{}, ErrMissingToken
+	}
+	claims, err := g.VerifyToken(token)
+	if err != nil {
+		return claims, err
+	}
+	if scope != ScopePublic && claims.Scope != scope {
+		return claims, ErrInsufficientScope
+	}
+	return claims, nil
+}
+
+// Admit runs every guard check for a websocket route and writes an error
+// response on failure. On success the caller must invoke release when the
+// connection ends.
+func (g *WSGuard) Admit(w http.ResponseWriter, r *http.Request, scope string) (claims WSClaims, release func(), ok bool) {
+	if !g.CheckOrigin(r) {
+		http.Error(w, "Forbidden: Origin not allowed", http.StatusForbidden)
+		return claims, nil, false
+	}
+	claims, err := g.Authorize(r, scope)
+	if err != nil {
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return claims, nil, false
+	}
+	release, err = g.Acquire(g.ClientIP(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return claims, nil, false
+	}
+	return claims, release, true
+}
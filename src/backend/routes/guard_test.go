@@ -0,0 +1,145 @@
+package routes
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSGuardClientIP(t *testing.T) {
+	tests := []struct {
+		trustProxy bool
+		forwarded  []string
+		expected   string
+	}{
+		{false, nil, "10.0.0.1"},
+		{false, []string{"1.2.3.4"}, "10.0.0.1"},
+		{true, nil, "10.0.0.1"},
+		{true, []string{"1.2.3.4"}, "1.2.3.4"},
+		{true, []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{true, []string{"6.6.6.6", "1.2.3.4"}, "1.2.3.4"},
+		{true, []string{"6.6.6.6,"}, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		g := NewWSGuard(WSGuardOptions{TrustProxy: test.trustProxy})
+		r := httptest.NewRequest("GET", "/ws/chat", nil)
+		r.RemoteAddr = "10.0.0.1:5000"
+		for _, fwd := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", fwd)
+		}
+		if got := g.ClientIP(r); got != test.expected {
+			t.Errorf("%v %q: expected %s, got %s", test.trustProxy, test.forwarded, test.expected, got)
+		}
+	}
+}
+
+func TestWSGuardOrigin(t *testing.T) {
+	g := NewWSGuard(WSGuardOptions{AllowedOrigins: []string{"https://Chat.example.com/", "http://localhost:5173"}})
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://chat.example.com", true},
+		{"http://localhost:5173", true},
+		{"http://chat.example.com", false},
+		{"https://evil.example.com", false},
+		{"http://localhost:3000", false},
+		{"not a url", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/ws/chat", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if got := g.CheckOrigin(r); got != test.allowed {
+			t.Errorf("%q: expected %v, got %v", test.origin, test.allowed, got)
+		}
+	}
+
+	if !NewWSGuard(WSGuardOptions{}).CheckOrigin(httptest.NewRequest("GET", "/ws/chat", nil)) {
+		t.Error("Expected every origin without an allowlist")
+	}
+}
+
+func TestWSGuardLimits(t *testing.T) {
+	g := NewWSGuard(WSGuardOptions{MaxConns: 3, MaxConnsPerIP: 2})
+
+	release1, err := g.Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Acquire("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Acquire("a"); !errors.Is(err, ErrTooManyConnectionsForIP) {
+		t.Errorf("Expected per IP limit, got %v", err)
+	}
+	if _, err := g.Acquire("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Acquire("c"); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("Expected global limit, got %v", err)
+	}
+
+	// Releasing twice frees a single slot
+	release1()
+	release1()
+	if _, err := g.Acquire("c"); err != nil {
+		t.Errorf("Expected a free slot, got %v", err)
+	}
+	if _, err := g.Acquire("d"); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("Expected global limit, got %v", err)
+	}
+}
+
+func TestWSGuardTokens(t *testing.T) {
+	g := NewWSGuard(WSGuardOptions{TokenSecret: []byte("secret")})
+	sign := func(claims WSClaims) string {
+		token, err := g.SignToken(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	hour := time.Hour
+	public := sign(WSClaims{Subject: "dayo", Scope: ScopePublic, Expiry: time.Now().Add(hour).Unix()})
+	mod := sign(WSClaims{Subject: "dayo", Scope: ScopeMod, Expiry: time.Now().Add(hour).Unix()})
+	expired := sign(WSClaims{Subject: "dayo", Scope: ScopeMod, Expiry: time.Now().Add(-hour).Unix()})
+	modPayload, _, _ := strings.Cut(mod, ".")
+	_, publicSig, _ := strings.Cut(public, ".")
+	forged := modPayload + "." + publicSig
+	other, _ := NewWSGuard(WSGuardOptions{TokenSecret: []byte("other")}).SignToken(WSClaims{Scope: ScopeMod})
+
+	tests := []struct {
+		name         string
+		requireToken bool
+		scope        string
+		token        string
+		err          error
+	}{
+		{"public without token", false, ScopePublic, "", nil},
+		{"public token required", true, ScopePublic, "", ErrMissingToken},
+		{"public token", true, ScopePublic, public, nil},
+		{"mod without token", false, ScopeMod, "", ErrMissingToken},
+		{"mod token", false, ScopeMod, mod, nil},
+		{"public token for mod", false, ScopeMod, public, ErrInsufficientScope},
+		{"expired", false, ScopeMod, expired, ErrExpiredToken},
+		{"forged payload", false, ScopeMod, forged, ErrInvalidToken},
+		{"other secret", false, ScopeMod, other, ErrInvalidToken},
+		{"garbage", false, ScopePublic, "garbage", ErrInvalidToken},
+	}
+	for _, test := range tests {
+		g.Options.RequireToken = test.requireToken
+		r := httptest.NewRequest("GET", "/ws/chat?token="+test.token, nil)
+		if _, err := g.Authorize(r, test.scope); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	if _, err := NewWSGuard(WSGuardOptions{}).VerifyToken(mod); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected tokens to be refused without a secret, got %v", err)
+	}
+}
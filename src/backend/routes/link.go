@@ -0,0 +1,304 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Link policy modes. Links to allowlisted domains always pass; the mode
+// decides what happens to every other link.
+const (
+	LinkPolicyAllow     = "allow"     // all links pass
+	LinkPolicyAllowlist = "allowlist" // messages with other links are dropped
+	LinkPolicyMask      = "mask"      // other links are masked
+	LinkPolicyApproval  = "approval"  // messages with other links wait for a moderator
+)
+
+const (
+	maskedLinkText     = "[link removed]"
+	maxLinkDisplayLen  = 40
+	pendingMessagesKey = "pendingMessages"
+
+	// Held messages nobody approves are discarded after this long
+	pendingMessageTTL = 24 * time.Hour
+)
+
+// Top level domains recognized without a scheme or www prefix.
+var bareLinkTLDs = map[string]struct{}{
+	"com": {},
+	"net": {},
+	"org": {},
+	"tv":  {},
+	"gg":  {},
+	"io":  {},
+	"be":  {},
+	"ly":  {},
+	"co":  {},
+	"app": {},
+	"dev": {},
+	"me":  {},
+}
+
+var linkPolicy = LinkPolicy{Mode: LinkPolicyAllow}
+
+type Link struct {
+	URL     string `json:"url"`
+	Domain  string `json:"domain"`
+	Display string `json:"display"`
+	Masked  bool   `json:"masked"`
+}
+
+// ParseLink reports whether word is a URL and returns its normalized form.
+// Trailing punctuation is not part of the link; n is the length of word
+// covered by the link.
+func ParseLink(word string) (link Link, n int, ok bool) {
+	raw := strings.TrimRight(word, ".,!?;:)]}'\"")
+	if raw == "" {
+		return link, 0, false
+	}
+
+	lower := strings.ToLower(raw)
+	withScheme := raw
+	switch {
+	case strings.HasPrefix(lower, "http://"), strings.HasPrefix(lower, "https://"):
+	case strings.HasPrefix(lower, "www."):
+		withScheme = "https://" + raw
+	default:
+		host, _, _ := strings.Cut(lower, "/")
+		dot := strings.LastIndexByte(host, '.')
+		if dot <= 0 {
+			return link, 0, false
+		}
+		if _, ok := bareLinkTLDs[host[dot+1:]]; !ok {
+			return link, 0, false
+		}
+		withScheme = "https://" + raw
+	}
+
+	u, err := url.Parse(withScheme)
+	if err != nil || u.Hostname() == "" || !strings.Contains(u.Hostname(), ".") {
+		return link, 0, false
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "https" && u.Port() == "443") || (u.Scheme == "http" && u.Port() == "80") {
+		u.Host = u.Hostname()
+	}
+	u.Fragment = ""
+
+	display := u.Host + u.EscapedPath()
+	if display != "" && display[len(display)-1] == '/' {
+		display = display[:len(display)-1]
+	}
+	if utf8.RuneCountInString(display) > maxLinkDisplayLen {
+		display = string([]rune(display)[:maxLinkDisplayLen-1]) + "…"
+	}
+
+	return Link{
+		URL:     u.String(),
+		Domain:  strings.TrimPrefix(u.Hostname(), "www."),
+		Display: display,
+	}, len(raw), true
+}
+
+type LinkPolicy struct {
+	Mode           string
+	AllowedDomains map[string]struct{}
+}
+
+// LinkPolicyFromEnv reads the link policy from the environment.
+//
+//	LINK_POLICY           allow (default), allowlist, mask or approval
+//	LINK_ALLOWED_DOMAINS  comma separated list of domains
+func LinkPolicyFromEnv() LinkPolicy {
+	lp := LinkPolicy{
+		Mode:           strings.ToLower(os.Getenv("LINK_POLICY")),
+		AllowedDomains: make(map[string]struct{}),
+	}
+	switch lp.Mode {
+	case LinkPolicyAllowlist, LinkPolicyMask, LinkPolicyApproval:
+	default:
+		lp.Mode = LinkPolicyAllow
+	}
+	for _, domain := range strings.Split(os.Getenv("LINK_ALLOWED_DOMAINS"), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			lp.AllowedDomains[strings.TrimPrefix(domain, "www.")] = struct{}{}
+		}
+	}
+	return lp
+}
+
+// Allowed reports whether domain or one of its parent domains is allowlisted.
+func (lp LinkPolicy) Allowed(domain string) bool {
+	for domain != "" {
+		if _, ok := lp.AllowedDomains[domain]; ok {
+			return true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return false
+}
+
+// Apply enforces the policy on the link tokens of m.
+// Returns the message and whether it may be published directly. Messages
+// which may not be published are either dropped (allowlist) or held for
+// approval; the caller decides based on the mode.
+func (lp LinkPolicy) Apply(m Message) (Message, bool) {
+	if lp.Mode == LinkPolicyAllow {
+		return m, true
+	}
+
+	blocked := false
+	for _, tok := range m.Tokens {
+		if tok.Type == TokenTypeLink && !lp.Allowed(tok.Link.Domain) {
+			blocked = true
+			break
+		}
+		// The arguments of commands are not tokenized
+		if _, ok := lp.maskText(tok.Text); tok.Type == TokenTypeCommand && ok {
+			blocked = true
+			break
+		}
+	}
+	if !blocked {
+		return m, true
+	}
+
+	switch lp.Mode {
+	case LinkPolicyMask:
+		return lp.mask(m), true
+	default:
+		return m, false
+	}
+}
+
+// mask replaces blocked links in the message and tokens, shifting the
+// source ranges of the following tokens accordingly.
+func (lp LinkPolicy) mask(m Message) Message {
+	var sb strings.Builder
+	runes := 0
+	for i, tok := range m.Tokens {
+		text := m.Message[tok.Start:tok.End]
+		if tok.Type == TokenTypeLink && !lp.Allowed(tok.Link.Domain) {
+			text = maskedLinkText
+			tok.Text = maskedLinkText
+			tok.Link = &Link{Masked: true}
+		} else if tok.Type == TokenTypeCommand {
+			text, _ = lp.maskText(text)
+			tok.Text, _ = lp.maskText(tok.Text)
+		}
+		tok.Start = sb.Len()
+		tok.RuneStart = runes
+		sb.WriteString(text)
+		runes += utf8.RuneCountInString(text)
+		tok.End = sb.Len()
+		tok.RuneEnd = runes
+		m.Tokens[i] = tok
+	}
+	m.Message = sb.String()
+	return m
+}
+
+// maskText replaces the blocked links in the words of s. blocked reports
+// whether any were found.
+func (lp LinkPolicy) maskText(s string) (masked string, blocked bool) {
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		wordStart := skipSpace(s, i)
+		wordEnd := skipWord(s, wordStart)
+		sb.WriteString(s[i:wordStart])
+		word := s[wordStart:wordEnd]
+		if link, n, ok := ParseLink(word); ok && !lp.Allowed(link.Domain) {
+			sb.WriteString(maskedLinkText)
+			sb.WriteString(word[n:])
+			blocked = true
+		} else {
+			sb.WriteString(word)
+		}
+		i = wordEnd
+	}
+	return sb.String(), blocked
+}
+
+// pendingMessage is a message held by the link policy with the chat it came
+// from, so that approving it answers there.
+type pendingMessage struct {
+	Message Message `json:"message"`
+	URL     string  `json:"url"`
+}
+
+// holdForApproval stores the message from url until a moderator approves
+// it, for up to pendingMessageTTL, and shows it on the moderator stream.
+func holdForApproval(m Message, url string) error {
+	id, err := generateState()
+	if err != nil {
+		return err
+	}
+	m.ID = id
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	pending, err := json.Marshal(pendingMessage{Message: m, URL: url})
+	if err != nil {
+		return err
+	}
+	if err := redisClient.Set(ctx, pendingMessagesKey+":"+id, pending, pendingMessageTTL).Err(); err != nil {
+		return err
+	}
+	return redisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: "modMessages",
+		Values: map[string]any{"message": string(data)},
+		MaxLen: 100,
+		Approx: true,
+	}).Err()
+}
+
+// ApprovePendingMessage delivers (approve) or discards (reject) a message
+// held by the link policy. Approved messages run their command and get the
+// author's colour like any other message.
+func ApprovePendingMessage(w http.ResponseWriter, r *http.Request) {
+	var requestBody struct {
+		ID      string `json:"id"`
+		Approve bool   `json:"approve"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil || requestBody.ID == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	data, err := redisClient.GetDel(ctx, pendingMessagesKey+":"+requestBody.ID).Result()
+	if err == redis.Nil {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to read pending message", http.StatusInternalServerError)
+		return
+	}
+
+	if requestBody.Approve {
+		var pending pendingMessage
+		if err := json.Unmarshal([]byte(data), &pending); err != nil {
+			http.Error(w, "Invalid pending message", http.StatusInternalServerError)
+			return
+		}
+		if err := deliverMessage(pending.Message, pending.URL); err != nil {
+			log.Printf("redis: Failed to publish approved message: %v", err)
+			http.Error(w, "Failed to publish message", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,144 @@
+package routes
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	mentionPrefix        = '@'
+	defaultMaxAuthors    = 4096
+	defaultAuthorTimeout = 2 * time.Hour
+)
+
+type Mention struct {
+	Name     string `json:"name"`
+	Source   string `json:"source"`
+	Colour   string `json:"colour"`
+	Resolved bool   `json:"resolved"`
+}
+
+type recentAuthor struct {
+	Name   string
+	Source string
+	Colour string
+	Seen   time.Time
+}
+
+// AuthorCache remembers recent chat authors from every source so that
+// mentions can be resolved across platforms. Safe for concurrent use.
+type AuthorCache struct {
+	MaxAuthors int
+	Timeout    time.Duration
+
+	mu      sync.RWMutex
+	authors map[string]recentAuthor
+}
+
+func NewAuthorCache() *AuthorCache {
+	return &AuthorCache{
+		MaxAuthors: defaultMaxAuthors,
+		Timeout:    defaultAuthorTimeout,
+		authors:    make(map[string]recentAuthor),
+	}
+}
+
+// Seen records that name spoke on source with the given colour.
+func (c *AuthorCache) Seen(name string, source string, colour string) {
+	if c == nil || name == "" {
+		return
+	}
+	now := time.Now()
+	key := strings.ToLower(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.authors[key]; !ok && len(c.authors) >= c.MaxAuthors {
+		c.evict(now)
+	}
+	c.authors[key] = recentAuthor{name, source, colour, now}
+}
+
+// evict drops expired authors, or the oldest author if none have expired.
+// Must be called with the lock held.
+func (c *AuthorCache) evict(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, a := range c.authors {
+		if now.Sub(a.Seen) > c.Timeout {
+			delete(c.authors, key)
+		} else if oldestKey == "" || a.Seen.Before(oldest) {
+			oldestKey, oldest = key, a.Seen
+		}
+	}
+	if len(c.authors) >= c.MaxAuthors {
+		delete(c.authors, oldestKey)
+	}
+}
+
+// Resolve looks up a recently seen author by name (case insensitive).
+func (c *AuthorCache) Resolve(name string) (Mention, bool) {
+	m := Mention{Name: name}
+	if c == nil {
+		return m, false
+	}
+
+	c.mu.RLock()
+	a, ok := c.authors[strings.ToLower(name)]
+	c.mu.RUnlock()
+
+	if !ok || time.Since(a.Seen) > c.Timeout {
+		return m, false
+	}
+	return Mention{
+		Name:     a.Name,
+		Source:   a.Source,
+		Colour:   a.Colour,
+		Resolved: true,
+	}, true
+}
+
+// ParseMention reports whether word is an @name mention. Trailing
+// punctuation is not part of the mention; n is the length of word covered
+// by the mention.
+func ParseMention(word string) (name string, n int, ok bool) {
+	if len(word) < 2 || word[0] != mentionPrefix {
+		return "", 0, false
+	}
+	raw := strings.TrimRight(word, ".,!?;:)]}'\"")
+	name = raw[1:]
+	if name == "" {
+		return "", 0, false
+	}
+	for _, r := range name {
+		if !isUsernameRune(r) {
+			return "", 0, false
+		}
+	}
+	return name, len(raw), true
+}
+
+// Matches the characters kept in author names by fetch_chat.py.
+func isUsernameRune(r rune) bool {
+	switch r {
+	case '_', '-', '.', '·':
+		return true
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// MentionsUser reports whether any mention token in m names username.
+func (m Message) MentionsUser(username string) bool {
+	if username == "" {
+		return false
+	}
+	for _, tok := range m.Tokens {
+		if tok.Type == TokenTypeMention && tok.Mention != nil && strings.EqualFold(tok.Mention.Name, username) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package routes
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// PATTERN GRAMMAR
+// ----------------------------------------------------------------------------
+//
+//	pattern = "pattern" op { op } sep    (at most PatternMaxOpsLen op characters)
+//	op      = colour [ width ]
+//	colour  = one of the PatternPalette codes
+//	width   = "1" … "9"                  (characters per colour, default 1)
+//
+// Example: patternr2w2: alternates two red and two white characters.
+
+const (
+	PatternKeyword   = "pattern"
+	PatternMaxOpsLen = 8
+)
+
+// Colour codes usable in patterns (hue wheel plus greys).
+var PatternPalette = map[byte]string{
+	'r': "#FF0000", // red
+	'o': "#FF8000", // orange
+	'y': "#FFFF00", // yellow
+	'l': "#80FF00", // lime
+	'g': "#00FF00", // green
+	't': "#00FF80", // teal
+	'c': "#00FFFF", // cyan
+	's': "#0080FF", // sky
+	'b': "#0000FF", // blue
+	'v': "#8000FF", // violet
+	'p': "#FF00FF", // purple
+	'q': "#FF0080", // pink
+	'w': "#FFFFFF", // white
+	'e': "#808080", // grey
+	'k': "#000000", // black
+}
+
+type PatternOp struct {
+	Code   string `json:"code"`
+	Colour string `json:"colour"`
+	Width  int    `json:"width"`
+}
+
+type Pattern struct {
+	Ops []PatternOp `json:"ops"`
+}
+
+// ErrInvalidPattern describes why a pattern prefix was rejected.
+type ErrInvalidPattern struct {
+	Ops    string
+	Reason string
+}
+
+func (e *ErrInvalidPattern) Error() string {
+	return fmt.Sprintf("invalid pattern %q: %s", e.Ops, e.Reason)
+}
+
+// isPatternOps reports whether s is made only of op characters, i.e. is
+// meant as a pattern rather than a word starting with "pattern".
+func isPatternOps(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if _, ok := PatternPalette[s[i]]; !ok && (s[i] < '0' || s[i] > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParsePattern parses and validates pattern opcodes (the text following the
+// "pattern" keyword).
+func ParsePattern(ops string) (Pattern, error) {
+	var p Pattern
+
+	if ops == "" {
+		return p, &ErrInvalidPattern{ops, "at least one colour is required"}
+	}
+	if len(ops) > PatternMaxOpsLen {
+		return p, &ErrInvalidPattern{ops, fmt.Sprintf("at most %d characters are allowed", PatternMaxOpsLen)}
+	}
+
+	for i := 0; i < len(ops); i++ {
+		code := ops[i]
+		colour, ok := PatternPalette[code]
+		if !ok {
+			return p, &ErrInvalidPattern{ops, fmt.Sprintf("unknown colour %q", code)}
+		}
+		op := PatternOp{
+			Code:   string(code),
+			Colour: colour,
+			Width:  1,
+		}
+		if i+1 < len(ops) && '0' <= ops[i+1] && ops[i+1] <= '9' {
+			if ops[i+1] == '0' {
+				return p, &ErrInvalidPattern{ops, "width must be between 1 and 9"}
+			}
+			op.Width = int(ops[i+1] - '0')
+			i++
+		}
+		p.Ops = append(p.Ops, op)
+	}
+
+	return p, nil
+}
+
+// String returns the normalized opcodes (widths of 1 are omitted).
+func (p Pattern) String() string {
+	var sb strings.Builder
+	for _, op := range p.Ops {
+		sb.WriteString(op.Code)
+		if op.Width != 1 {
+			sb.WriteByte(byte('0' + op.Width))
+		}
+	}
+	return sb.String()
+}
+
+// PatternHelp explains the pattern grammar to users.
+func PatternHelp() string {
+	sb := strings.Builder{}
+
+	fmt.Fprintf(&sb, "Usage: pattern[colour][width]...: (up to %d characters, width 1-9). Colours:", PatternMaxOpsLen)
+	for _, code := range slices.Sorted(maps.Keys(PatternPalette)) {
+		sb.WriteByte(' ')
+		sb.WriteByte(code)
+	}
+
+	return sb.String()
+}
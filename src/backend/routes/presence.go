@@ -0,0 +1,243 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client types reported by websocket clients with the ?client= parameter.
+const (
+	ClientTypeOverlay   = "overlay"
+	ClientTypeDashboard = "dashboard"
+	ClientTypePopout    = "popout"
+	ClientTypeOther     = "other"
+)
+
+const (
+	presenceKeyPrefix = "presence:"
+	presenceTTL       = 30 * time.Second
+	presenceCacheTTL  = 5 * time.Second
+	maxRoomLength     = 32
+)
+
+var presence *Presence
+
+const (
+	// Redis pub/sub channel for events broadcast to every websocket
+	chatEventsChannel = "chatEvents"
+
+	EventPresence        = "presence"
+	EventEmoteSetChanged = "emote_set_changed"
+	EventCounter         = "counter"
+)
+
+// Event is the envelope for typed server events sent over the websocket
+// alongside chat messages.
+type Event struct {
+	Event string `json:"event"`
+	Data  any    `json:"data"`
+}
+
+type RoomPresence struct {
+	Total   int            `json:"total"`
+	Clients map[string]int `json:"clients"`
+}
+
+type PresenceSnapshot struct {
+	Total int                     `json:"total"`
+	Rooms map[string]RoomPresence `json:"rooms"`
+}
+
+type presenceKey struct {
+	Room   string
+	Client string
+}
+
+// Presence counts connected websocket clients by room and client type.
+//
+// Each instance publishes its own counts to a Redis hash that expires unless
+// refreshed, so totals summed across instances drop stale instances on their
+// own.
+type Presence struct {
+	instanceID string
+
+	mu    sync.Mutex
+	local map[presenceKey]int
+
+	// Serializes publishes so an older snapshot never overwrites a newer one
+	publishMu sync.Mutex
+
+	cacheMu   sync.Mutex
+	cache     PresenceSnapshot
+	cacheTime time.Time
+}
+
+func NewPresence(instanceID string) *Presence {
+	return &Presence{
+		instanceID: instanceID,
+		local:      make(map[presenceKey]int),
+	}
+}
+
+// NormalizeClientType maps unknown client types to ClientTypeOther.
+func NormalizeClientType(client string) string {
+	client = strings.ToLower(client)
+	switch client {
+	case ClientTypeOverlay, ClientTypeDashboard, ClientTypePopout:
+		return client
+	default:
+		return ClientTypeOther
+	}
+}
+
+// NormalizeRoom lowercases a client-chosen room name, falling back to
+// fallback when it is empty, longer than maxRoomLength or contains anything
+// but letters, digits, '-' and '_'.
+func NormalizeRoom(room string, fallback string) string {
+	room = strings.ToLower(room)
+	if room == "" || len(room) > maxRoomLength {
+		return fallback
+	}
+	for _, r := range room {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return fallback
+		}
+	}
+	return room
+}
+
+// Join records a connected client and returns a function which removes it.
+func (p *Presence) Join(room string, client string) func() {
+	key := presenceKey{room, NormalizeClientType(client)}
+
+	p.mu.Lock()
+	p.local[key]++
+	p.mu.Unlock()
+	p.publish()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			if p.local[key]--; p.local[key] <= 0 {
+				delete(p.local, key)
+			}
+			p.mu.Unlock()
+			p.publish()
+		})
+	}
+}
+
+// publish writes the local counts to this instance's Redis hash.
+func (p *Presence) publish() {
+	p.publishMu.Lock()
+	defer p.publishMu.Unlock()
+
+	p.mu.Lock()
+	fields := make(map[string]any, len(p.local))
+	for key, count := range p.local {
+		fields[key.Room+"|"+key.Client] = count
+	}
+	p.mu.Unlock()
+	if redisClient == nil {
+		return
+	}
+
+	key := presenceKeyPrefix + p.instanceID
+	pipe := redisClient.TxPipeline()
+	pipe.Del(ctx, key)
+	if len(fields) > 0 {
+		pipe.HSet(ctx, key, fields)
+		pipe.Expire(ctx, key, presenceTTL)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("redis: Failed to publish presence: %v", err)
+	}
+}
+
+// Run refreshes this instance's presence entry until the process exits.
+func (p *Presence) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.publish()
+	}
+}
+
+// Snapshot sums the presence entries of every live instance.
+func (p *Presence) Snapshot() (PresenceSnapshot, error) {
+	snapshot := PresenceSnapshot{Rooms: make(map[string]RoomPresence)}
+
+	iter := redisClient.Scan(ctx, 0, presenceKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		fields, err := redisClient.HGetAll(ctx, iter.Val()).Result()
+		if err != nil {
+			return snapshot, err
+		}
+		for field, value := range fields {
+			room, client, ok := strings.Cut(field, "|")
+			if !ok {
+				continue
+			}
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			rp, ok := snapshot.Rooms[room]
+			if !ok {
+				rp.Clients = make(map[string]int)
+			}
+			rp.Total += count
+			rp.Clients[client] += count
+			snapshot.Rooms[room] = rp
+			snapshot.Total += count
+		}
+	}
+	return snapshot, iter.Err()
+}
+
+// Cached returns a recent snapshot, refreshing it at most every few seconds
+// so that periodic events from many connections do not flood Redis.
+func (p *Presence) Cached() PresenceSnapshot {
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+
+	if time.Since(p.cacheTime) < presenceCacheTTL {
+		return p.cache
+	}
+	snapshot, err := p.Snapshot()
+	if err != nil {
+		log.Printf("redis: Failed to read presence: %v", err)
+		return p.cache
+	}
+	p.cache = snapshot
+	p.cacheTime = time.Now()
+	return snapshot
+}
+
+// PresenceEvent builds the periodic presence event sent to clients in room.
+func (p *Presence) PresenceEvent(room string) Event {
+	snapshot := p.Cached()
+	rp, ok := snapshot.Rooms[room]
+	if !ok {
+		rp.Clients = map[string]int{}
+	}
+	return Event{
+		Event: EventPresence,
+		Data: struct {
+			Room string `json:"room"`
+			RoomPresence
+		}{room, rp},
+	}
+}
+
+// GetPresence serves the connected client counts for every room.
+func GetPresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presence.Cached())
+}
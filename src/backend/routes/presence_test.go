@@ -0,0 +1,49 @@
+package routes
+
+import "testing"
+
+func TestNormalizeRoom(t *testing.T) {
+	tests := []struct {
+		room     string
+		expected string
+	}{
+		{"", "public"},
+		{"Overlay-1", "overlay-1"},
+		{"stream_2", "stream_2"},
+		{"a|b", "public"},
+		{"room name", "public"},
+		{"ümlaut", "public"},
+		{"abcdefghijklmnopqrstuvwxyz0123456", "public"},
+	}
+	for _, test := range tests {
+		if got := NormalizeRoom(test.room, "public"); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.room, test.expected, got)
+		}
+	}
+}
+
+func TestPresenceJoin(t *testing.T) {
+	p := NewPresence("test")
+	leave1 := p.Join("public", "Overlay")
+	leave2 := p.Join("public", "overlay")
+	leave3 := p.Join("public", "unknown")
+
+	if n := p.local[presenceKey{"public", ClientTypeOverlay}]; n != 2 {
+		t.Errorf("Expected 2 overlays, got %d", n)
+	}
+	if n := p.local[presenceKey{"public", ClientTypeOther}]; n != 1 {
+		t.Errorf("Expected 1 other client, got %d", n)
+	}
+
+	// Leaving twice only counts once
+	leave1()
+	leave1()
+	leave3()
+	if n := p.local[presenceKey{"public", ClientTypeOverlay}]; n != 1 {
+		t.Errorf("Expected 1 overlay, got %d", n)
+	}
+	leave2()
+	if len(p.local) != 0 {
+		t.Errorf("Expected no clients, got %v", p.local)
+	}
+}
@@ -0,0 +1,384 @@
+package routes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	quotesKey       = "quotes"
+	quotesNextKey   = "quotes:next"
+	maxQuoteLen     = 500
+	maxQuoteGameLen = 100
+)
+
+var (
+	ErrUnknownQuote = errors.New("no such quote")
+	ErrInvalidQuote = errors.New("invalid quote")
+)
+
+var quotes *QuoteBook
+
+// Quote is a saved chat line. Quotes from every platform share one book.
+type Quote struct {
+	ID        int       `json:"id"`
+	Text      string    `json:"text"`
+	Author    string    `json:"author"`         // Who said it
+	AddedBy   string    `json:"addedBy"`        // Who saved it
+	Source    string    `json:"source"`         // Platform it was saved from
+	Game      string    `json:"game,omitempty"` // Game or stream title, if known
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (q Quote) String() string {
+	s := fmt.Sprintf("#%d: \"%s\" - %s", q.ID, q.Text, q.Author)
+	if q.Game != "" {
+		s += " [" + q.Game + "]"
+	}
+	return s + " (" + q.CreatedAt.Format(time.DateOnly) + ")"
+}
+
+// QuoteFilter selects quotes. Empty fields match every quote.
+type QuoteFilter struct {
+	Query  string // Substring of the text, author or game (case insensitive)
+	Author string
+	Source string
+	Game   string
+}
+
+func (f QuoteFilter) match(q Quote) bool {
+	contains := func(s string, sub string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+	if f.Query != "" && !contains(q.Text, f.Query) && !contains(q.Author, f.Query) && !contains(q.Game, f.Query) {
+		return false
+	}
+	return (f.Author == "" || strings.EqualFold(q.Author, f.Author)) &&
+		(f.Source == "" || strings.EqualFold(q.Source, f.Source)) &&
+		(f.Game == "" || contains(q.Game, f.Game))
+}
+
+// QuoteBook holds the quotes, kept in Redis.
+type QuoteBook struct {
+	// Looks up the current game or title of a message source, for quotes
+	// added without one
+	Game func(source string) string
+
+	mu     sync.RWMutex
+	quotes map[int]Quote
+	next   int // Last ID given without Redis
+}
+
+// NewQuoteBook creates an empty quote book and registers !quote, !addquote
+// and !delquote in r.
+func NewQuoteBook(r *CommandRegistry) *QuoteBook {
+	b := &QuoteBook{quotes: make(map[int]Quote)}
+	b.register(r)
+	return b
+}
+
+// Load replaces the quotes with those stored in Redis.
+func (b *QuoteBook) Load() error {
+	data, err := redisClient.HGetAll(ctx, quotesKey).Result()
+	if err != nil {
+		return err
+	}
+	loaded := make(map[int]Quote, len(data))
+	for id, d := range data {
+		var q Quote
+		if err := json.Unmarshal([]byte(d), &q); err != nil {
+			log.Printf("quotes: Invalid quote %s: %v", id, err)
+			continue
+		}
+		loaded[q.ID] = q
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.quotes = loaded
+	for id := range loaded {
+		b.next = max(b.next, id)
+	}
+	return nil
+}
+
+// nextID allocates a quote ID. Must be called with the lock held.
+func (b *QuoteBook) nextID() (int, error) {
+	if redisClient == nil {
+		b.next++
+		return b.next, nil
+	}
+	id, err := redisClient.Incr(ctx, quotesNextKey).Result()
+	return int(id), err
+}
+
+// Add saves a quote with a new ID and the current time.
+func (b *QuoteBook) Add(q Quote) (Quote, error) {
+	q.Text = strings.TrimSpace(q.Text)
+	if q.Text == "" || len(q.Text) > maxQuoteLen {
+		return q, fmt.Errorf("%w: quotes are 1 to %d bytes", ErrInvalidQuote, maxQuoteLen)
+	}
+	if len(q.Game) > maxQuoteGameLen {
+		return q, fmt.Errorf("%w: games are up to %d bytes", ErrInvalidQuote, maxQuoteGameLen)
+	}
+	if q.Author == "" {
+		q.Author = q.AddedBy
+	}
+	q.CreatedAt = time.Now().UTC()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id, err := b.nextID()
+	if err != nil {
+		return q, err
+	}
+	q.ID = id
+	if redisClient != nil {
+		data, err := json.Marshal(q)
+		if err != nil {
+			return q, err
+		}
+		if err := redisClient.HSet(ctx, quotesKey, strconv.Itoa(q.ID), data).Err(); err != nil {
+			return q, err
+		}
+	}
+	b.quotes[q.ID] = q
+	notifyStateChange(StateQuotes)
+	return q, nil
+}
+
+// Delete removes a quote. IDs are not reused.
+func (b *QuoteBook) Delete(id int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.quotes[id]; !ok {
+		return ErrUnknownQuote
+	}
+	if redisClient != nil {
+		if err := redisClient.HDel(ctx, quotesKey, strconv.Itoa(id)).Err(); err != nil {
+			return err
+		}
+	}
+	delete(b.quotes, id)
+	notifyStateChange(StateQuotes)
+	return nil
+}
+
+func (b *QuoteBook) Get(id int) (Quote, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	q, ok := b.quotes[id]
+	return q, ok
+}
+
+// Find returns the quotes matching f, ordered by ID.
+func (b *QuoteBook) Find(f QuoteFilter) []Quote {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	found := []Quote{}
+	for _, q := range b.quotes {
+		if f.match(q) {
+			found = append(found, q)
+		}
+	}
+	slices.SortFunc(found, func(a Quote, b Quote) int {
+		return a.ID - b.ID
+	})
+	return found
+}
+
+// Random returns a random quote matching f.
+func (b *QuoteBook) Random(f QuoteFilter) (Quote, bool) {
+	found := b.Find(f)
+	if len(found) == 0 {
+		return Quote{}, false
+	}
+	return found[rand.IntN(len(found))], true
+}
+
+func (book *QuoteBook) register(r *CommandRegistry) {
+	r.Register(CommandFunc{
+		CommandInfo: CommandInfo{
+			Name:     "quote",
+			Aliases:  []string{"q"},
+			Cooldown: Cooldown{Global: 5 * time.Second, User: 15 * time.Second, Exempt: RoleModerator},
+			Args:     []ArgSpec{{Name: "number or search", Type: ArgText, Optional: true}},
+		},
+		Handler: func(c *CommandContext) (Message, error) {
+			query := c.Arg("number or search").Text
+			var q Quote
+			var ok bool
+			if id, err := strconv.Atoi(strings.TrimPrefix(query, "#")); err == nil {
+				q, ok = book.Get(id)
+			} else {
+				q, ok = book.Random(QuoteFilter{Query: query})
+			}
+			if !ok {
+				return c.Parser.CreateResponse(fmt.Sprintf("@%s No quote found", c.Message.Author)), nil
+			}
+			return c.Parser.CreateResponse(q.String()), nil
+		},
+	})
+	r.Register(CommandFunc{
+		CommandInfo: CommandInfo{
+			Name: "addquote",
+			Role: RoleVIP,
+			Args: []ArgSpec{
+				{Name: "author", Type: ArgMention, Flag: true},
+				{Name: "game", Type: ArgString, Flag: true},
+				{Name: "text", Type: ArgText},
+			},
+		},
+		Handler: func(c *CommandContext) (Message, error) {
+			game := c.Arg("game").Text
+			if game == "" && book.Game != nil {
+				game = book.Game(c.Message.Source)
+			}
+			q, err := book.Add(Quote{
+				Text:    c.Arg("text").Text,
+				Author:  c.Arg("author").Text,
+				AddedBy: c.Message.Author,
+				Source:  c.Message.Source,
+				Game:    game,
+			})
+			if err != nil {
+				return c.Parser.CreateResponse(fmt.Sprintf("@%s %v", c.Message.Author, err)), nil
+			}
+			return c.Parser.CreateResponse(fmt.Sprintf("@%s Added quote #%d", c.Message.Author, q.ID)), nil
+		},
+	})
+	r.Register(CommandFunc{
+		CommandInfo: CommandInfo{
+			Name: "delquote",
+			Role: RoleModerator,
+			Args: []ArgSpec{{Name: "number", Type: ArgInteger}},
+		},
+		Handler: func(c *CommandContext) (Message, error) {
+			id := int(c.Arg("number").Integer)
+			if err := book.Delete(id); err != nil {
+				return c.Parser.CreateResponse(fmt.Sprintf("@%s %v: #%d", c.Message.Author, err, id)), nil
+			}
+			return c.Parser.CreateResponse(fmt.Sprintf("@%s Deleted quote #%d", c.Message.Author, id)), nil
+		},
+	})
+}
+
+func quoteFilterFromQuery(r *http.Request) QuoteFilter {
+	query := r.URL.Query()
+	return QuoteFilter{
+		Query:  query.Get("q"),
+		Author: query.Get("author"),
+		Source: query.Get("source"),
+		Game:   query.Get("game"),
+	}
+}
+
+// ListQuotes lists the quotes. Filters: q (text, author or game), author,
+// source and game.
+func ListQuotes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quotes.Find(quoteFilterFromQuery(r)))
+}
+
+// GetQuote returns a quote by ID.
+func GetQuote(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	q, ok := quotes.Get(id)
+	if !ok {
+		http.Error(w, "Quote not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
+
+// ExportQuotes downloads the quotes matching the ListQuotes filters as JSON
+// or, with format=csv, as CSV.
+func ExportQuotes(w http.ResponseWriter, r *http.Request) {
+	found := quotes.Find(quoteFilterFromQuery(r))
+
+	if r.URL.Query().Get("format") != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="quotes.json"`)
+		json.NewEncoder(w).Encode(found)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="quotes.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "text", "author", "addedBy", "source", "game", "createdAt"})
+	for _, q := range found {
+		cw.Write([]string{strconv.Itoa(q.ID), csvText(q.Text), csvText(q.Author), csvText(q.AddedBy), q.Source, csvText(q.Game), q.CreatedAt.Format(time.RFC3339)})
+	}
+	cw.Flush()
+}
+
+// csvText escapes chat text that spreadsheets would read as a formula.
+func csvText(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
+// CreateQuote adds a quote from a JSON body with text, author, source and
+// game. Moderators only.
+func CreateQuote(w http.ResponseWriter, r *http.Request) {
+	var q Quote
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	if sessionToken, err := getSessionTokenFromRequest(r); err == nil {
+		q.AddedBy, _ = getUsernameFromSession(sessionToken)
+	}
+	q, err := quotes.Add(q)
+	if errors.Is(err, ErrInvalidQuote) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to save quote", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(q)
+}
+
+// DeleteQuote removes a quote by ID. Moderators only.
+func DeleteQuote(w http.ResponseWriter, r *http.Request) {
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	err := quotes.Delete(id)
+	if errors.Is(err, ErrUnknownQuote) {
+		http.Error(w, "Quote not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to delete quote", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package routes
+
+import (
+	"encoding/csv"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuotes(t *testing.T) {
+	r := DefaultCommands()
+	book := NewQuoteBook(r)
+	book.Game = func(source string) string { return "Live on " + source }
+	parser := CommandParser{Commands: r, Cooldowns: NewCooldownManager(nil)}
+	run := func(author string, role Role, source string, text string) string {
+		msg := Message{Author: author, Role: role, Source: source, Tokens: []Token{{Type: TokenTypeCommand, Text: text}}}
+		got, err := parser.Parse(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.Message
+	}
+
+	if got := run("viewer", RoleViewer, "Twitch", "addquote hi"); got != "" {
+		t.Errorf("Expected viewers to be ignored, got %q", got)
+	}
+	if got := run("dayo", RoleVIP, "Twitch", `addquote --author @Streamer --game "Elden Ring" I am  not lost`); got != "@dayo Added quote #1" {
+		t.Errorf("Expected quote #1, got %q", got)
+	}
+	if got := run("mod", RoleModerator, "YouTube", "addquote gg"); got != "@mod Added quote #2" {
+		t.Errorf("Expected quote #2, got %q", got)
+	}
+
+	q, ok := book.Get(1)
+	if !ok || q.Text != "I am  not lost" || q.Author != "Streamer" || q.AddedBy != "dayo" || q.Source != "Twitch" || q.Game != "Elden Ring" {
+		t.Errorf("Unexpected quote %+v", q)
+	}
+	if q, _ := book.Get(2); q.Author != "mod" || q.Source != "YouTube" || q.Game != "Live on YouTube" {
+		t.Errorf("Expected the adder as author and the stream game, got %+v", q)
+	}
+
+	// Both platforms read the same book
+	if got := run("moderator", RoleModerator, "YouTube", "quote 1"); !strings.HasPrefix(got, `#1: "I am  not lost" - Streamer [Elden Ring]`) {
+		t.Errorf("Expected quote #1, got %q", got)
+	}
+	if got := run("moderator", RoleModerator, "Twitch", "quote gg"); !strings.HasPrefix(got, `#2: "gg" - mod`) {
+		t.Errorf("Expected quote #2, got %q", got)
+	}
+	if got := run("moderator", RoleModerator, "Twitch", "quote nothing"); got != "@moderator No quote found" {
+		t.Errorf("Expected no quote, got %q", got)
+	}
+
+	if found := book.Find(QuoteFilter{Query: "elden"}); len(found) != 1 || found[0].ID != 1 {
+		t.Errorf("Expected quote #1, got %+v", found)
+	}
+	if found := book.Find(QuoteFilter{Source: "youtube"}); len(found) != 1 || found[0].ID != 2 {
+		t.Errorf("Expected quote #2, got %+v", found)
+	}
+
+	if got := run("dayo", RoleVIP, "Twitch", "delquote 1"); got != "" {
+		t.Errorf("Expected VIPs to be ignored, got %q", got)
+	}
+	for _, arg := range []string{"1.9", "NaN", "1e300"} {
+		if got := run("mod", RoleModerator, "Twitch", "delquote "+arg); !strings.Contains(got, "is not a whole number") {
+			t.Errorf("delquote %s: expected usage error, got %q", arg, got)
+		}
+	}
+	if got := run("mod", RoleModerator, "Twitch", "delquote 1"); got != "@mod Deleted quote #1" {
+		t.Errorf("Expected deletion, got %q", got)
+	}
+	if err := book.Delete(1); !errors.Is(err, ErrUnknownQuote) {
+		t.Errorf("Expected unknown quote, got %v", err)
+	}
+	if q, _ := book.Add(Quote{Text: "new", AddedBy: "mod"}); q.ID != 3 {
+		t.Errorf("Expected IDs not to be reused, got %d", q.ID)
+	}
+	if _, err := book.Add(Quote{Text: "  "}); !errors.Is(err, ErrInvalidQuote) {
+		t.Errorf("Expected invalid quote, got %v", err)
+	}
+}
+
+func TestExportQuotesCSV(t *testing.T) {
+	saved := quotes
+	defer func() { quotes = saved }()
+	quotes = NewQuoteBook(NewCommandRegistry())
+	quotes.Add(Quote{Text: "=HYPERLINK(\"http://evil\")", Author: "@mod", AddedBy: "+dayo", Game: "-1"})
+
+	w := httptest.NewRecorder()
+	ExportQuotes(w, httptest.NewRequest("GET", "/api/quotes/export?format=csv", nil))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Expected a header and a quote, got %v %v", records, err)
+	}
+	got := records[1][1:4]
+	want := []string{"'=HYPERLINK(\"http://evil\")", "'@mod", "'+dayo"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %q, got %q", want[i], got[i])
+		}
+	}
+	if game := records[1][5]; game != "'-1" {
+		t.Errorf("Expected escaped game, got %q", game)
+	}
+}
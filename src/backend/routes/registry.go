@@ -0,0 +1,339 @@
+package routes
+
+import (
+	"container/list"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultMaxLearned = 1024
+
+// Registry layers (EmoteEntry.Layer)
+const (
+	EmoteLayerCustom  = "custom"
+	EmoteLayerChannel = "channel"
+	EmoteLayerGlobal  = "global"
+	EmoteLayerLearned = "learned"
+)
+
+// EmoteRegistry layers the emotes known to the tokenizer. Lookups check the
+// custom emotes of the channel (or of every channel), then the channel's
+// third party emotes, then the global emotes, then native emotes learned
+// from recent messages of the channel. Disabled names are never matched.
+// Safe for concurrent use.
+//
+// All layers but the learned one are immutable snapshots replaced with
+// copy-on-write, so readers never block. Learned emotes are bounded by
+// MaxLearned and evicted least recently used first. Their lookups share a
+// read lock and only record recency when the lock is free.
+type EmoteRegistry struct {
+	MaxLearned int
+
+	// Serializes snapshot writers
+	mu   sync.Mutex
+	snap atomic.Pointer[EmoteSnapshot]
+
+	learnMu sync.RWMutex
+	learned map[learnedKey]*list.Element
+	order   *list.List // Of learnedKey, front is most recently used
+}
+
+type learnedKey struct {
+	Channel string
+	Name    string
+}
+
+type learnedEmote struct {
+	learnedKey
+	Emote Emote
+}
+
+// EmoteSnapshot is an immutable view of the registry (except learned
+// emotes). Custom emotes under the channel "" apply to every channel.
+type EmoteSnapshot struct {
+	Global   map[string]Emote
+	Channels map[string]map[string]Emote
+	Custom   map[string]map[string]Emote
+	Disabled map[string]struct{}
+
+	registry *EmoteRegistry
+}
+
+func NewEmoteRegistry(global map[string]Emote) *EmoteRegistry {
+	r := &EmoteRegistry{
+		MaxLearned: defaultMaxLearned,
+		learned:    make(map[learnedKey]*list.Element),
+		order:      list.New(),
+	}
+	if global == nil {
+		global = map[string]Emote{}
+	}
+	r.snap.Store(&EmoteSnapshot{
+		Global:   global,
+		Channels: map[string]map[string]Emote{},
+		Custom:   map[string]map[string]Emote{},
+		Disabled: map[string]struct{}{},
+		registry: r,
+	})
+	return r
+}
+
+// Snapshot returns the current global and channel layers.
+func (r *EmoteRegistry) Snapshot() *EmoteSnapshot {
+	if r == nil {
+		return nil
+	}
+	return r.snap.Load()
+}
+
+// update replaces the snapshot with a modified copy. The maps of the copy
+// are shallow clones; f must replace layers rather than modify them.
+func (r *EmoteRegistry) update(f func(s *EmoteSnapshot)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.snap.Load()
+	s := &EmoteSnapshot{
+		Global:   old.Global,
+		Channels: maps.Clone(old.Channels),
+		Custom:   maps.Clone(old.Custom),
+		Disabled: old.Disabled,
+		registry: r,
+	}
+	f(s)
+	r.snap.Store(s)
+}
+
+// SetGlobal replaces the global emotes. The registry takes ownership of
+// emotes.
+func (r *EmoteRegistry) SetGlobal(emotes map[string]Emote) {
+	if emotes == nil {
+		emotes = map[string]Emote{}
+	}
+	r.update(func(s *EmoteSnapshot) {
+		s.Global = emotes
+	})
+}
+
+// SetChannel replaces the third party emotes of channel. The registry takes
+// ownership of emotes.
+func (r *EmoteRegistry) SetChannel(channel string, emotes map[string]Emote) {
+	r.update(func(s *EmoteSnapshot) {
+		if emotes == nil {
+			delete(s.Channels, channel)
+		} else {
+			s.Channels[channel] = emotes
+		}
+	})
+}
+
+// RebaseChannel replaces the third party emotes of channel with emotes,
+// a fresh load started when the channel had the emotes in base. Changes made
+// since then, e.g. by live updates, are applied on top. It returns the
+// emotes it replaced.
+func (r *EmoteRegistry) RebaseChannel(channel string, base map[string]Emote, emotes map[string]Emote) (old map[string]Emote) {
+	r.update(func(s *EmoteSnapshot) {
+		old = s.Channels[channel]
+		for name, emote := range old {
+			if b, ok := base[name]; !ok || b.ID != emote.ID {
+				emotes[name] = emote
+			}
+		}
+		for name := range base {
+			if _, ok := old[name]; !ok {
+				delete(emotes, name)
+			}
+		}
+		s.Channels[channel] = emotes
+	})
+	return old
+}
+
+// UpdateChannel atomically applies f to a copy of the third party emotes
+// of channel.
+func (r *EmoteRegistry) UpdateChannel(channel string, f func(emotes map[string]Emote)) {
+	r.update(func(s *EmoteSnapshot) {
+		emotes := maps.Clone(s.Channels[channel])
+		if emotes == nil {
+			emotes = map[string]Emote{}
+		}
+		f(emotes)
+		s.Channels[channel] = emotes
+	})
+}
+
+// SetCustom adds or replaces a custom emote of channel ("" for every
+// channel).
+func (r *EmoteRegistry) SetCustom(channel string, emote Emote) {
+	r.update(func(s *EmoteSnapshot) {
+		emotes := maps.Clone(s.Custom[channel])
+		if emotes == nil {
+			emotes = map[string]Emote{}
+		}
+		emotes[emote.Name] = emote
+		s.Custom[channel] = emotes
+	})
+}
+
+// RemoveCustom removes a custom emote of channel by name.
+func (r *EmoteRegistry) RemoveCustom(channel string, name string) {
+	r.update(func(s *EmoteSnapshot) {
+		emotes := maps.Clone(s.Custom[channel])
+		delete(emotes, name)
+		if len(emotes) == 0 {
+			delete(s.Custom, channel)
+		} else {
+			s.Custom[channel] = emotes
+		}
+	})
+}
+
+// SetDisabled stops (or resumes) matching the emote name in every layer.
+func (r *EmoteRegistry) SetDisabled(name string, disabled bool) {
+	r.update(func(s *EmoteSnapshot) {
+		s.Disabled = maps.Clone(s.Disabled)
+		if disabled {
+			s.Disabled[name] = struct{}{}
+		} else {
+			delete(s.Disabled, name)
+		}
+	})
+}
+
+// Learn remembers a native platform emote of channel by name so it can be
+// used in later messages of the channel which do not carry it.
+func (r *EmoteRegistry) Learn(channel string, emote Emote) {
+	if r == nil || emote.Name == "" {
+		return
+	}
+	emote.Locations = []string{}
+	key := learnedKey{channel, emote.Name}
+
+	r.learnMu.Lock()
+	defer r.learnMu.Unlock()
+
+	if el, ok := r.learned[key]; ok {
+		el.Value = learnedEmote{key, emote}
+		r.order.MoveToFront(el)
+		return
+	}
+	r.learned[key] = r.order.PushFront(learnedEmote{key, emote})
+	for r.order.Len() > r.MaxLearned {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.learned, oldest.Value.(learnedEmote).learnedKey)
+	}
+}
+
+// Learned reports the number of learned emotes.
+func (r *EmoteRegistry) Learned() int {
+	r.learnMu.RLock()
+	defer r.learnMu.RUnlock()
+	return r.order.Len()
+}
+
+func (r *EmoteRegistry) lookupLearned(channel string, name string) (Emote, bool) {
+	r.learnMu.RLock()
+	el, ok := r.learned[learnedKey{channel, name}]
+	var emote Emote
+	if ok {
+		emote = el.Value.(learnedEmote).Emote
+	}
+	r.learnMu.RUnlock()
+	if !ok {
+		return Emote{}, false
+	}
+
+	// Recency is best effort: skipped while other lookups or Learn hold
+	// the lock. Moving an evicted element is a no-op.
+	if r.learnMu.TryLock() {
+		r.order.MoveToFront(el)
+		r.learnMu.Unlock()
+	}
+	return emote, true
+}
+
+// Lookup finds an emote usable in channel by name.
+func (s *EmoteSnapshot) Lookup(channel string, name string) (Emote, bool) {
+	if s == nil {
+		return Emote{}, false
+	}
+	if _, ok := s.Disabled[name]; ok {
+		return Emote{}, false
+	}
+	if emote, ok := s.Custom[channel][name]; ok {
+		return emote, true
+	}
+	if emote, ok := s.Custom[""][name]; ok {
+		return emote, true
+	}
+	if emote, ok := s.Channels[channel][name]; ok {
+		return emote, true
+	}
+	if emote, ok := s.Global[name]; ok {
+		return emote, true
+	}
+	return s.registry.lookupLearned(channel, name)
+}
+
+// Lookup finds an emote usable in channel by name in the current snapshot.
+func (r *EmoteRegistry) Lookup(channel string, name string) (Emote, bool) {
+	return r.Snapshot().Lookup(channel, name)
+}
+
+// EmoteEntry describes an emote of one registry layer.
+type EmoteEntry struct {
+	Emote
+	Layer    string `json:"layer"`
+	Channel  string `json:"channel,omitempty"`
+	Disabled bool   `json:"disabled"`
+}
+
+// Entries lists the emotes of every layer sorted by name, then layer
+// precedence.
+func (r *EmoteRegistry) Entries() []EmoteEntry {
+	s := r.Snapshot()
+	entries := []EmoteEntry{}
+	add := func(layer string, channel string, emotes map[string]Emote) {
+		for name, emote := range emotes {
+			_, disabled := s.Disabled[name]
+			entries = append(entries, EmoteEntry{emote, layer, channel, disabled})
+		}
+	}
+	for channel, emotes := range s.Custom {
+		add(EmoteLayerCustom, channel, emotes)
+	}
+	for channel, emotes := range s.Channels {
+		add(EmoteLayerChannel, channel, emotes)
+	}
+	add(EmoteLayerGlobal, "", s.Global)
+
+	r.learnMu.RLock()
+	learned := make(map[string]map[string]Emote)
+	for el := r.order.Front(); el != nil; el = el.Next() {
+		l := el.Value.(learnedEmote)
+		if learned[l.Channel] == nil {
+			learned[l.Channel] = make(map[string]Emote)
+		}
+		learned[l.Channel][l.Name] = l.Emote
+	}
+	r.learnMu.RUnlock()
+	for channel, emotes := range learned {
+		add(EmoteLayerLearned, channel, emotes)
+	}
+
+	precedence := []string{EmoteLayerCustom, EmoteLayerChannel, EmoteLayerGlobal, EmoteLayerLearned}
+	slices.SortFunc(entries, func(a, b EmoteEntry) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		if c := slices.Index(precedence, a.Layer) - slices.Index(precedence, b.Layer); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Channel, b.Channel)
+	})
+	return entries
+}
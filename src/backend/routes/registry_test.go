@@ -0,0 +1,328 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestEmoteRegistryLayers(t *testing.T) {
+	r := NewEmoteRegistry(map[string]Emote{
+		"KEKW": {ID: "global", Name: "KEKW"},
+	})
+	r.SetChannel("dayoman", map[string]Emote{
+		"KEKW":  {ID: "channel", Name: "KEKW"},
+		"Clap2": {ID: "clap2", Name: "Clap2"},
+	})
+	r.Learn("dayoman", Emote{ID: "native", Name: "LUL", Locations: []string{"0-2"}})
+	r.Learn("dayoman", Emote{ID: "native", Name: "KEKW"})
+
+	tests := []struct {
+		Channel string
+		Name    string
+		ID      string
+	}{
+		{"dayoman", "KEKW", "channel"},
+		{"other", "KEKW", "global"},
+		{"other", "Clap2", ""},
+		{"dayoman", "LUL", "native"},
+		{"other", "LUL", ""},
+		{"", "Missing", ""},
+	}
+	for _, test := range tests {
+		emote, ok := r.Lookup(test.Channel, test.Name)
+		if ok != (test.ID != "") || emote.ID != test.ID {
+			t.Errorf("Lookup(%q, %q) = %v, %v; expected ID %q", test.Channel, test.Name, emote, ok, test.ID)
+		}
+	}
+	if emote, _ := r.Lookup("dayoman", "LUL"); len(emote.Locations) != 0 {
+		t.Errorf("Learned emote kept locations: %v", emote.Locations)
+	}
+
+	// Old snapshots are unaffected by updates
+	snap := r.Snapshot()
+	r.SetChannel("dayoman", nil)
+	r.SetGlobal(nil)
+	if _, ok := snap.Lookup("dayoman", "Clap2"); !ok {
+		t.Error("Snapshot changed after SetChannel")
+	}
+	if _, ok := r.Lookup("dayoman", "Clap2"); ok {
+		t.Error("Channel emotes remain after removal")
+	}
+}
+
+func TestEmoteRegistryEviction(t *testing.T) {
+	r := NewEmoteRegistry(nil)
+	r.MaxLearned = 3
+	for _, name := range []string{"a", "b", "c"} {
+		r.Learn("", Emote{Name: name})
+	}
+
+	// Using "a" makes "b" the least recently used
+	r.Lookup("", "a")
+	r.Learn("", Emote{Name: "d"})
+
+	if r.Learned() != 3 {
+		t.Errorf("Expected 3 learned emotes, got %d", r.Learned())
+	}
+	for _, name := range []string{"a", "c", "d"} {
+		if _, ok := r.Lookup("", name); !ok {
+			t.Errorf("Expected %q to be learned", name)
+		}
+	}
+	if _, ok := r.Lookup("", "b"); ok {
+		t.Error("Expected \"b\" to be evicted")
+	}
+}
+
+// Run with -race
+func TestEmoteRegistryConcurrent(t *testing.T) {
+	r := NewEmoteRegistry(nil)
+	r.MaxLearned = 64
+	tokenizer := Tokenizer{
+		Emotes:            r,
+		TextEffectSep:     ':',
+		TextCommandPrefix: '!',
+	}
+
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				name := fmt.Sprintf("e%d", (w*200+i)%100)
+				switch i % 4 {
+				case 0:
+					r.SetGlobal(map[string]Emote{name: {ID: name, Name: name}})
+				case 1:
+					r.SetChannel(fmt.Sprintf("c%d", w), map[string]Emote{name: {ID: name, Name: name}})
+				default:
+					r.Learn(fmt.Sprintf("c%d", w), Emote{ID: name, Name: name})
+				}
+			}
+		}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				for range tokenizer.Iter(fmt.Sprintf("hi e%d e%d", i%100, (i+1)%100)) {
+				}
+				r.Lookup(fmt.Sprintf("c%d", w), fmt.Sprintf("e%d", i%100))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if r.Learned() > r.MaxLearned {
+		t.Errorf("Learned %d emotes, limit is %d", r.Learned(), r.MaxLearned)
+	}
+}
+
+func TestEmoteSetsPerChannel(t *testing.T) {
+	const twitchURL = "https://www.twitch.tv/dayoman"
+	const youtubeURL = "http://youtube.com/channel/UC2c4NxvHnbXs3NLpCm641ew/live"
+
+	loads := map[string]int{}
+	load := func(platform string, platformID string) (map[string]Emote, error) {
+		loads[platform+"/"+platformID]++
+		emotes := map[string]Emote{"KEKW": {ID: "3", Name: "KEKW"}}
+		switch platformID {
+		case "39226538":
+			emotes["DayoHog"] = Emote{ID: "hog", Name: "DayoHog"}
+		case "UC2c4NxvHnbXs3NLpCm641ew":
+			emotes["ytOnly"] = Emote{ID: "yt", Name: "ytOnly"}
+		}
+		return emotes, nil
+	}
+
+	r := NewEmoteRegistry(nil)
+	s := NewEmoteSets(r, load)
+	s.PlatformIDs[twitchURL] = "39226538"
+	if err := s.RefreshGlobal(); err != nil {
+		t.Fatal(err)
+	}
+	for _, chatURL := range []string{twitchURL, youtubeURL} {
+		if !s.addChannel(chatURL) {
+			t.Fatalf("No platform ID for %s", chatURL)
+		}
+		if err := s.Refresh(chatURL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.addChannel("https://www.twitch.tv/unknown") {
+		t.Error("Added Twitch channel without a platform ID")
+	}
+
+	if len(s.Channels()) != 2 {
+		t.Errorf("Expected 2 channels, got %v", s.Channels())
+	}
+	if loads["youtube/UC2c4NxvHnbXs3NLpCm641ew"] != 1 || loads["twitch/39226538"] != 1 {
+		t.Errorf("Unexpected loads: %v", loads)
+	}
+	if snap := r.Snapshot(); len(snap.Channels[twitchURL]) != 1 {
+		t.Errorf("Global emotes kept in channel layer: %v", snap.Channels[twitchURL])
+	}
+
+	tokenizer := Tokenizer{Emotes: r, TextEffectSep: ':', TextCommandPrefix: '!'}
+	count := func(channel string, message string) int {
+		n := 0
+		for tok := range tokenizer.IterChannel(message, channel, nil) {
+			if tok.Type == TokenTypeEmote {
+				n++
+			}
+		}
+		return n
+	}
+	if n := count(twitchURL, "KEKW DayoHog ytOnly"); n != 2 {
+		t.Errorf("Expected 2 emotes in Twitch channel, got %d", n)
+	}
+	if n := count(youtubeURL, "KEKW DayoHog ytOnly"); n != 2 {
+		t.Errorf("Expected 2 emotes in YouTube channel, got %d", n)
+	}
+	if n := count("", "KEKW DayoHog ytOnly"); n != 1 {
+		t.Errorf("Expected only global emotes without a channel, got %d", n)
+	}
+	if err := s.Refresh("https://www.twitch.tv/unknown"); err != ErrUnknownEmoteChannel {
+		t.Errorf("Expected ErrUnknownEmoteChannel, got %v", err)
+	}
+}
+
+func TestEmoteRegistryAdmin(t *testing.T) {
+	r := NewEmoteRegistry(map[string]Emote{
+		"LUL": {ID: "global", Name: "LUL", Provider: EmoteProviderBTTV},
+		"the": {ID: "word", Name: "the", Provider: EmoteProviderFFZ},
+	})
+	r.SetCustom("dayoman", Emote{ID: "c1", Name: "LUL", Provider: EmoteProviderCustom})
+	r.SetCustom("", Emote{ID: "c2", Name: "hog", Provider: EmoteProviderCustom})
+	r.SetDisabled("the", true)
+
+	if e, _ := r.Lookup("dayoman", "LUL"); e.ID != "c1" {
+		t.Errorf("Expected custom emote to take precedence, got %v", e)
+	}
+	if e, _ := r.Lookup("other", "LUL"); e.ID != "global" {
+		t.Errorf("Expected global emote in other channels, got %v", e)
+	}
+	if _, ok := r.Lookup("other", "hog"); !ok {
+		t.Error("Expected custom emote for every channel")
+	}
+	if _, ok := r.Lookup("", "the"); ok {
+		t.Error("Disabled emote matched")
+	}
+
+	entries := r.Entries()
+	layers := []string{}
+	for _, e := range entries {
+		layers = append(layers, e.Name+"/"+e.Layer)
+	}
+	expected := []string{"LUL/custom", "LUL/global", "hog/custom", "the/global"}
+	if fmt.Sprint(layers) != fmt.Sprint(expected) {
+		t.Errorf("Expected entries %v, got %v", expected, layers)
+	}
+	if !entries[3].Disabled {
+		t.Error("Expected disabled entry")
+	}
+
+	r.SetDisabled("the", false)
+	r.RemoveCustom("dayoman", "LUL")
+	if e, _ := r.Lookup("dayoman", "LUL"); e.ID != "global" {
+		t.Errorf("Expected global emote after removing custom, got %v", e)
+	}
+	if _, ok := r.Lookup("", "the"); !ok {
+		t.Error("Re-enabled emote not matched")
+	}
+}
+
+func TestImagePreference(t *testing.T) {
+	files := []sevenTVFile{
+		{Name: "1x.webp", StaticName: "1x_static.webp", Width: 28, Format: "WEBP"},
+		{Name: "1x.avif", StaticName: "1x_static.avif", Width: 28, Format: "AVIF"},
+		{Name: "2x.webp", StaticName: "2x_static.webp", Width: 56, Format: "WEBP"},
+		{Name: "4x.gif", StaticName: "4x_static.gif", Width: 112, Format: "GIF"},
+	}
+	seventv := sevenTVImages("7", "//cdn.7tv.app/emote/7", true, files)
+	native := []Image{{ID: "n1", Width: 28}, {ID: "n2", Width: 56}, {ID: "n4", Width: 112}}
+	ffz := []Image{{ID: "f1", Scale: "1x"}, {ID: "f2", Scale: "2x"}, {ID: "f4", Scale: "4x"}}
+
+	tests := []struct {
+		Pref   ImagePreference
+		Images []Image
+		ID     string
+	}{
+		{DefaultImagePreference, seventv, "7+1x.webp"},
+		{ImagePreference{Scale: "1x", Format: "avif"}, seventv, "7+1x.avif"},
+		{ImagePreference{Scale: "1x", Format: "webp", Static: true}, seventv, "7+1x_static.webp"},
+		{ImagePreference{Scale: "4x", Format: "webp"}, seventv, "7+4x.gif"},
+		{ImagePreference{Scale: "3x", Format: "webp"}, bttvImages("b", false), "b+3x.webp"},
+		{ImagePreference{Scale: "4x", Format: "png"}, bttvImages("b", false), "b+3x.png"},
+		{ImagePreference{Scale: "3x"}, ffz, "f4"},
+		{ImagePreference{Scale: "2x"}, native, "n2"},
+	}
+	for _, test := range tests {
+		if best, _ := test.Pref.Best(test.Images); best.ID != test.ID {
+			t.Errorf("%+v: expected %s, got %s", test.Pref, test.ID, best.ID)
+		}
+	}
+
+	msg := Message{Tokens: []Token{{Type: TokenTypeEmote, Emote: Emote{Images: seventv}}}}
+	applied := ImagePreference{Scale: "2x", Format: "webp"}.Apply(msg)
+	if len(applied.Tokens[0].Emote.Images) != 1 || applied.Tokens[0].Emote.Images[0].ID != "7+2x.webp" {
+		t.Errorf("Unexpected images after Apply: %v", applied.Tokens[0].Emote.Images)
+	}
+	if len(msg.Tokens[0].Emote.Images) != len(seventv) {
+		t.Error("Apply modified the original message")
+	}
+}
+
+func TestEmoteSetsRefreshKeepsChanges(t *testing.T) {
+	const chatURL = "https://www.twitch.tv/dayoman"
+	r := NewEmoteRegistry(nil)
+	var load EmoteLoader
+	s := NewEmoteSets(r, func(platform string, platformID string) (map[string]Emote, error) {
+		return load(platform, platformID)
+	})
+	s.PlatformIDs[chatURL] = "39226538"
+	s.addChannel(chatURL)
+
+	load = func(string, string) (map[string]Emote, error) {
+		return map[string]Emote{"a": {ID: "a", Name: "a"}, "b": {ID: "b", Name: "b"}}, nil
+	}
+	if err := s.Refresh(chatURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Live updates arriving during a load are kept
+	load = func(string, string) (map[string]Emote, error) {
+		r.UpdateChannel(chatURL, func(emotes map[string]Emote) {
+			delete(emotes, "a")
+			emotes["c"] = Emote{ID: "c", Name: "c"}
+		})
+		return map[string]Emote{"a": {ID: "a", Name: "a"}, "b": {ID: "b", Name: "b"}, "d": {ID: "d", Name: "d"}}, nil
+	}
+	if err := s.Refresh(chatURL); err != nil {
+		t.Fatal(err)
+	}
+	names := slices.Sorted(maps.Keys(r.Snapshot().Channels[chatURL]))
+	if fmt.Sprint(names) != "[b c d]" {
+		t.Errorf("Expected [b c d], got %v", names)
+	}
+
+	// A failed load keeps the previous set and its count
+	loaded := s.Channels()[0].Loaded
+	load = func(string, string) (map[string]Emote, error) {
+		return nil, errors.New("offline")
+	}
+	if err := s.Refresh(chatURL); err == nil {
+		t.Fatal("Expected an error")
+	}
+	ch := s.Channels()[0]
+	if ch.Count != 3 || ch.Loaded != loaded || ch.Error != "offline" {
+		t.Errorf("Unexpected channel after failed refresh: %+v", ch)
+	}
+	if len(r.Snapshot().Channels[chatURL]) != 3 {
+		t.Error("Failed refresh replaced the emotes")
+	}
+}
@@ -0,0 +1,535 @@
+package routes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/endpoints"
+)
+
+// Responder modes
+const (
+	ResponderOff    = "off"
+	ResponderSource = "source" // Respond in the chat the command came from
+	ResponderAll    = "all"    // Respond in every chat
+
+	// Messages waiting for a platform rate limit before new ones are dropped
+	responderQueueSize = 32
+
+	TwitchIRCAddr = "irc.chat.twitch.tv:6667"
+	YouTubeAPIURL = "https://www.googleapis.com/youtube/v3"
+
+	// Limit of IRC logins and writes
+	twitchIOTimeout = 10 * time.Second
+
+	maxTwitchMessageLen  = 500
+	maxYouTubeMessageLen = 200
+)
+
+// RateLimit allows Messages per sliding window of Per.
+type RateLimit struct {
+	Messages int
+	Per      time.Duration
+}
+
+var (
+	// Twitch allows 20 messages per 30 seconds to accounts which are not
+	// moderators of the channel
+	TwitchRateLimit = RateLimit{Messages: 20, Per: 30 * time.Second}
+
+	// YouTube has no published chat limit, so stay well under spam filters
+	YouTubeRateLimit = RateLimit{Messages: 10, Per: 30 * time.Second}
+)
+
+// rateLimiter delays sends to stay within a RateLimit.
+type rateLimiter struct {
+	limit RateLimit
+	sent  []time.Time
+}
+
+// wait blocks until a message may be sent, and records it.
+func (rl *rateLimiter) wait() {
+	if rl.limit.Messages <= 0 {
+		return
+	}
+	if len(rl.sent) == rl.limit.Messages {
+		time.Sleep(time.Until(rl.sent[0].Add(rl.limit.Per)))
+		rl.sent = rl.sent[1:]
+	}
+	rl.sent = append(rl.sent, time.Now())
+}
+
+// Sender posts bot messages to the chat of a platform.
+type Sender interface {
+	Platform() string // PlatformTwitch or PlatformYouTube
+
+	// Send posts text to the chat of channel (a chat URL)
+	Send(channel string, text string) error
+}
+
+type outboundMessage struct {
+	Channel string
+	Text    string
+}
+
+type platformSender struct {
+	sender  Sender
+	limiter rateLimiter
+	queue   chan outboundMessage
+}
+
+func (ps *platformSender) run() {
+	for msg := range ps.queue {
+		ps.limiter.wait()
+		if err := ps.sender.Send(msg.Channel, msg.Text); err != nil {
+			log.Printf("responder: Failed to send to %s: %v", msg.Channel, err)
+		}
+	}
+}
+
+var responder *Responder
+
+// Responder delivers bot responses to the platform chats, queueing them to
+// respect the rate limit of each platform.
+type Responder struct {
+	Mode string
+
+	mu       sync.Mutex
+	senders  map[string]*platformSender // By platform
+	channels []string
+	bots     map[string]struct{} // Lowercase names of the bot accounts
+}
+
+func NewResponder(mode string) *Responder {
+	return &Responder{
+		Mode:    mode,
+		senders: make(map[string]*platformSender),
+		bots:    make(map[string]struct{}),
+	}
+}
+
+// ResponderFromEnv configures a responder from the environment. Platforms
+// without bot credentials are not answered.
+//
+//	RESPONDER_MODE        source (default), all or off
+//	TWITCH_BOT_USERNAME   Twitch bot account
+//	TWITCH_BOT_TOKEN      OAuth token of the Twitch bot (chat:edit scope)
+//	YOUTUBE_BOT_CLIENT_ID      OAuth client of the YouTube bot
+//	YOUTUBE_BOT_CLIENT_SECRET
+//	YOUTUBE_BOT_REFRESH_TOKEN  Refresh token of the bot (youtube.force-ssl
+//	                           scope), exchanged for access tokens as needed
+//	YOUTUBE_BOT_NAME           YouTube bot channel name, required with the
+//	                           token so that the bot's own messages are not
+//	                           answered
+func ResponderFromEnv() *Responder {
+	mode := strings.ToLower(os.Getenv("RESPONDER_MODE"))
+	switch mode {
+	case ResponderOff, ResponderAll:
+	default:
+		mode = ResponderSource
+	}
+	r := NewResponder(mode)
+
+	if username, token := os.Getenv("TWITCH_BOT_USERNAME"), os.Getenv("TWITCH_BOT_TOKEN"); username != "" && token != "" {
+		r.AddSender(&TwitchSender{Addr: TwitchIRCAddr, Username: username, Token: token}, TwitchRateLimit)
+		r.AddBot(username)
+	}
+	if name, token := os.Getenv("YOUTUBE_BOT_NAME"), os.Getenv("YOUTUBE_BOT_REFRESH_TOKEN"); token != "" {
+		config := oauth2.Config{
+			ClientID:     os.Getenv("YOUTUBE_BOT_CLIENT_ID"),
+			ClientSecret: os.Getenv("YOUTUBE_BOT_CLIENT_SECRET"),
+			Endpoint:     endpoints.Google,
+		}
+		if name == "" || config.ClientID == "" || config.ClientSecret == "" {
+			log.Printf("config: YOUTUBE_BOT_NAME, YOUTUBE_BOT_CLIENT_ID and YOUTUBE_BOT_CLIENT_SECRET are required to respond on YouTube")
+		} else {
+			tokens := config.TokenSource(context.Background(), &oauth2.Token{RefreshToken: token})
+			r.AddSender(&YouTubeSender{APIURL: YouTubeAPIURL, Tokens: tokens}, YouTubeRateLimit)
+			r.AddBot(name)
+		}
+	}
+	return r
+}
+
+// AddSender delivers responses for the platform of s within limit.
+func (r *Responder) AddSender(s Sender, limit RateLimit) {
+	ps := &platformSender{
+		sender:  s,
+		limiter: rateLimiter{limit: limit},
+		queue:   make(chan outboundMessage, responderQueueSize),
+	}
+	r.mu.Lock()
+	r.senders[s.Platform()] = ps
+	r.mu.Unlock()
+	go ps.run()
+}
+
+// AddChannel adds a chat URL answered in ResponderAll mode.
+func (r *Responder) AddChannel(channel string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channels = append(r.channels, channel)
+}
+
+// AddBot marks name as a bot account, so that its own messages coming back
+// through the chat fetch can be skipped.
+func (r *Responder) AddBot(name string) {
+	if name == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bots[strings.ToLower(name)] = struct{}{}
+}
+
+// IsBot reports whether author is one of the bot accounts.
+func (r *Responder) IsBot(author string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.bots[strings.ToLower(author)]
+	return ok
+}
+
+// Respond queues text for the chat of channel, or every chat in
+// ResponderAll mode. Responses are dropped if a platform queue is full.
+func (r *Responder) Respond(channel string, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var targets []string
+	switch r.Mode {
+	case ResponderSource:
+		targets = []string{channel}
+	case ResponderAll:
+		targets = r.channels
+	}
+
+	for _, target := range targets {
+		r.queue(target, text)
+	}
+}
+
+// queue hands text to the sender of the platform of channel. Must be called
+// with the lock held.
+func (r *Responder) queue(channel string, text string) {
+	platform, _ := ChannelPlatform(channel)
+	ps, ok := r.senders[platform]
+	if !ok {
+		return
+	}
+	select {
+	case ps.queue <- outboundMessage{channel, text}:
+	default:
+		log.Printf("responder: Queue full, dropping message to %s", channel)
+	}
+}
+
+// Announce queues text for every chat of the given platforms, whatever the
+// mode.
+func (r *Responder) Announce(platforms []string, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, channel := range r.channels {
+		platform, _ := ChannelPlatform(channel)
+		if slices.Contains(platforms, platform) {
+			r.queue(channel, text)
+		}
+	}
+}
+
+// truncateMessage shortens text to at most n bytes on a rune boundary and
+// joins lines, since chats take single line messages.
+func truncateMessage(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
+
+// TwitchSender posts to Twitch chat over IRC with a bot account.
+type TwitchSender struct {
+	Addr     string
+	Username string
+	Token    string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	joined map[string]struct{}
+}
+
+func (s *TwitchSender) Platform() string {
+	return PlatformTwitch
+}
+
+// twitchChannel returns the IRC channel of a Twitch chat URL.
+func twitchChannel(chatURL string) (string, error) {
+	u, err := url.Parse(chatURL)
+	if err != nil {
+		return "", err
+	}
+	name, _, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if name == "" {
+		return "", fmt.Errorf("no Twitch channel in %s", chatURL)
+	}
+	return "#" + strings.ToLower(name), nil
+}
+
+// login sends the credentials and waits for the welcome message, failing
+// if Twitch refuses them.
+func (s *TwitchSender) login(conn net.Conn, scanner *bufio.Scanner) error {
+	token := s.Token
+	if !strings.HasPrefix(token, "oauth:") {
+		token = "oauth:" + token
+	}
+	conn.SetDeadline(time.Now().Add(twitchIOTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := fmt.Fprintf(conn, "PASS %s\r\nNICK %s\r\n", token, strings.ToLower(s.Username)); err != nil {
+		return err
+	}
+	for scanner.Scan() {
+		_, command, _ := strings.Cut(scanner.Text(), " ")
+		switch {
+		case strings.HasPrefix(command, "001 "):
+			return nil
+		case strings.HasPrefix(command, "NOTICE "):
+			_, notice, _ := strings.Cut(command, " :")
+			return fmt.Errorf("twitch: login failed: %s", notice)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("twitch: connection closed during login")
+}
+
+// connect logs in to IRC. Must be called with the lock held.
+func (s *TwitchSender) connect() error {
+	conn, err := net.DialTimeout("tcp", s.Addr, twitchIOTimeout)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(conn)
+	if err := s.login(conn, scanner); err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn = conn
+	s.joined = make(map[string]struct{})
+
+	// Answer keepalive pings until the connection closes, so that the next
+	// message reconnects
+	go func() {
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "PING ") {
+				s.mu.Lock()
+				fmt.Fprintf(conn, "PONG %s\r\n", strings.TrimPrefix(line, "PING "))
+				s.mu.Unlock()
+			} else if _, command, _ := strings.Cut(line, " "); strings.HasPrefix(command, "NOTICE ") {
+				log.Printf("twitch: %s", command)
+			}
+		}
+		s.mu.Lock()
+		if s.conn == conn {
+			s.conn = nil
+		}
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	return nil
+}
+
+func (s *TwitchSender) Send(channel string, text string) error {
+	ircChannel, err := twitchChannel(channel)
+	if err != nil {
+		return err
+	}
+	text = truncateMessage(text, maxTwitchMessageLen)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			if err := s.connect(); err != nil {
+				return err
+			}
+		}
+		var buf bytes.Buffer
+		if _, ok := s.joined[ircChannel]; !ok {
+			fmt.Fprintf(&buf, "JOIN %s\r\n", ircChannel)
+		}
+		fmt.Fprintf(&buf, "PRIVMSG %s :%s\r\n", ircChannel, text)
+		s.conn.SetWriteDeadline(time.Now().Add(twitchIOTimeout))
+		_, err := s.conn.Write(buf.Bytes())
+		if err == nil {
+			s.joined[ircChannel] = struct{}{}
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+// YouTubeSender posts to the live chat of a YouTube stream with the Data API.
+type YouTubeSender struct {
+	APIURL string
+	Tokens oauth2.TokenSource // Access tokens (youtube.force-ssl scope)
+
+	mu        sync.Mutex
+	liveChats map[string]string // Live chat ID by chat URL
+}
+
+func (s *YouTubeSender) Platform() string {
+	return PlatformYouTube
+}
+
+// authorize adds a current access token to req.
+func (s *YouTubeSender) authorize(req *http.Request) error {
+	token, err := s.Tokens.Token()
+	if err != nil {
+		return fmt.Errorf("youtube: access token: %w", err)
+	}
+	token.SetAuthHeader(req)
+	return nil
+}
+
+func (s *YouTubeSender) get(path string, query url.Values, v any) error {
+	req, err := http.NewRequest(http.MethodGet, s.APIURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(req); err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("youtube: %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// liveChatID finds the live chat of a watch URL, or of the current stream
+// of a /channel/<id> URL.
+func (s *YouTubeSender) liveChatID(chatURL string) (string, error) {
+	s.mu.Lock()
+	id, ok := s.liveChats[chatURL]
+	s.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	u, err := url.Parse(chatURL)
+	if err != nil {
+		return "", err
+	}
+	videoID := u.Query().Get("v")
+	if _, channelID := ChannelPlatform(chatURL); videoID == "" && channelID != "" {
+		var search struct {
+			Items []struct {
+				ID struct {
+					VideoID string `json:"videoId"`
+				} `json:"id"`
+			} `json:"items"`
+		}
+		query := url.Values{"part": {"id"}, "channelId": {channelID}, "eventType": {"live"}, "type": {"video"}}
+		if err := s.get("/search", query, &search); err != nil {
+			return "", err
+		}
+		if len(search.Items) > 0 {
+			videoID = search.Items[0].ID.VideoID
+		}
+	}
+	if videoID == "" {
+		return "", fmt.Errorf("youtube: no live stream for %s", chatURL)
+	}
+
+	var videos struct {
+		Items []struct {
+			LiveStreamingDetails struct {
+				ActiveLiveChatID string `json:"activeLiveChatId"`
+			} `json:"liveStreamingDetails"`
+		} `json:"items"`
+	}
+	if err := s.get("/videos", url.Values{"part": {"liveStreamingDetails"}, "id": {videoID}}, &videos); err != nil {
+		return "", err
+	}
+	if len(videos.Items) == 0 || videos.Items[0].LiveStreamingDetails.ActiveLiveChatID == "" {
+		return "", fmt.Errorf("youtube: %s has no active live chat", videoID)
+	}
+	id = videos.Items[0].LiveStreamingDetails.ActiveLiveChatID
+
+	s.mu.Lock()
+	if s.liveChats == nil {
+		s.liveChats = make(map[string]string)
+	}
+	s.liveChats[chatURL] = id
+	s.mu.Unlock()
+	return id, nil
+}
+
+func (s *YouTubeSender) Send(channel string, text string) error {
+	chatID, err := s.liveChatID(channel)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"snippet": map[string]any{
+			"liveChatId": chatID,
+			"type":       "textMessageEvent",
+			"textMessageDetails": map[string]string{
+				"messageText": truncateMessage(text, maxYouTubeMessageLen),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.APIURL+"/liveChat/messages?part=snippet", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if err := s.authorize(req); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// The stream may have ended, so find the live chat again next time
+		s.mu.Lock()
+		delete(s.liveChats, channel)
+		s.mu.Unlock()
+		return errors.New("youtube: send message: " + resp.Status)
+	}
+	return nil
+}
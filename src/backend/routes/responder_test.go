@@ -0,0 +1,234 @@
+package routes
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSender records the messages sent to a platform
+type fakeSender struct {
+	platform string
+	sent     chan outboundMessage
+}
+
+func newFakeSender(platform string) *fakeSender {
+	return &fakeSender{platform: platform, sent: make(chan outboundMessage, 16)}
+}
+
+func (s *fakeSender) Platform() string {
+	return s.platform
+}
+
+func (s *fakeSender) Send(channel string, text string) error {
+	s.sent <- outboundMessage{channel, text}
+	return nil
+}
+
+func (s *fakeSender) next(t *testing.T) outboundMessage {
+	t.Helper()
+	select {
+	case msg := <-s.sent:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a message")
+		return outboundMessage{}
+	}
+}
+
+func (s *fakeSender) none(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-s.sent:
+		t.Errorf("Unexpected message: %+v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestResponder(t *testing.T) {
+	const twitchChat = "https://www.twitch.tv/dayoman"
+	const youtubeChat = "https://www.youtube.com/channel/UC2c4NxvHnbXs3NLpCm641ew/live"
+
+	twitch := newFakeSender(PlatformTwitch)
+	youtube := newFakeSender(PlatformYouTube)
+	r := NewResponder(ResponderSource)
+	r.AddSender(twitch, RateLimit{})
+	r.AddSender(youtube, RateLimit{})
+	r.AddChannel(twitchChat)
+	r.AddChannel(youtubeChat)
+
+	r.Respond(youtubeChat, "@viewer hi")
+	if got := youtube.next(t); got != (outboundMessage{youtubeChat, "@viewer hi"}) {
+		t.Errorf("Unexpected YouTube message: %+v", got)
+	}
+	twitch.none(t)
+
+	r.Mode = ResponderAll
+	r.Respond(youtubeChat, "everyone")
+	if got := twitch.next(t); got != (outboundMessage{twitchChat, "everyone"}) {
+		t.Errorf("Unexpected Twitch message: %+v", got)
+	}
+	youtube.next(t)
+
+	r.Mode = ResponderOff
+	r.Respond(twitchChat, "nobody")
+	twitch.none(t)
+}
+
+func TestResponderAnnounce(t *testing.T) {
+	twitch := newFakeSender(PlatformTwitch)
+	youtube := newFakeSender(PlatformYouTube)
+	r := NewResponder(ResponderOff)
+	r.AddSender(twitch, RateLimit{})
+	r.AddSender(youtube, RateLimit{})
+	r.AddChannel("https://www.twitch.tv/dayoman")
+	r.AddChannel("https://www.youtube.com/channel/UC2c4NxvHnbXs3NLpCm641ew/live")
+
+	r.Announce([]string{PlatformYouTube}, "schedule")
+	if got := youtube.next(t); got.Text != "schedule" {
+		t.Errorf("Unexpected announcement: %+v", got)
+	}
+	twitch.none(t)
+}
+
+func TestResponderFromEnv(t *testing.T) {
+	t.Setenv("TWITCH_BOT_USERNAME", "")
+	t.Setenv("YOUTUBE_BOT_CLIENT_ID", "client")
+	t.Setenv("YOUTUBE_BOT_CLIENT_SECRET", "secret")
+	t.Setenv("YOUTUBE_BOT_REFRESH_TOKEN", "token")
+	t.Setenv("YOUTUBE_BOT_NAME", "")
+
+	// Without its name the bot would answer its own messages
+	if r := ResponderFromEnv(); len(r.senders) != 0 {
+		t.Errorf("Expected no YouTube sender without a bot name, got %v", r.senders)
+	}
+
+	t.Setenv("YOUTUBE_BOT_NAME", "EloraBot")
+	r := ResponderFromEnv()
+	if _, ok := r.senders[PlatformYouTube]; !ok {
+		t.Error("Expected a YouTube sender")
+	}
+	if !r.IsBot("elorabot") {
+		t.Error("Expected the bot's own messages to be skipped")
+	}
+}
+
+func TestResponderRateLimit(t *testing.T) {
+	const chat = "https://www.twitch.tv/dayoman"
+	sender := newFakeSender(PlatformTwitch)
+	r := NewResponder(ResponderSource)
+	r.AddSender(sender, RateLimit{Messages: 2, Per: 200 * time.Millisecond})
+
+	start := time.Now()
+	for range 3 {
+		r.Respond(chat, "hi")
+	}
+	sender.next(t)
+	sender.next(t)
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("First messages were delayed by %v", elapsed)
+	}
+	sender.next(t)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Third message sent after %v, within the rate limit", elapsed)
+	}
+}
+
+// fakeTwitchIRC accepts IRC connections, answering NICK with reply. Lines
+// received are sent to lines; closing a value of conns closes its connection.
+func fakeTwitchIRC(t *testing.T, reply string) (addr string, lines chan string, conns chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	lines = make(chan string, 16)
+	conns = make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+					if strings.HasPrefix(scanner.Text(), "NICK ") {
+						fmt.Fprintf(conn, "%s\r\n", reply)
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), lines, conns
+}
+
+func expectLines(t *testing.T, lines chan string, expected ...string) {
+	t.Helper()
+	for _, want := range expected {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestTwitchSender(t *testing.T) {
+	addr, lines, conns := fakeTwitchIRC(t, ":tmi.twitch.tv 001 elorabot :Welcome, GLHF!")
+
+	s := &TwitchSender{Addr: addr, Username: "EloraBot", Token: "secret"}
+	for _, text := range []string{"first\nline", "second"} {
+		if err := s.Send("https://www.twitch.tv/Dayoman", text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectLines(t, lines, "PASS oauth:secret", "NICK elorabot", "JOIN #dayoman", "PRIVMSG #dayoman :first line", "PRIVMSG #dayoman :second")
+
+	// A dropped connection logs in again
+	(<-conns).Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		closed := s.conn == nil
+		s.mu.Unlock()
+		if closed {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the connection to close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Send("https://www.twitch.tv/Dayoman", "third"); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, lines, "PASS oauth:secret", "NICK elorabot", "JOIN #dayoman", "PRIVMSG #dayoman :third")
+}
+
+func TestTwitchSenderLoginFailed(t *testing.T) {
+	addr, _, _ := fakeTwitchIRC(t, ":tmi.twitch.tv NOTICE * :Login authentication failed")
+
+	s := &TwitchSender{Addr: addr, Username: "EloraBot", Token: "expired"}
+	err := s.Send("https://www.twitch.tv/Dayoman", "hi")
+	if err == nil || !strings.Contains(err.Error(), "Login authentication failed") {
+		t.Errorf("Expected a login error, got %v", err)
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	if got := truncateMessage("héllo", 2); got != "h" {
+		t.Errorf("Expected rune boundary, got %q", got)
+	}
+	if got := truncateMessage(strings.Repeat("a", 600), maxTwitchMessageLen); len(got) != maxTwitchMessageLen {
+		t.Errorf("Expected %d bytes, got %d", maxTwitchMessageLen, len(got))
+	}
+}
@@ -0,0 +1,118 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Role is the standing of a chat user, ordered from least to most trusted.
+type Role int
+
+const (
+	RoleViewer Role = iota
+	RoleSubscriber
+	RoleVIP
+	RoleModerator
+	RoleBroadcaster
+)
+
+var roleNames = []string{"viewer", "subscriber", "vip", "moderator", "broadcaster"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return "unknown"
+	}
+	return roleNames[r]
+}
+
+// Roles granted by Twitch badge names
+var twitchBadgeRoles = map[string]Role{
+	"broadcaster": RoleBroadcaster,
+	"moderator":   RoleModerator,
+	"vip":         RoleVIP,
+	"subscriber":  RoleSubscriber,
+	"founder":     RoleSubscriber,
+}
+
+// RoleFromBadges returns the highest role granted by the badges of a
+// message from source. Twitch badges are matched by name, YouTube badges by
+// their owner, moderator and member titles.
+func RoleFromBadges(source string, badges []Badge) Role {
+	role := RoleViewer
+	for _, badge := range badges {
+		var r Role
+		switch {
+		case strings.EqualFold(source, PlatformTwitch):
+			r = twitchBadgeRoles[strings.ToLower(badge.Name)]
+		case strings.EqualFold(source, PlatformYouTube):
+			title := strings.ToLower(badge.Title)
+			switch {
+			case strings.Contains(title, "owner"):
+				r = RoleBroadcaster
+			case strings.Contains(title, "moderator"):
+				r = RoleModerator
+			case strings.Contains(title, "member"):
+				r = RoleSubscriber
+			}
+		}
+		role = max(role, r)
+	}
+	return role
+}
+
+// messageRole returns the role of the author of m. WS_MOD_USERS lists
+// Twitch logins, so only their Twitch messages are raised to moderator.
+func messageRole(m Message) Role {
+	role := RoleFromBadges(m.Source, m.Badges)
+	if strings.EqualFold(m.Source, PlatformTwitch) && isModerator(m.Author) {
+		role = max(role, RoleModerator)
+	}
+	return role
+}
+
+// EffectRolesFromEnv reads the minimum roles of text effects from
+// EFFECT_ROLES, a comma separated list of name=role. Names are colours,
+// effects, "pattern", or "*" for every effect.
+//
+//	EFFECT_ROLES=rainbow=subscriber,pattern=vip
+func EffectRolesFromEnv() map[string]Role {
+	roles := make(map[string]Role)
+	for _, entry := range strings.Split(os.Getenv("EFFECT_ROLES"), ",") {
+		name, roleName, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		role, err := ParseRole(strings.ToLower(roleName))
+		if err != nil {
+			log.Printf("config: EFFECT_ROLES: %v", err)
+			continue
+		}
+		roles[name] = role
+	}
+	return roles
+}
+
+// ParseRole parses the name of a role.
+func ParseRole(name string) (Role, error) {
+	for i, n := range roleNames {
+		if n == name {
+			return Role(i), nil
+		}
+	}
+	return RoleViewer, fmt.Errorf("unknown role: %q", name)
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
@@ -0,0 +1,287 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 7TV EventAPI (https://github.com/SevenTV/EventAPI)
+const (
+	SevenTVEventURL = "wss://events.7tv.io/v3"
+	SevenTVAPIURL   = "https://7tv.io/v3"
+
+	sevenTVOpDispatch     = 0
+	sevenTVOpHello        = 1
+	sevenTVOpHeartbeat    = 2
+	sevenTVOpReconnect    = 4
+	sevenTVOpEndOfStream  = 7
+	sevenTVOpSubscribe    = 35
+	sevenTVEmoteSetUpdate = "emote_set.update"
+
+	// Active emote flag and emote data flag marking zero-width emotes
+	sevenTVActiveZeroWidth = 1 << 0
+	sevenTVDataZeroWidth   = 1 << 8
+
+	sevenTVMaxBackoff = 2 * time.Minute
+)
+
+type sevenTVMessage struct {
+	Op   int             `json:"op"`
+	Data json.RawMessage `json:"d"`
+}
+
+type sevenTVDispatch struct {
+	Type string `json:"type"`
+	Body struct {
+		ID      string               `json:"id"`
+		Pushed  []sevenTVChangeField `json:"pushed"`
+		Pulled  []sevenTVChangeField `json:"pulled"`
+		Updated []sevenTVChangeField `json:"updated"`
+	} `json:"body"`
+}
+
+type sevenTVChangeField struct {
+	Key      string              `json:"key"`
+	Value    *sevenTVActiveEmote `json:"value"`
+	OldValue *sevenTVActiveEmote `json:"old_value"`
+}
+
+type sevenTVActiveEmote struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Flags int    `json:"flags"`
+	Data  struct {
+		ID       string `json:"id"`
+		Flags    int    `json:"flags"`
+		Animated bool   `json:"animated"`
+		Host     struct {
+			URL   string        `json:"url"`
+			Files []sevenTVFile `json:"files"`
+		} `json:"host"`
+	} `json:"data"`
+}
+
+// Emote converts an active 7TV emote (named as in the set) to an Emote.
+func (a sevenTVActiveEmote) Emote() Emote {
+	e := Emote{
+		ID:        a.ID,
+		Name:      a.Name,
+		Locations: []string{},
+		Images:    sevenTVImages(a.ID, a.Data.Host.URL, a.Data.Animated, a.Data.Host.Files),
+		Provider:  EmoteProviderSevenTV,
+		ZeroWidth: a.Flags&sevenTVActiveZeroWidth != 0 || a.Data.Flags&sevenTVDataZeroWidth != 0,
+	}
+	emoteImagePreference.Sort(e.Images)
+	return e
+}
+
+// SevenTVEvents subscribes to the 7TV emote sets of the channels in Sets and
+// applies emote changes to the registry as they happen.
+type SevenTVEvents struct {
+	URL    string // EventAPI websocket URL
+	APIURL string // REST API used to find the emote set of a channel
+	Sets   *EmoteSets
+	Dialer *websocket.Dialer
+
+	// Called after an event changes the emotes of a channel
+	OnChange func(EmoteSetChange)
+
+	mu       sync.Mutex
+	conn     *websocket.Conn
+	channels map[string]string // Channel by emote set ID
+}
+
+func NewSevenTVEvents(sets *EmoteSets) *SevenTVEvents {
+	return &SevenTVEvents{
+		URL:      SevenTVEventURL,
+		APIURL:   SevenTVAPIURL,
+		Sets:     sets,
+		Dialer:   websocket.DefaultDialer,
+		channels: make(map[string]string),
+	}
+}
+
+// EmoteSetID finds the active 7TV emote set of a platform user.
+func (s *SevenTVEvents) EmoteSetID(platform string, platformID string) (string, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/users/%s/%s", s.APIURL, platform, platformID))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("7tv: user %s/%s: %s", platform, platformID, resp.Status)
+	}
+
+	var user struct {
+		EmoteSet struct {
+			ID string `json:"id"`
+		} `json:"emote_set"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", err
+	}
+	if user.EmoteSet.ID == "" {
+		return "", errors.New("7tv: user has no active emote set")
+	}
+	return user.EmoteSet.ID, nil
+}
+
+// Subscribe follows the emote set of a channel. Subscriptions are renewed
+// whenever the connection is reestablished.
+func (s *SevenTVEvents) Subscribe(ch EmoteChannel) error {
+	setID, err := s.EmoteSetID(ch.Platform, ch.PlatformID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[setID] = ch.URL
+	if s.conn != nil {
+		return s.subscribe(setID)
+	}
+	return nil
+}
+
+// Follow subscribes to the emote set of ch in the background, for use as
+// EmoteSets.OnAdd.
+func (s *SevenTVEvents) Follow(ch EmoteChannel) {
+	go func() {
+		if err := s.Subscribe(ch); err != nil {
+			log.Printf("7tv: Failed to subscribe to %s: %v", ch.URL, err)
+		}
+	}()
+}
+
+// subscribe sends the subscription for setID. Must be called with the lock
+// held.
+func (s *SevenTVEvents) subscribe(setID string) error {
+	return s.conn.WriteJSON(map[string]any{
+		"op": sevenTVOpSubscribe,
+		"d": map[string]any{
+			"type":      sevenTVEmoteSetUpdate,
+			"condition": map[string]string{"object_id": setID},
+		},
+	})
+}
+
+// Run keeps the event stream connected, reconnecting with backoff. Channels
+// are subscribed to as they are added to Sets (see Follow).
+func (s *SevenTVEvents) Run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := s.Listen()
+		log.Printf("7tv: Event stream closed: %v", err)
+		if time.Since(start) > sevenTVMaxBackoff {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, sevenTVMaxBackoff)
+	}
+}
+
+// Listen connects to the event stream and applies events until the
+// connection ends.
+func (s *SevenTVEvents) Listen() error {
+	conn, _, err := s.Dialer.Dial(s.URL, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var msg sevenTVMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+
+		switch msg.Op {
+		case sevenTVOpHello:
+			s.mu.Lock()
+			s.conn = conn
+			for setID := range s.channels {
+				if err := s.subscribe(setID); err != nil {
+					s.mu.Unlock()
+					return err
+				}
+			}
+			s.mu.Unlock()
+		case sevenTVOpDispatch:
+			var d sevenTVDispatch
+			if err := json.Unmarshal(msg.Data, &d); err != nil {
+				log.Printf("7tv: Failed to decode dispatch: %v", err)
+				continue
+			}
+			s.apply(d)
+		case sevenTVOpReconnect:
+			return errors.New("7tv: reconnect requested")
+		case sevenTVOpEndOfStream:
+			return errors.New("7tv: end of stream")
+		case sevenTVOpHeartbeat:
+		}
+	}
+}
+
+// apply swaps in the emote set changes of an emote_set.update dispatch.
+func (s *SevenTVEvents) apply(d sevenTVDispatch) {
+	if d.Type != sevenTVEmoteSetUpdate {
+		return
+	}
+	s.mu.Lock()
+	channel, ok := s.channels[d.Body.ID]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	change := EmoteSetChange{
+		Channel: channel,
+		Added:   []Emote{},
+		Removed: []string{},
+		Source:  EmoteProviderSevenTV,
+	}
+	for _, f := range d.Body.Pulled {
+		if f.Key == "emotes" && f.OldValue != nil {
+			change.Removed = append(change.Removed, f.OldValue.Name)
+		}
+	}
+	for _, f := range d.Body.Updated {
+		if f.Key == "emotes" && f.OldValue != nil && f.Value != nil {
+			change.Removed = append(change.Removed, f.OldValue.Name)
+			change.Added = append(change.Added, f.Value.Emote())
+		}
+	}
+	for _, f := range d.Body.Pushed {
+		if f.Key == "emotes" && f.Value != nil {
+			change.Added = append(change.Added, f.Value.Emote())
+		}
+	}
+	if change.Empty() {
+		return
+	}
+
+	s.Sets.Registry.UpdateChannel(channel, func(emotes map[string]Emote) {
+		for _, name := range change.Removed {
+			delete(emotes, name)
+		}
+		for _, emote := range change.Added {
+			emotes[emote.Name] = emote
+		}
+	})
+	if s.OnChange != nil {
+		s.OnChange(change)
+	}
+}
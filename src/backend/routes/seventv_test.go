@@ -0,0 +1,149 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Stand-in for the 7TV REST and EventAPI endpoints
+func newSevenTVStandIn(t *testing.T, dispatches []string) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/twitch/39226538", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"u1","emote_set":{"id":"set1"}}`))
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"op":1,"d":{"heartbeat_interval":45000,"session_id":"s1"}}`))
+
+		var sub struct {
+			Op int `json:"op"`
+			D  struct {
+				Type      string            `json:"type"`
+				Condition map[string]string `json:"condition"`
+			} `json:"d"`
+		}
+		if err := conn.ReadJSON(&sub); err != nil {
+			t.Error(err)
+			return
+		}
+		if sub.Op != sevenTVOpSubscribe || sub.D.Type != sevenTVEmoteSetUpdate || sub.D.Condition["object_id"] != "set1" {
+			t.Errorf("Unexpected subscription: %+v", sub)
+		}
+
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"op":2,"d":{}}`))
+		for _, d := range dispatches {
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"op":0,"d":`+d+`}`))
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"op":7,"d":{}}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestSevenTVEvents(t *testing.T) {
+	const channel = "https://www.twitch.tv/dayoman"
+	emote := func(id string, name string, flags int) string {
+		return `{"id":"` + id + `","name":"` + name + `","flags":` + strconv.Itoa(flags) +
+			`,"data":{"host":{"url":"//cdn.7tv.app/emote/` + id + `","files":[{"name":"1x.avif","format":"AVIF"},{"name":"1x.webp","format":"WEBP","width":28,"height":28}]}}}`
+	}
+	server := newSevenTVStandIn(t, []string{
+		`{"type":"emote_set.update","body":{"id":"set1","pushed":[{"key":"emotes","index":1,"value":` + emote("e2", "newEmote", 0) + `},{"key":"emotes","index":2,"value":` + emote("e3", "overlay", 1) + `}]}}`,
+		`{"type":"emote_set.update","body":{"id":"set1","pulled":[{"key":"emotes","index":0,"old_value":` + emote("e1", "oldEmote", 0) + `}]}}`,
+		`{"type":"emote_set.update","body":{"id":"other","pulled":[{"key":"emotes","index":0,"old_value":` + emote("e2", "newEmote", 0) + `}]}}`,
+	})
+	defer server.Close()
+
+	registry := NewEmoteRegistry(nil)
+	registry.SetChannel(channel, map[string]Emote{"oldEmote": {ID: "e1", Name: "oldEmote"}})
+	sets := NewEmoteSets(registry, nil)
+	sets.PlatformIDs[channel] = "39226538"
+	sets.addChannel(channel)
+
+	events := NewSevenTVEvents(sets)
+	events.APIURL = server.URL
+	events.URL = "ws" + strings.TrimPrefix(server.URL, "http") + "/events"
+	var changes []EmoteSetChange
+	events.OnChange = func(c EmoteSetChange) {
+		changes = append(changes, c)
+	}
+
+	if err := events.Subscribe(sets.Channels()[0]); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- events.Listen()
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "end of stream") {
+			t.Errorf("Expected end of stream, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for events")
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, got %+v", changes)
+	}
+	if changes[0].Channel != channel || len(changes[0].Added) != 2 || changes[1].Removed[0] != "oldEmote" {
+		t.Errorf("Unexpected changes: %+v", changes)
+	}
+
+	if _, ok := registry.Lookup(channel, "oldEmote"); ok {
+		t.Error("Pulled emote still in registry")
+	}
+	added, ok := registry.Lookup(channel, "newEmote")
+	if !ok || added.ZeroWidth || len(added.Images) != 2 || added.Images[0].URL != "https://cdn.7tv.app/emote/e2/1x.webp" {
+		t.Errorf("Unexpected pushed emote: %+v", added)
+	}
+	if overlay, _ := registry.Lookup(channel, "overlay"); !overlay.ZeroWidth {
+		t.Errorf("Expected zero-width emote: %+v", overlay)
+	}
+}
+
+func TestSevenTVFollow(t *testing.T) {
+	server := newSevenTVStandIn(t, nil)
+	defer server.Close()
+
+	sets := NewEmoteSets(NewEmoteRegistry(nil), func(string, string) (map[string]Emote, error) {
+		return map[string]Emote{}, nil
+	})
+	sets.PlatformIDs["https://www.twitch.tv/dayoman"] = "39226538"
+	events := NewSevenTVEvents(sets)
+	events.APIURL = server.URL
+	sets.OnAdd = events.Follow
+
+	// Channels added after the event stream started are subscribed to
+	sets.AddChannel("https://www.twitch.tv/unknown")
+	sets.AddChannel("https://www.twitch.tv/dayoman")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events.mu.Lock()
+		channel, ok := events.channels["set1"]
+		n := len(events.channels)
+		events.mu.Unlock()
+		if ok {
+			if channel != "https://www.twitch.tv/dayoman" || n != 1 {
+				t.Errorf("Unexpected subscriptions: %d, set1 for %s", n, channel)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the subscription")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
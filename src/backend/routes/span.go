@@ -0,0 +1,178 @@
+package routes
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// ----------------------------------------------------------------------------
+// EFFECT SPANS
+// ----------------------------------------------------------------------------
+//
+// Effects may cover several words with a bracketed span at the start of any
+// word. Spans nest, and chained prefixes open one scope each:
+//
+//	wave:[this whole phrase]
+//	red:wave:[both effects] then wave:[a red:[nested] span]
+//
+// A span yields a span_start token for each prefix, the tokens of its
+// content, then a span_end token for each prefix (innermost first).
+// Unterminated spans and spans over the Tokenizer limits are not spans; they
+// fall back to ordinary first word effects, or plain text elsewhere.
+
+const (
+	TokenTypeSpanStart = "span_start"
+	TokenTypeSpanEnd   = "span_end"
+
+	SpanOpen  = '['
+	SpanClose = ']'
+
+	DefaultMaxEffectDepth = 2
+	DefaultMaxSpanLen     = 200
+	DefaultMaxSpans       = 8
+)
+
+type Span struct {
+	// Effect kind: TokenTypeColour, TokenTypeEffect or TokenTypePattern
+	Kind string `json:"kind"`
+
+	// Nesting depth of the scope (1 is outermost)
+	Depth int `json:"depth"`
+}
+
+type spanFrame struct {
+	// Byte offset of the closing bracket
+	Close int
+
+	// Span start tokens closed by the bracket (outermost first)
+	Opens []Token
+}
+
+func (p Tokenizer) maxEffectDepth() int {
+	if p.MaxEffectDepth > 0 {
+		return p.MaxEffectDepth
+	}
+	return DefaultMaxEffectDepth
+}
+
+func (p Tokenizer) maxSpanLen() int {
+	if p.MaxSpanLen > 0 {
+		return p.MaxSpanLen
+	}
+	return DefaultMaxSpanLen
+}
+
+func (p Tokenizer) maxSpans() int {
+	if p.MaxSpans > 0 {
+		return p.MaxSpans
+	}
+	return DefaultMaxSpans
+}
+
+// scanSpanOpen parses a chain of effect prefixes ending with an opening
+// bracket at pos, and finds the matching closing bracket before limit.
+// depth is the number of scopes already open. err reports an effect of a
+// complete span which cannot be used, in which case ok is false.
+func (p Tokenizer) scanSpanOpen(e *tokenEmitter, pos int, limit int, depth int) (opens []Token, contentStart int, closePos int, ok bool, err error) {
+	s := e.src[:limit]
+	i := pos
+	var effectErr error
+	for {
+		// Find the end of the next prefix
+		j := i
+		for j < len(s) && s[j] != p.TextEffectSep {
+			r, size := utf8.DecodeRuneInString(s[j:])
+			if r == SpanOpen || r == SpanClose || unicode.IsSpace(r) {
+				return nil, 0, 0, false, nil
+			}
+			j += size
+		}
+		if j == len(s) || j == i {
+			return nil, 0, 0, false, nil
+		}
+
+		// Unusable effects are only reported once the span is known to be
+		// complete, so prose such as "note:this" is left alone
+		tok, ok, err := p.effectToken(e, s[i:j])
+		if err != nil && effectErr == nil {
+			effectErr = err
+		} else if !ok && err == nil {
+			return nil, 0, 0, false, nil
+		}
+		if depth+len(opens)+1 > p.maxEffectDepth() {
+			return nil, 0, 0, false, nil
+		}
+		tok.Type = TokenTypeSpanStart
+		tok.Span = &Span{Kind: effectKind(s[i:j], tok), Depth: depth + len(opens) + 1}
+		tok.Start = i
+		tok.End = j + 1
+		opens = append(opens, tok)
+
+		i = j + 1
+		if i < len(s) && s[i] == SpanOpen {
+			opens[len(opens)-1].End = i + 1
+			contentStart = i + 1
+			break
+		}
+	}
+
+	// Find the matching close, allowing balanced brackets inside
+	level := 0
+	closePos = -1
+	for j := contentStart; j < len(s); j++ {
+		if s[j] == SpanOpen {
+			level++
+		} else if s[j] == SpanClose {
+			if level == 0 {
+				closePos = j
+				break
+			}
+			level--
+		}
+	}
+	if closePos < 0 || utf8.RuneCountInString(s[contentStart:closePos]) > p.maxSpanLen() {
+		return nil, 0, 0, false, nil
+	}
+	if effectErr != nil {
+		return nil, 0, 0, false, effectErr
+	}
+
+	return opens, contentStart, closePos, true, nil
+}
+
+// effectKind returns the token type effectToken assigned to prefix.
+func effectKind(prefix string, tok Token) string {
+	if tok.Pattern != nil {
+		return TokenTypePattern
+	}
+	if _, ok := TextColours[prefix]; ok {
+		return TokenTypeColour
+	}
+	return TokenTypeEffect
+}
+
+// emitSpanEnd closes every scope of the frame. The first end token covers
+// the closing bracket; the rest are empty.
+func (e *tokenEmitter) emitSpanEnd(frame spanFrame) bool {
+	end := frame.Close + 1
+	for k := len(frame.Opens) - 1; k >= 0; k-- {
+		open := frame.Opens[k]
+		tok := Token{
+			Type: TokenTypeSpanEnd,
+			Text: open.Text,
+			Emote: Emote{
+				Locations: []string{},
+				Images:    []Image{},
+			},
+			Span: open.Span,
+		}
+		start := frame.Close
+		if k != len(frame.Opens)-1 {
+			start = end
+		}
+		if !e.emit(tok, start, end) {
+			return false
+		}
+	}
+	return true
+}
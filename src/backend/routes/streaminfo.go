@@ -0,0 +1,208 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/oauth2/twitch"
+)
+
+const (
+	TwitchHelixURL = "https://api.twitch.tv/helix"
+
+	// Time a looked up game or title is reused
+	streamInfoTTL = 5 * time.Minute
+)
+
+var streamInfo *StreamInfo
+
+// StreamInfo looks up the game, or else the title, of the streams being
+// fetched. Lookups happen on demand and are cached, so that the YouTube
+// quota is only spent when a quote is added.
+type StreamInfo struct {
+	TwitchURL     string
+	TwitchClient  *http.Client // Authorized with an app access token
+	TwitchID      string       // Client ID of the app
+	YouTubeURL    string
+	YouTubeClient *http.Client
+	YouTubeKey    string
+
+	mu       sync.Mutex
+	channels map[string]string // First chat URL by platform
+	cached   map[string]streamInfoEntry
+}
+
+type streamInfoEntry struct {
+	game    string
+	expires time.Time
+}
+
+// StreamInfoFromEnv reads the configuration from the environment:
+//
+//	TWITCH_CLIENT_ID      App credentials for Helix
+//	TWITCH_CLIENT_SECRET
+//	YOUTUBE_API_KEY       Data API key
+//
+// Platforms without credentials have no stream info.
+func StreamInfoFromEnv() *StreamInfo {
+	s := &StreamInfo{
+		TwitchURL:     TwitchHelixURL,
+		YouTubeURL:    YouTubeAPIURL,
+		YouTubeClient: &http.Client{Timeout: 5 * time.Second},
+		YouTubeKey:    os.Getenv("YOUTUBE_API_KEY"),
+	}
+	if id, secret := os.Getenv("TWITCH_CLIENT_ID"), os.Getenv("TWITCH_CLIENT_SECRET"); id != "" && secret != "" {
+		config := clientcredentials.Config{ClientID: id, ClientSecret: secret, TokenURL: twitch.Endpoint.TokenURL}
+		s.TwitchClient = config.Client(context.Background())
+		s.TwitchClient.Timeout = 5 * time.Second
+		s.TwitchID = id
+	}
+	return s
+}
+
+// AddChannel records a fetched chat. Only the first chat of each platform is
+// looked up, as messages only carry their platform.
+func (s *StreamInfo) AddChannel(chatURL string) {
+	platform, _ := ChannelPlatform(chatURL)
+	if platform == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.channels == nil {
+		s.channels = make(map[string]string)
+	}
+	if _, ok := s.channels[platform]; !ok {
+		s.channels[platform] = chatURL
+	}
+}
+
+// Game returns the game or title of the stream on the platform of a message
+// source, or "" if unknown.
+func (s *StreamInfo) Game(source string) string {
+	if s == nil {
+		return ""
+	}
+	platform := strings.ToLower(source)
+	s.mu.Lock()
+	chatURL, ok := s.channels[platform]
+	entry, cached := s.cached[platform]
+	s.mu.Unlock()
+	if !ok {
+		return ""
+	} else if cached && time.Now().Before(entry.expires) {
+		return entry.game
+	}
+
+	var game string
+	var err error
+	switch platform {
+	case PlatformTwitch:
+		game, err = s.twitchGame(chatURL)
+	case PlatformYouTube:
+		game, err = s.youTubeTitle(chatURL)
+	}
+	if err != nil {
+		log.Printf("streaminfo: Failed to look up %s: %v", chatURL, err)
+	}
+
+	// Failures are cached too, so that a broken API is not asked on every
+	// quote
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached == nil {
+		s.cached = make(map[string]streamInfoEntry)
+	}
+	s.cached[platform] = streamInfoEntry{game: game, expires: time.Now().Add(streamInfoTTL)}
+	return game
+}
+
+// twitchGame returns the category of a live Twitch stream, or its title.
+func (s *StreamInfo) twitchGame(chatURL string) (string, error) {
+	if s.TwitchClient == nil {
+		return "", nil
+	}
+	channel, err := twitchChannel(chatURL)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, s.TwitchURL+"/streams?"+url.Values{"user_login": {channel[1:]}}.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Client-Id", s.TwitchID)
+	var streams struct {
+		Data []struct {
+			GameName string `json:"game_name"`
+			Title    string `json:"title"`
+		} `json:"data"`
+	}
+	if err := getJSON(s.TwitchClient, req, &streams); err != nil {
+		return "", err
+	}
+	if len(streams.Data) == 0 {
+		return "", nil
+	}
+	if game := streams.Data[0].GameName; game != "" {
+		return truncateMessage(game, maxQuoteGameLen), nil
+	}
+	return truncateMessage(streams.Data[0].Title, maxQuoteGameLen), nil
+}
+
+// youTubeTitle returns the title of a watch URL, or of the current stream
+// of a /channel/<id> URL.
+func (s *StreamInfo) youTubeTitle(chatURL string) (string, error) {
+	if s.YouTubeKey == "" {
+		return "", nil
+	}
+	u, err := url.Parse(chatURL)
+	if err != nil {
+		return "", err
+	}
+	path, query := "/videos", url.Values{"part": {"snippet"}, "id": {u.Query().Get("v")}}
+	if _, channelID := ChannelPlatform(chatURL); channelID != "" {
+		path, query = "/search", url.Values{"part": {"snippet"}, "channelId": {channelID}, "eventType": {"live"}, "type": {"video"}}
+	} else if query.Get("id") == "" {
+		return "", nil
+	}
+	query.Set("key", s.YouTubeKey)
+	req, err := http.NewRequest(http.MethodGet, s.YouTubeURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	var videos struct {
+		Items []struct {
+			Snippet struct {
+				Title string `json:"title"`
+			} `json:"snippet"`
+		} `json:"items"`
+	}
+	if err := getJSON(s.YouTubeClient, req, &videos); err != nil {
+		return "", err
+	}
+	if len(videos.Items) == 0 {
+		return "", nil
+	}
+	return truncateMessage(videos.Items[0].Snippet.Title, maxQuoteGameLen), nil
+}
+
+func getJSON(client *http.Client, req *http.Request, v any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", req.URL.Path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
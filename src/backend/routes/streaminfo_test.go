@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStreamInfo(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/helix/streams":
+			if r.URL.Query().Get("user_login") != "dayoman" || r.Header.Get("Client-Id") != "app" {
+				t.Errorf("Unexpected Twitch request %s", r.URL)
+			}
+			w.Write([]byte(`{"data":[{"game_name":"Elden Ring","title":"blind run"}]}`))
+		case "/youtube/videos":
+			if r.URL.Query().Get("id") != "abc" || r.URL.Query().Get("key") != "key" {
+				t.Errorf("Unexpected YouTube request %s", r.URL)
+			}
+			w.Write([]byte(`{"items":[{"snippet":{"title":"Late night stream"}}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s := &StreamInfo{
+		TwitchURL:     srv.URL + "/helix",
+		TwitchClient:  srv.Client(),
+		TwitchID:      "app",
+		YouTubeURL:    srv.URL + "/youtube",
+		YouTubeClient: srv.Client(),
+		YouTubeKey:    "key",
+	}
+	if got := s.Game("Twitch"); got != "" {
+		t.Errorf("Expected no game before a channel is fetched, got %q", got)
+	}
+	s.AddChannel("https://www.twitch.tv/Dayoman")
+	s.AddChannel("https://www.youtube.com/watch?v=abc")
+	s.AddChannel("https://www.youtube.com/watch?v=other")
+
+	for range 2 {
+		if got := s.Game("Twitch"); got != "Elden Ring" {
+			t.Errorf("Expected the Twitch category, got %q", got)
+		}
+		if got := s.Game("YouTube"); got != "Late night stream" {
+			t.Errorf("Expected the YouTube title, got %q", got)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Expected lookups to be cached, got %d requests", requests)
+	}
+}
@@ -0,0 +1,372 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	timersKey = "timers"
+
+	// Held by the instance announcing a timer, see claimTimer
+	timerLockKeyPrefix = "timers:lock:"
+
+	// Shortest interval between two runs of a timer, in seconds
+	minTimerInterval = 60
+
+	timerTickInterval = 5 * time.Second
+)
+
+var (
+	ErrUnknownTimer = errors.New("no such timer")
+	ErrInvalidTimer = errors.New("invalid timer")
+)
+
+var timers *Timers
+
+// Timer is a recurring announcement. It runs once Interval has passed and
+// at least MinLines chat messages were sent since it last ran.
+type Timer struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Message   string   `json:"message"`
+	Interval  int      `json:"interval"` // Seconds
+	MinLines  int      `json:"minLines"`
+	Platforms []string `json:"platforms"` // Platform chats to announce in, besides the unified stream
+	Enabled   bool     `json:"enabled"`
+}
+
+func (t Timer) validate() error {
+	if t.Name == "" || len(t.Name) > maxCommandNameLen {
+		return fmt.Errorf("%w: names are 1 to %d bytes", ErrInvalidTimer, maxCommandNameLen)
+	}
+	if t.Message == "" || len(t.Message) > maxCommandResponseLen {
+		return fmt.Errorf("%w: messages are 1 to %d bytes", ErrInvalidTimer, maxCommandResponseLen)
+	}
+	if t.Interval < minTimerInterval {
+		return fmt.Errorf("%w: intervals are at least %d seconds", ErrInvalidTimer, minTimerInterval)
+	}
+	if t.MinLines < 0 {
+		return fmt.Errorf("%w: negative minimum lines", ErrInvalidTimer)
+	}
+	for _, platform := range t.Platforms {
+		if platform != PlatformTwitch && platform != PlatformYouTube {
+			return fmt.Errorf("%w: unknown platform %q", ErrInvalidTimer, platform)
+		}
+	}
+	return nil
+}
+
+type timerState struct {
+	Timer
+	lastRun time.Time
+	lines   int64 // Chat lines counted when the timer last ran
+}
+
+// Timers schedules the timers, kept in Redis.
+type Timers struct {
+	// Called when a timer runs
+	Announce func(Timer)
+
+	mu     sync.Mutex
+	timers map[string]*timerState
+	lines  int64 // Chat lines seen
+}
+
+func NewTimers(announce func(Timer)) *Timers {
+	return &Timers{
+		Announce: announce,
+		timers:   make(map[string]*timerState),
+	}
+}
+
+// Load restores the timers stored in Redis, removing those deleted since the
+// last load. Known timers keep their schedule; intervals of new ones start
+// over.
+func (ts *Timers) Load() error {
+	data, err := redisClient.HGetAll(ctx, timersKey).Result()
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]Timer, len(data))
+	for id, d := range data {
+		var t Timer
+		if err := json.Unmarshal([]byte(d), &t); err != nil {
+			log.Printf("timers: Invalid timer %s: %v", id, err)
+			continue
+		}
+		loaded[t.ID] = t
+	}
+
+	now := time.Now()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for id := range ts.timers {
+		if _, ok := loaded[id]; !ok {
+			delete(ts.timers, id)
+		}
+	}
+	for id, t := range loaded {
+		if state, ok := ts.timers[id]; ok {
+			state.Timer = t
+		} else {
+			ts.timers[id] = &timerState{Timer: t, lastRun: now, lines: ts.lines}
+		}
+	}
+	return nil
+}
+
+func saveTimer(t Timer) error {
+	if redisClient == nil {
+		return nil
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return redisClient.HSet(ctx, timersKey, t.ID, data).Err()
+}
+
+// Line counts a chat message towards MinLines.
+func (ts *Timers) Line() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.lines++
+}
+
+// List returns the timers sorted by name.
+func (ts *Timers) List() []Timer {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	list := make([]Timer, 0, len(ts.timers))
+	for _, state := range ts.timers {
+		list = append(list, state.Timer)
+	}
+	slices.SortFunc(list, func(a Timer, b Timer) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+// Add creates a timer with a new ID, first running after its interval.
+func (ts *Timers) Add(t Timer) (Timer, error) {
+	if err := t.validate(); err != nil {
+		return t, err
+	}
+	id, err := generateState()
+	if err != nil {
+		return t, err
+	}
+	t.ID = id
+	if err := saveTimer(t); err != nil {
+		return t, err
+	}
+
+	ts.mu.Lock()
+	ts.timers[t.ID] = &timerState{Timer: t, lastRun: time.Now(), lines: ts.lines}
+	ts.mu.Unlock()
+	notifyStateChange(StateTimers)
+	return t, nil
+}
+
+// Get finds a timer by ID. The result may be modified.
+func (ts *Timers) Get(id string) (Timer, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	state, ok := ts.timers[id]
+	if !ok {
+		return Timer{}, false
+	}
+	t := state.Timer
+	t.Platforms = slices.Clone(t.Platforms)
+	return t, true
+}
+
+// Update replaces the settings of the timer with the ID of t, keeping its
+// schedule.
+func (ts *Timers) Update(t Timer) error {
+	if err := t.validate(); err != nil {
+		return err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	state, ok := ts.timers[t.ID]
+	if !ok {
+		return ErrUnknownTimer
+	}
+	if err := saveTimer(t); err != nil {
+		return err
+	}
+	state.Timer = t
+	notifyStateChange(StateTimers)
+	return nil
+}
+
+// Delete removes a timer.
+func (ts *Timers) Delete(id string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, ok := ts.timers[id]; !ok {
+		return ErrUnknownTimer
+	}
+	if redisClient != nil {
+		if err := redisClient.HDel(ctx, timersKey, id).Err(); err != nil {
+			return err
+		}
+	}
+	delete(ts.timers, id)
+	notifyStateChange(StateTimers)
+	return nil
+}
+
+// Tick runs the timers which are due at now.
+func (ts *Timers) Tick(now time.Time) {
+	var due []Timer
+	ts.mu.Lock()
+	for _, state := range ts.timers {
+		interval := time.Duration(state.Interval) * time.Second
+		if !state.Enabled || now.Sub(state.lastRun) < interval || ts.lines-state.lines < int64(state.MinLines) {
+			continue
+		}
+		state.lastRun = now
+		state.lines = ts.lines
+		due = append(due, state.Timer)
+	}
+	ts.mu.Unlock()
+
+	for _, t := range due {
+		if claimTimer(t) {
+			ts.Announce(t)
+		}
+	}
+}
+
+// claimTimer takes the lease on a run of t, so that a timer due on several
+// instances is announced once. The lease expires a tick before the next run.
+func claimTimer(t Timer) bool {
+	if redisClient == nil {
+		return true
+	}
+	lease := time.Duration(t.Interval)*time.Second - timerTickInterval
+	ok, err := redisClient.SetNX(ctx, timerLockKeyPrefix+t.ID, 1, lease).Result()
+	if err != nil {
+		log.Printf("redis: Failed to claim timer %s: %v", t.ID, err)
+		return false
+	}
+	return ok
+}
+
+func (ts *Timers) Run() {
+	ticker := time.NewTicker(timerTickInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		ts.Tick(now)
+	}
+}
+
+// announceTimer posts a timer message to the unified stream and to the
+// chats of its platforms.
+func announceTimer(t Timer) {
+	data, err := json.Marshal(commandParser.CreateResponse(t.Message))
+	if err != nil {
+		log.Printf("timers: Failed to marshal announcement: %v", err)
+		return
+	}
+	if err := publishMessage(data); err != nil {
+		log.Printf("redis: Failed to add announcement to stream: %v", err)
+	}
+	responder.Announce(t.Platforms, t.Message)
+}
+
+// writeTimerError maps a timer error to an HTTP response.
+func writeTimerError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidTimer):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrUnknownTimer):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, "Failed to save timer", http.StatusInternalServerError)
+	}
+}
+
+// ListTimers lists the timers.
+func ListTimers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timers.List())
+}
+
+// CreateTimer adds a timer from a JSON Timer, enabled unless it says
+// otherwise. Moderators only.
+func CreateTimer(w http.ResponseWriter, r *http.Request) {
+	t := Timer{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	t, err := timers.Add(t)
+	if err != nil {
+		writeTimerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// UpdateTimer changes the fields of a timer given in a JSON Timer.
+// Moderators only.
+func UpdateTimer(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	t, ok := timers.Get(id)
+	if !ok {
+		writeTimerError(w, ErrUnknownTimer)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	t.ID = id
+	if err := timers.Update(t); err != nil {
+		writeTimerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteTimer removes a timer. Moderators only.
+func DeleteTimer(w http.ResponseWriter, r *http.Request) {
+	if ok := requireModerator(w, r); !ok {
+		return
+	}
+
+	if err := timers.Delete(mux.Vars(r)["id"]); err != nil {
+		writeTimerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,75 @@
+package routes
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimers(t *testing.T) {
+	var announced []string
+	ts := NewTimers(func(timer Timer) {
+		announced = append(announced, timer.Name)
+	})
+
+	if _, err := ts.Add(Timer{Name: "fast", Message: "hi", Interval: 1}); !errors.Is(err, ErrInvalidTimer) {
+		t.Errorf("Expected interval error, got %v", err)
+	}
+	if _, err := ts.Add(Timer{Name: "x", Message: "hi", Interval: 60, Platforms: []string{"kick"}}); !errors.Is(err, ErrInvalidTimer) {
+		t.Errorf("Expected platform error, got %v", err)
+	}
+
+	socials, err := ts.Add(Timer{Name: "socials", Message: "Follow!", Interval: 60, MinLines: 2, Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Add(Timer{Name: "rules", Message: "Be nice", Interval: 60, Enabled: false}); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	ts.Tick(start.Add(2 * time.Minute))
+	if len(announced) != 0 {
+		t.Errorf("Ran without enough chat lines: %v", announced)
+	}
+
+	ts.Line()
+	ts.Line()
+	ts.Tick(start.Add(30 * time.Second))
+	if len(announced) != 0 {
+		t.Errorf("Ran before its interval: %v", announced)
+	}
+	ts.Tick(start.Add(2 * time.Minute))
+	if len(announced) != 1 || announced[0] != "socials" {
+		t.Fatalf("Expected socials to run once, got %v", announced)
+	}
+
+	// Lines are counted again from the last run
+	ts.Line()
+	ts.Tick(start.Add(10 * time.Minute))
+	if len(announced) != 1 {
+		t.Errorf("Ran again without enough chat lines: %v", announced)
+	}
+
+	// Changes are made to the stored timer, as UpdateTimer does
+	socials, ok := ts.Get(socials.ID)
+	if !ok || !socials.Enabled || socials.MinLines != 2 {
+		t.Fatalf("Unexpected timer: %+v %v", socials, ok)
+	}
+	socials.Enabled = false
+	if err := ts.Update(socials); err != nil {
+		t.Fatal(err)
+	}
+	ts.Line()
+	ts.Tick(start.Add(20 * time.Minute))
+	if len(announced) != 1 {
+		t.Errorf("Disabled timer ran: %v", announced)
+	}
+
+	if err := ts.Delete(socials.ID); err != nil || len(ts.List()) != 1 {
+		t.Errorf("Failed to delete timer: %v %+v", err, ts.List())
+	}
+	if err := ts.Delete(socials.ID); !errors.Is(err, ErrUnknownTimer) {
+		t.Errorf("Expected unknown timer, got %v", err)
+	}
+}
@@ -3,8 +3,12 @@ package routes
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"iter"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -14,6 +18,9 @@ const (
 	TokenTypeEffect  = "effect"
 	TokenTypePattern = "pattern"
 	TokenTypeCommand = "command"
+	TokenTypeLink    = "link"
+	TokenTypeMention = "mention"
+	TokenTypeEmoji   = "emoji"
 )
 
 var TextEffects = map[string]struct{}{
@@ -42,15 +49,48 @@ var TextColours = map[string]struct{}{
 }
 
 type Token struct {
-	Type  string `json:"type"`
-	Text  string `json:"text"`
-	Emote Emote  `json:"emote"`
+	Type    string   `json:"type"`
+	Text    string   `json:"text"`
+	Emote   Emote    `json:"emote"`
+	Link    *Link    `json:"link,omitempty"`
+	Mention *Mention `json:"mention,omitempty"`
+	Emoji   *Emoji   `json:"emoji,omitempty"`
+	Pattern *Pattern `json:"pattern,omitempty"`
+	Span    *Span    `json:"span,omitempty"`
+
+	// Zero-width emotes stacked on top of this emote (in order)
+	Overlays []Emote `json:"overlays,omitempty"`
+
+	// Why the source of this text token was not tokenized as an effect
+	Error string `json:"error,omitempty"`
+
+	// Source range in bytes and runes (end exclusive)
+	Start     int `json:"start"`
+	End       int `json:"end"`
+	RuneStart int `json:"runeStart"`
+	RuneEnd   int `json:"runeEnd"`
 }
 
 type Tokenizer struct {
-	EmoteCache        map[string]Emote
+	Emotes            *EmoteRegistry
+	Authors           *AuthorCache
 	TextEffectSep     byte
 	TextCommandPrefix byte
+
+	// Commands recognized after TextCommandPrefix at the start of a message
+	Commands *CommandRegistry
+
+	// Minimum role for effects by name (see EffectRolesFromEnv). Effects
+	// not listed may be used by anyone.
+	EffectRoles map[string]Role
+
+	// Image URL template for emoji (see DefaultEmojiURLTemplate)
+	EmojiURLTemplate string
+
+	// Effect limits (zero uses the defaults in span.go)
+	MaxEffectDepth int // Nested effect scopes, and effects on the first word
+	MaxSpanLen     int // Runes inside a single span
+	MaxSpans       int // Spans per message
 }
 
 // ScanSeparator returns a split function for a [Scanner] that returns text separated
@@ -78,6 +118,199 @@ func ScanSeparator(sep byte) bufio.SplitFunc {
 	}
 }
 
+// tokenEmitter yields tokens annotated with their source range. Adjacent text
+// (words and whitespace alike) is merged into a single text token so that
+// the ranges of all yielded tokens tile the original message.
+type tokenEmitter struct {
+	src   string
+	yield func(Token) bool
+
+	// Pending text range [textStart, textEnd)
+	textStart int
+	textEnd   int
+	hasText   bool
+
+	// Cursor used to convert increasing byte offsets to rune offsets
+	bytePos int
+	runePos int
+
+	// Emotes of the message being tokenized. Native emotes are located by
+	// their byte range (keyed by start); emotes without locations are
+	// matched by name within this message only.
+	native      map[int]nativeEmote
+	localEmotes map[string]Emote
+
+	// Registry layers at the start of the message, and the channel whose
+	// third party emotes apply
+	emotes  *EmoteSnapshot
+	channel string
+
+	// Role of the author, checked against Tokenizer.EffectRoles
+	role Role
+
+	// Error attached to the next text token (e.g. an invalid pattern)
+	textError string
+
+	// Last emote token, held back so that following zero-width emotes can
+	// be attached as overlays
+	held    Token
+	hasHeld bool
+
+	stopped bool
+}
+
+type nativeEmote struct {
+	End   int
+	Emote Emote
+}
+
+// setEmotes indexes the platform emotes of a message. Locations are
+// inclusive rune ranges ("start-end") as provided by the platforms.
+// Locations which are malformed, out of bounds or overlapping are ignored.
+func (e *tokenEmitter) setEmotes(emotes []Emote) {
+	if len(emotes) == 0 {
+		return
+	}
+
+	// Byte offset of every rune index (plus the end of the string)
+	runeToByte := make([]int, 0, len(e.src)+1)
+	for i := range e.src {
+		runeToByte = append(runeToByte, i)
+	}
+	runeToByte = append(runeToByte, len(e.src))
+
+	e.native = make(map[int]nativeEmote)
+	covered := make(map[int]struct{})
+	for _, emote := range emotes {
+		if len(emote.Locations) == 0 {
+			if emote.Name != "" {
+				if e.localEmotes == nil {
+					e.localEmotes = make(map[string]Emote)
+				}
+				e.localEmotes[emote.Name] = emote
+			}
+			continue
+		}
+		for _, loc := range emote.Locations {
+			startStr, endStr, ok := strings.Cut(loc, "-")
+			if !ok {
+				continue
+			}
+			start, err1 := strconv.Atoi(startStr)
+			end, err2 := strconv.Atoi(endStr)
+			if err1 != nil || err2 != nil || start < 0 || end < start || end+1 >= len(runeToByte) {
+				continue
+			}
+			overlaps := false
+			for i := start; i <= end; i++ {
+				if _, ok := covered[i]; ok {
+					overlaps = true
+					break
+				}
+			}
+			if overlaps {
+				continue
+			}
+			for i := start; i <= end; i++ {
+				covered[i] = struct{}{}
+			}
+			e.native[runeToByte[start]] = nativeEmote{runeToByte[end+1], emote}
+		}
+	}
+}
+
+func (e *tokenEmitter) runeOffset(b int) int {
+	e.runePos += utf8.RuneCountInString(e.src[e.bytePos:b])
+	e.bytePos = b
+	return e.runePos
+}
+
+// text marks the source range [start, end) as plain text.
+func (e *tokenEmitter) text(start int, end int) {
+	if start >= end {
+		return
+	}
+	if !e.hasText {
+		e.textStart = start
+		e.hasText = true
+	}
+	e.textEnd = end
+}
+
+// flush yields any held emote and pending text. Returns false if the
+// consumer stopped.
+func (e *tokenEmitter) flush() bool {
+	if e.hasHeld {
+		e.hasHeld = false
+		if !e.send(e.held, e.held.Start, e.held.End) {
+			return false
+		}
+	}
+	if !e.hasText {
+		return !e.stopped
+	}
+	e.hasText = false
+	tok := Token{
+		Type: TokenTypeText,
+		Text: e.src[e.textStart:e.textEnd],
+		Emote: Emote{
+			Locations: []string{},
+			Images:    []Image{},
+		},
+		Error: e.textError,
+	}
+	e.textError = ""
+	return e.send(tok, e.textStart, e.textEnd)
+}
+
+// emit yields tok covering [start, end) after any pending text.
+// Returns false if the consumer stopped.
+func (e *tokenEmitter) emit(tok Token, start int, end int) bool {
+	if tok.Type == TokenTypeEmote && tok.Emote.ZeroWidth && e.overlay(tok, end) {
+		return !e.stopped
+	}
+	if !e.flush() {
+		return false
+	}
+	if tok.Type == TokenTypeEmote {
+		tok.Start = start
+		tok.End = end
+		e.held = tok
+		e.hasHeld = true
+		return true
+	}
+	return e.send(tok, start, end)
+}
+
+// overlay attaches a zero-width emote ending at end to the held emote when
+// only whitespace separates them. The held emote then covers both.
+func (e *tokenEmitter) overlay(tok Token, end int) bool {
+	if !e.hasHeld {
+		return false
+	}
+	if e.hasText && (e.textError != "" || strings.TrimSpace(e.src[e.textStart:e.textEnd]) != "") {
+		return false
+	}
+	e.hasText = false
+	e.held.Overlays = append(e.held.Overlays, tok.Emote)
+	e.held.End = end
+	return true
+}
+
+func (e *tokenEmitter) send(tok Token, start int, end int) bool {
+	if e.stopped {
+		return false
+	}
+	tok.Start = start
+	tok.End = end
+	tok.RuneStart = e.runeOffset(start)
+	tok.RuneEnd = e.runeOffset(end)
+	if !e.yield(tok) {
+		e.stopped = true
+	}
+	return !e.stopped
+}
+
 // Recursively check for the presence of colors and effects
 //
 // Formats:
@@ -87,198 +320,449 @@ func ScanSeparator(sep byte) bufio.SplitFunc {
 //	color:effect:text
 //	effect:colour:text
 //
-// Returns: (yield stop, last word (text only))
-func (p Tokenizer) iterWordEffect(yield func(Token) bool, word string, depth int) (bool, string) {
-
-	// Base Case: Empty string
+// Returns the effect tokens found (with ranges relative to word) and the
+// number of bytes of word they consume. The remainder of the word is
+// tokenized as a regular word.
+func (p Tokenizer) scanWordEffects(e *tokenEmitter, word string, offset int, depth int, toks []Token) ([]Token, int) {
+	// Base Case: Empty string or emote
 	if word == "" {
-		return false, ""
+		return toks, offset
 	}
-
-	tok := Token{
-		Type: TokenTypeText,
-		Text: word,
-		Emote: Emote{
-			Locations: []string{},
-			Images:    []Image{},
-		},
+	if _, ok := e.native[offset]; ok {
+		return toks, offset
 	}
-
-	// Base Case: Emote
-	if emote, ok := p.EmoteCache[word]; ok {
-		tok.Type = TokenTypeEmote
-		tok.Emote = emote
-		return !yield(tok), ""
+	if _, ok := p.lookupEmote(e, word); ok {
+		return toks, offset
 	}
 
 	// Base Case: Depth limit
-	if depth == 2 {
-		return false, word
+	if depth == p.maxEffectDepth() {
+		return toks, offset
 	}
 
 	prefix, postfix, sepFound := strings.Cut(word, string(p.TextEffectSep))
 
 	// No effects found, return word
 	if !sepFound || prefix == "" {
-		return false, word
+		return toks, offset
+	}
+
+	tok, ok, err := p.effectToken(e, prefix)
+	if err != nil {
+		e.textError = err.Error()
+	}
+	if !ok {
+		return toks, offset
+	}
+	tok.Start = offset
+	tok.End = offset + len(prefix) + 1
+
+	// Recursively tokenize next effect
+	return p.scanWordEffects(e, postfix, tok.End, depth+1, append(toks, tok))
+}
+
+// Look for color, effect, or pattern named by prefix. err is set when
+// prefix names an effect which cannot be used (an invalid pattern or an
+// effect above the role of the author); callers report it only where the
+// effect would have been applied.
+func (p Tokenizer) effectToken(e *tokenEmitter, prefix string) (tok Token, ok bool, err error) {
+	tok = Token{
+		Emote: Emote{
+			Locations: []string{},
+			Images:    []Image{},
+		},
 	}
 
-	// Look for color, effect, or pattern
 	if _, ok := TextColours[prefix]; ok {
 		tok.Type = TokenTypeColour
 		tok.Text = prefix
 	} else if _, ok := TextEffects[prefix]; ok {
 		tok.Type = TokenTypeEffect
 		tok.Text = prefix
-	} else if 7 <= len(prefix) && len(prefix) <= 15 && prefix[:7] == "pattern" {
-		// Note: Len("pattern...ops") >= 8 and pattern opcode max length is 8.
-		if len(prefix) == 7 {
-			return false, word[8:]
+	} else if ops, ok := strings.CutPrefix(prefix, PatternKeyword); ok && isPatternOps(ops) {
+		// Note: A bare "pattern:" and words such as "patterned:" are plain
+		// text. Invalid patterns stay text and report the error, with the
+		// grammar, on the text token.
+		pattern, err := ParsePattern(ops)
+		if err != nil {
+			return tok, false, fmt.Errorf("%w. %s", err, PatternHelp())
 		}
 		tok.Type = TokenTypePattern
-		tok.Text = prefix[7:]
+		tok.Text = pattern.String()
+		tok.Pattern = &pattern
 	} else {
-		return false, word
+		return tok, false, nil
 	}
 
-	if !yield(tok) {
-		return true, ""
+	name := tok.Text
+	if tok.Type == TokenTypePattern {
+		name = "pattern"
+	}
+	if required := p.effectRole(name); e.role < required {
+		return tok, false, fmt.Errorf("%s requires the %s role", name, required)
 	}
 
-	// Recursively tokenize next effect
-	return p.iterWordEffect(yield, postfix, depth+1)
+	return tok, true, nil
+}
+
+// effectRole returns the minimum role allowed to use the named effect.
+func (p Tokenizer) effectRole(name string) Role {
+	if role, ok := p.EffectRoles[name]; ok {
+		return role
+	}
+	return p.EffectRoles["*"]
 }
 
-// Helper to iterate over YouTube style emotes
-func (p Tokenizer) iterYoutube(yield func(Token) bool, word string, sb strings.Builder) strings.Builder {
-	scanner := bufio.NewScanner(strings.NewReader(word))
+// Looks up an emote by name, preferring emotes sent with the message over
+// third party emotes.
+func (p Tokenizer) lookupEmote(e *tokenEmitter, name string) (Emote, bool) {
+	if emote, ok := e.localEmotes[name]; ok {
+		return emote, true
+	}
+	return e.emotes.Lookup(e.channel, name)
+}
+
+// Helper to iterate over YouTube style emotes in the word at [start, end)
+func (p Tokenizer) iterYoutube(e *tokenEmitter, start int, end int) bool {
+	scanner := bufio.NewScanner(strings.NewReader(e.src[start:end]))
 	scanner.Split(ScanSeparator(':'))
 
 	// Iterate over potential emotes [:emote:] (scanning over colons)
-	tok := Token{
-		Type: TokenTypeText,
-		Emote: Emote{
-			Locations: []string{},
-			Images:    []Image{},
-		},
-	}
+	offset := start
 	for scanner.Scan() {
 		text := scanner.Text()
 		// YouTube emote found
-		if emote, ok := p.EmoteCache[text]; ok && text[0] == ':' {
-			// yield text before emote
-			tok.Text = strings.TrimSpace(sb.String())
-			if tok.Text != "" {
-				if !yield(tok) {
-					return sb
-				}
+		if emote, ok := p.lookupEmote(e, text); ok && text[0] == ':' {
+			tok := Token{
+				Type:  TokenTypeEmote,
+				Text:  text,
+				Emote: emote,
 			}
-			tok.Type = TokenTypeEmote
-			tok.Text = text
-			tok.Emote = emote
-			if !yield(tok) {
-				return sb
+			if !e.emit(tok, offset, offset+len(text)) {
+				return false
 			}
-			sb.Reset()
-		} else {
-			tok.Type = TokenTypeText
-			tok.Emote = Emote{
-				Locations: []string{},
-				Images:    []Image{},
+		} else if sequence, ok := p.shortcode(text); ok {
+			tok := Token{
+				Type: TokenTypeEmoji,
+				Text: text,
+				Emote: Emote{
+					Locations: []string{},
+					Images:    []Image{},
+				},
 			}
-			sb.WriteString(text)
+			emoji := NewEmoji(sequence, text[1:len(text)-1], p.EmojiURLTemplate)
+			tok.Emoji = &emoji
+			if !e.emit(tok, offset, offset+len(text)) {
+				return false
+			}
+		} else if !p.iterEmoji(e, offset, offset+len(text)) {
+			return false
 		}
+		offset += len(text)
 	}
-	sb.WriteByte(' ')
 
-	return sb
+	return true
 }
 
-// Returns an iterator over the string which yields tokens.
-func (p Tokenizer) Iter(s string) iter.Seq[Token] {
-	return func(yield func(Token) bool) {
-		var sb strings.Builder
-		scanner := bufio.NewScanner(strings.NewReader(s))
-		scanner.Split(bufio.ScanWords)
+// Looks up a :shortcode: emoji.
+func (p Tokenizer) shortcode(text string) (string, bool) {
+	if len(text) < 3 || text[0] != ':' || text[len(text)-1] != ':' {
+		return "", false
+	}
+	sequence, ok := EmojiShortcodes[text[1:len(text)-1]]
+	return sequence, ok
+}
+
+// Helper to split Unicode emoji sequences out of the text at [start, end)
+func (p Tokenizer) iterEmoji(e *tokenEmitter, start int, end int) bool {
+	textStart := start
+	for i := start; i < end; {
+		// Fast path for ASCII which cannot start an emoji
+		if c := e.src[i]; c < utf8.RuneSelf && !isKeycapBase(rune(c)) {
+			i++
+			continue
+		}
+		if n := ScanEmoji(e.src[i:end]); n > 0 {
+			e.text(textStart, i)
+			emoji := NewEmoji(e.src[i:i+n], "", p.EmojiURLTemplate)
+			tok := Token{
+				Type: TokenTypeEmoji,
+				Text: e.src[i : i+n],
+				Emote: Emote{
+					Locations: []string{},
+					Images:    []Image{},
+				},
+				Emoji: &emoji,
+			}
+			if !e.emit(tok, i, i+n) {
+				return false
+			}
+			i += n
+			textStart = i
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(e.src[i:end])
+		i += size
+	}
+	e.text(textStart, end)
+	return true
+}
 
+// Tokenizes the word at [start, end), splitting out native emotes by
+// position before matching the remaining pieces by name.
+func (p Tokenizer) iterWord(e *tokenEmitter, start int, end int) bool {
+	if len(e.native) == 0 {
+		return p.iterWordPiece(e, start, end)
+	}
+	for pos := start; pos < end; {
+		if native, ok := e.native[pos]; ok && native.End <= end {
+			tok := Token{
+				Type:  TokenTypeEmote,
+				Text:  e.src[pos:native.End],
+				Emote: native.Emote,
+			}
+			if !e.emit(tok, pos, native.End) {
+				return false
+			}
+			pos = native.End
+			continue
+		}
+		next := pos + 1
+		for next < end {
+			if _, ok := e.native[next]; ok {
+				break
+			}
+			next++
+		}
+		if !p.iterWordPiece(e, pos, next) {
+			return false
+		}
+		pos = next
+	}
+	return true
+}
+
+// Tokenizes the piece of a word at [start, end) as an emote, link, mention
+// or text.
+func (p Tokenizer) iterWordPiece(e *tokenEmitter, start int, end int) bool {
+	word := e.src[start:end]
+	if emote, ok := p.lookupEmote(e, word); ok {
+		tok := Token{
+			Type:  TokenTypeEmote,
+			Text:  word,
+			Emote: emote,
+		}
+		return e.emit(tok, start, end)
+	}
+	if link, n, ok := ParseLink(word); ok {
+		tok := Token{
+			Type: TokenTypeLink,
+			Text: word[:n],
+			Emote: Emote{
+				Locations: []string{},
+				Images:    []Image{},
+			},
+			Link: &link,
+		}
+		if !e.emit(tok, start, start+n) {
+			return false
+		}
+		e.text(start+n, end)
+		return true
+	}
+	if name, n, ok := ParseMention(word); ok {
+		mention, _ := p.Authors.Resolve(name)
 		tok := Token{
-			Type: TokenTypeText,
+			Type: TokenTypeMention,
+			Text: word[:n],
 			Emote: Emote{
 				Locations: []string{},
 				Images:    []Image{},
 			},
+			Mention: &mention,
+		}
+		if !e.emit(tok, start, start+n) {
+			return false
+		}
+		e.text(start+n, end)
+		return true
+	}
+	return p.iterYoutube(e, start, end)
+}
+
+// Returns the byte offset of the first non-space character at or after i.
+func skipSpace(s string, i int) int {
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !unicode.IsSpace(r) {
+			break
 		}
+		i += size
+	}
+	return i
+}
+
+// Returns the byte offset of the first space character at or after i.
+func skipWord(s string, i int) int {
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if unicode.IsSpace(r) {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+// Returns an iterator over the string which yields tokens.
+//
+// Every token carries the byte [Start, End) and rune [RuneStart, RuneEnd)
+// range of the source it was made from. The ranges are contiguous and cover
+// the entire message, so s can always be rebuilt from the tokens.
+func (p Tokenizer) Iter(s string) iter.Seq[Token] {
+	return p.IterEmotes(s, nil)
+}
 
-		ok := scanner.Scan()
-		if !ok {
+// Returns an iterator over the string which yields tokens, using the native
+// platform emotes sent with the message. Emotes with locations are matched
+// by position, the rest by name, and neither is remembered afterwards.
+func (p Tokenizer) IterEmotes(s string, emotes []Emote) iter.Seq[Token] {
+	return p.IterChannel(s, "", emotes)
+}
+
+// Returns an iterator over a message from channel which yields tokens. The
+// third party emotes of channel are used in addition to the global emotes.
+// Effects are limited to those allowed for viewers.
+func (p Tokenizer) IterChannel(s string, channel string, emotes []Emote) iter.Seq[Token] {
+	return p.iter(s, channel, emotes, RoleViewer)
+}
+
+// Returns an iterator over the tokens of m from channel, allowing the
+// effects permitted for the role of its author.
+func (p Tokenizer) IterMessage(m Message, channel string) iter.Seq[Token] {
+	return p.iter(m.Message, channel, m.Emotes, m.Role)
+}
+
+func (p Tokenizer) iter(s string, channel string, emotes []Emote, role Role) iter.Seq[Token] {
+	return func(yield func(Token) bool) {
+		e := &tokenEmitter{src: s, yield: yield, channel: channel, role: role}
+		e.setEmotes(emotes)
+		e.emotes = p.Emotes.Snapshot()
+
+		wordStart := skipSpace(s, 0)
+		wordEnd := skipWord(s, wordStart)
+
+		// Whitespace only
+		if wordStart == len(s) {
+			e.text(0, len(s))
+			e.flush()
 			return
 		}
 
-		word := scanner.Text()
+		word := s[wordStart:wordEnd]
+		_, _, _, firstWordSpan, _ := p.scanSpanOpen(e, wordStart, len(s), 0)
 
 		// Check for command
 		// Exits early if command prefix is detected at start of string
 		if len(word) > 1 && word[0] == p.TextCommandPrefix {
-			command := word[1:]
-			if officialCommand, isAlias := TextCommandAlias[command]; isAlias {
-				command = officialCommand
-			}
-			if _, ok := TextCommand[command]; ok {
-				tok.Type = TokenTypeCommand
-				tok.Text = strings.TrimSpace(command + s[len(word):])
+			if command, ok := p.Commands.Resolve(word[1:]); ok {
+				tok := Token{
+					Type: TokenTypeCommand,
+					Text: strings.TrimSpace(command + s[wordEnd:]),
+					Emote: Emote{
+						Locations: []string{},
+						Images:    []Image{},
+					},
+				}
+				e.emit(tok, 0, len(s))
 			} else {
-				tok.Text = strings.TrimSpace(s)
+				e.text(0, len(s))
+				e.flush()
 			}
-			yield(tok)
 			return
 		}
 
-		// Recursively tokenize text effects
-		stop, lastWord := p.iterWordEffect(yield, word, 0)
-		if stop {
-			return
+		// Tokenize text effects on the first word. The leading whitespace
+		// belongs to the first effect, and when the word holds nothing but
+		// effects the following whitespace belongs to the last one.
+		var effects []Token
+		consumed := wordStart
+		if !firstWordSpan {
+			effects, consumed = p.scanWordEffects(e, word, wordStart, 0, nil)
+		}
+		if len(effects) > 0 {
+			effects[0].Start = 0
+			if consumed == wordEnd {
+				consumed = skipSpace(s, wordEnd)
+				effects[len(effects)-1].End = consumed
+			}
+			for _, tok := range effects {
+				if !e.emit(tok, tok.Start, tok.End) {
+					return
+				}
+			}
+		} else {
+			e.text(0, wordStart)
+			consumed = wordStart
 		}
 
-		// Scan last word for youtube emotes
-		sb = p.iterYoutube(yield, lastWord, sb)
-
-		// Scan the rest of the message for emotes
-		for scanner.Scan() {
-			word = scanner.Text()
+		// Scan the rest of the message for effect spans and emotes
+		var spans []spanFrame
+		depth := 0
+		spanCount := 0
+		for i := consumed; i < len(s); {
+			limit := len(s)
+			if len(spans) > 0 {
+				limit = spans[len(spans)-1].Close
+			}
 
-			// Check for emote
-			if emote, ok := p.EmoteCache[word]; ok {
-				// yield text before emote
-				tok.Text = strings.TrimSpace(sb.String())
-				if tok.Text != "" {
-					if !yield(tok) {
-						return
-					}
-				}
-				tok.Type = TokenTypeEmote
-				tok.Text = word
-				tok.Emote = emote
-				if !yield(tok) {
+			// Close the innermost span
+			if i == limit {
+				frame := spans[len(spans)-1]
+				spans = spans[:len(spans)-1]
+				depth -= len(frame.Opens)
+				if !e.emitSpanEnd(frame) {
 					return
 				}
-				sb.Reset()
-			} else {
-				tok.Type = TokenTypeText
-				tok.Emote = Emote{
-					Locations: []string{},
-					Images:    []Image{},
-				}
-				sb = p.iterYoutube(yield, word, sb)
+				i++
+				continue
 			}
-		}
 
-		tok.Text = strings.TrimSpace(sb.String())
+			wordStart = skipSpace(s[:limit], i)
+			e.text(i, wordStart)
+			if wordStart == limit {
+				i = wordStart
+				continue
+			}
 
-		// yield remaining text at end of message scan
-		if tok.Text != "" {
-			if !yield(tok) {
+			// Open a span at the start of a word
+			if spanCount < p.maxSpans() {
+				opens, contentStart, closePos, ok, err := p.scanSpanOpen(e, wordStart, limit, depth)
+				if err != nil {
+					e.textError = err.Error()
+				}
+				if ok {
+					for _, tok := range opens {
+						if !e.emit(tok, tok.Start, tok.End) {
+							return
+						}
+					}
+					spans = append(spans, spanFrame{Close: closePos, Opens: opens})
+					depth += len(opens)
+					spanCount++
+					i = contentStart
+					continue
+				}
+			}
+
+			wordEnd = skipWord(s[:limit], wordStart)
+			if !p.iterWord(e, wordStart, wordEnd) {
 				return
 			}
+			i = wordEnd
 		}
+
+		// yield remaining text at end of message scan
+		e.flush()
 	}
 }
@@ -3,46 +3,50 @@ package routes
 import (
 	"bufio"
 	"iter"
+	"slices"
 	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestTokenizer(t *testing.T) {
-	tokenizer := Tokenizer{
-		EmoteCache: map[string]Emote{
-			"Clap": {
-				ID:     "1",
-				Name:   "Clap",
-				Images: []Image{{URL: "https://cdn.test.net/v1/emotes/1/1x.webp"}},
-			},
-			"Clap2": {
-				ID:     "2",
-				Name:   "Clap2",
-				Images: []Image{{URL: "https://cdn.test.net/v1/emotes/2/1x.webp"}},
-			},
-			"KEKW": {
-				ID:     "3",
-				Name:   "KEKW",
-				Images: []Image{{URL: "https://cdn.test.net/v1/emotes/3/1x.webp"}},
-			},
-			"FeelsGoodMan": {
-				ID:     "4",
-				Name:   "FeelsGoodMan",
-				Images: []Image{{URL: "https://cdn.test.net/v1/emotes/4/1x.webp"}},
-			},
-			":goat-turqouise-white-horns:": {
-				ID:     "5",
-				Name:   ":goat-turqouise-white-horns:",
-				Images: []Image{{URL: "https://cdn.test.net/v1/emotes/5/1x.webp"}},
-			},
-			":_DayoHog:": {
-				ID:     "6",
-				Name:   ":_DayoHog:",
-				Images: []Image{{URL: "https://cdn.test.net/v1/emotes/6/1x.webp"}},
-			},
+	emotes := map[string]Emote{
+		"Clap": {
+			ID:     "1",
+			Name:   "Clap",
+			Images: []Image{{URL: "https://cdn.test.net/v1/emotes/1/1x.webp"}},
+		},
+		"Clap2": {
+			ID:     "2",
+			Name:   "Clap2",
+			Images: []Image{{URL: "https://cdn.test.net/v1/emotes/2/1x.webp"}},
+		},
+		"KEKW": {
+			ID:     "3",
+			Name:   "KEKW",
+			Images: []Image{{URL: "https://cdn.test.net/v1/emotes/3/1x.webp"}},
+		},
+		"FeelsGoodMan": {
+			ID:     "4",
+			Name:   "FeelsGoodMan",
+			Images: []Image{{URL: "https://cdn.test.net/v1/emotes/4/1x.webp"}},
 		},
+		":goat-turqouise-white-horns:": {
+			ID:     "5",
+			Name:   ":goat-turqouise-white-horns:",
+			Images: []Image{{URL: "https://cdn.test.net/v1/emotes/5/1x.webp"}},
+		},
+		":_DayoHog:": {
+			ID:     "6",
+			Name:   ":_DayoHog:",
+			Images: []Image{{URL: "https://cdn.test.net/v1/emotes/6/1x.webp"}},
+		},
+	}
+	tokenizer := Tokenizer{
+		Emotes:            NewEmoteRegistry(emotes),
 		TextEffectSep:     ':',
 		TextCommandPrefix: '!',
+		Commands:          DefaultCommands(),
 	}
 	type Test struct {
 		Name     string
@@ -55,143 +59,168 @@ func TestTokenizer(t *testing.T) {
 			Name:    "colourEmpty",
 			Message: "white:",
 			Expected: []Token{
-				{TokenTypeColour, "white", Emote{}},
+				{Type: TokenTypeColour, Text: "white", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "<WS>colourEmpty",
 			Message: "    white:",
 			Expected: []Token{
-				{TokenTypeColour, "white", Emote{}},
+				{Type: TokenTypeColour, Text: "white", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "effectEmpty",
 			Message: "wave2:",
 			Expected: []Token{
-				{TokenTypeEffect, "wave2", Emote{}},
+				{Type: TokenTypeEffect, Text: "wave2", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "colour:text",
 			Message: "white:text",
 			Expected: []Token{
-				{TokenTypeColour, "white", Emote{}},
-				{TokenTypeText, "text", Emote{}},
+				{Type: TokenTypeColour, Text: "white", Emote: Emote{}},
+				{Type: TokenTypeText, Text: "text", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "color:<WS>text",
 			Message: "white:  text",
 			Expected: []Token{
-				{TokenTypeColour, "white", Emote{}},
-				{TokenTypeText, "text", Emote{}},
+				{Type: TokenTypeColour, Text: "white", Emote: Emote{}},
+				{Type: TokenTypeText, Text: "text", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "color:<WS>emote",
 			Message: "white:  Clap2",
 			Expected: []Token{
-				{TokenTypeColour, "white", Emote{}},
-				{TokenTypeEmote, "Clap2", tokenizer.EmoteCache["Clap2"]},
+				{Type: TokenTypeColour, Text: "white", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: "Clap2", Emote: emotes["Clap2"]},
 			},
 		},
 		{
 			Name:    "color:effect:emote",
 			Message: "rainbow:wave2:KEKW",
 			Expected: []Token{
-				{TokenTypeColour, "rainbow", Emote{}},
-				{TokenTypeEffect, "wave2", Emote{}},
-				{TokenTypeEmote, "KEKW", tokenizer.EmoteCache["KEKW"]},
+				{Type: TokenTypeColour, Text: "rainbow", Emote: Emote{}},
+				{Type: TokenTypeEffect, Text: "wave2", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: "KEKW", Emote: emotes["KEKW"]},
 			},
 		},
 		{
 			Name:    "effect:color:emote",
 			Message: "wave2:rainbow:KEKW",
 			Expected: []Token{
-				{TokenTypeEffect, "wave2", Emote{}},
-				{TokenTypeColour, "rainbow", Emote{}},
-				{TokenTypeEmote, "KEKW", tokenizer.EmoteCache["KEKW"]},
+				{Type: TokenTypeEffect, Text: "wave2", Emote: Emote{}},
+				{Type: TokenTypeColour, Text: "rainbow", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: "KEKW", Emote: emotes["KEKW"]},
 			},
 		},
 		{
 			Name:    "effect:color:<WS>emote",
 			Message: "wave2:rainbow:   KEKW",
 			Expected: []Token{
-				{TokenTypeEffect, "wave2", Emote{}},
-				{TokenTypeColour, "rainbow", Emote{}},
-				{TokenTypeEmote, "KEKW", tokenizer.EmoteCache["KEKW"]},
+				{Type: TokenTypeEffect, Text: "wave2", Emote: Emote{}},
+				{Type: TokenTypeColour, Text: "rainbow", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: "KEKW", Emote: emotes["KEKW"]},
 			},
 		},
 		{
 			Name:    "effect:emote:emote",
 			Message: "wave2:KEKW:KEKW",
 			Expected: []Token{
-				{TokenTypeEffect, "wave2", Emote{}},
-				{TokenTypeText, "KEKW:KEKW", Emote{}},
+				{Type: TokenTypeEffect, Text: "wave2", Emote: Emote{}},
+				{Type: TokenTypeText, Text: "KEKW:KEKW", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "leadingSep",
 			Message: ":cyan:text",
 			Expected: []Token{
-				{TokenTypeText, ":cyan:text", Emote{}},
+				{Type: TokenTypeText, Text: ":cyan:text", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "manySep",
 			Message: ":::::::::",
 			Expected: []Token{
-				{TokenTypeText, ":::::::::", Emote{}},
+				{Type: TokenTypeText, Text: ":::::::::", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "effect:manySep",
 			Message: "wave2:::::::::",
 			Expected: []Token{
-				{TokenTypeEffect, "wave2", Emote{}},
-				{TokenTypeText, "::::::::", Emote{}},
+				{Type: TokenTypeEffect, Text: "wave2", Emote: Emote{}},
+				{Type: TokenTypeText, Text: "::::::::", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "semicolons",
 			Message: ":jaja::#:!@#:",
 			Expected: []Token{
-				{TokenTypeText, ":jaja::#:!@#:", Emote{}},
+				{Type: TokenTypeText, Text: ":jaja::#:!@#:", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "semicolonEmpty",
 			Message: ":   ",
 			Expected: []Token{
-				{TokenTypeText, ":", Emote{}},
+				{Type: TokenTypeText, Text: ":   ", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "patternNoOps",
 			Message: "pattern:I am a bumblebee!!!",
 			Expected: []Token{
-				{TokenTypeText, "I am a bumblebee!!!", Emote{}},
+				{Type: TokenTypeText, Text: "pattern:I am a bumblebee!!!", Emote: Emote{}},
 			},
 		},
 		{
-			Name:     "patternEmpty",
-			Message:  "pattern:",
-			Expected: []Token{},
+			Name:    "patternEmpty",
+			Message: "pattern:",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "pattern:", Emote: Emote{}},
+			},
 		},
 		{
 			Name:    "patternMax",
 			Message: "patternq3q3q3q3:I am a bumblebee!!!",
 			Expected: []Token{
-				{TokenTypePattern, "q3q3q3q3", Emote{}},
-				{TokenTypeText, "I am a bumblebee!!!", Emote{}},
+				{Type: TokenTypePattern, Text: "q3q3q3q3", Emote: Emote{}},
+				{Type: TokenTypeText, Text: "I am a bumblebee!!!", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "patternOverMax",
 			Message: "patternq3q3q3q3q:I am a bumblebee!!!",
 			Expected: []Token{
-				{TokenTypeText, "patternq3q3q3q3q:I am a bumblebee!!!", Emote{}},
+				{Type: TokenTypeText, Text: "patternq3q3q3q3q:I am a bumblebee!!!", Emote: Emote{}, Error: "too long"},
+			},
+		},
+		{
+			Name:    "patternNormalized",
+			Message: "patternr1w2:hi",
+			Expected: []Token{
+				{Type: TokenTypePattern, Text: "rw2", Emote: Emote{}},
+				{Type: TokenTypeText, Text: "hi", Emote: Emote{}},
+			},
+		},
+		{
+			Name:    "effect:patternInvalid",
+			Message: "wave:pattern0r:hi",
+			Expected: []Token{
+				{Type: TokenTypeEffect, Text: "wave", Emote: Emote{}},
+				{Type: TokenTypeText, Text: "pattern0r:hi", Emote: Emote{}, Error: "unknown colour"},
+			},
+		},
+		{
+			Name:    "patternProse",
+			Message: "patterned: like a bee",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "patterned: like a bee", Emote: Emote{}},
 			},
 		},
 	}
@@ -202,53 +231,84 @@ func TestTokenizer(t *testing.T) {
 			Expected: []Token{},
 		},
 		{
-			Name:     "ws",
-			Message:  "  \n\t\r",
-			Expected: []Token{},
+			Name:    "ws",
+			Message: "  \n\t\r",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "  \n\t\r", Emote: Emote{}},
+			},
 		},
 		{
 			Name:    "randomWS",
 			Message: "  2[qrp]3-4t[    #(YT$ jd  ",
 			Expected: []Token{
-				{TokenTypeText, "2[qrp]3-4t[ #(YT$ jd", Emote{}},
+				{Type: TokenTypeText, Text: "  2[qrp]3-4t[    #(YT$ jd  ", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "emotesWS",
 			Message: "KEKW KEKW    FeelsGoodMan  !!!",
 			Expected: []Token{
-				{TokenTypeEmote, "KEKW", tokenizer.EmoteCache["KEKW"]},
-				{TokenTypeEmote, "KEKW", tokenizer.EmoteCache["KEKW"]},
-				{TokenTypeEmote, "FeelsGoodMan", tokenizer.EmoteCache["FeelsGoodMan"]},
-				{TokenTypeText, "!!!", Emote{}},
+				{Type: TokenTypeEmote, Text: "KEKW", Emote: emotes["KEKW"]},
+				{Type: TokenTypeText, Text: " ", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: "KEKW", Emote: emotes["KEKW"]},
+				{Type: TokenTypeText, Text: "    ", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: "FeelsGoodMan", Emote: emotes["FeelsGoodMan"]},
+				{Type: TokenTypeText, Text: "  !!!", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "emotesSmashed",
 			Message: "KEKWKEKWFeelsGoodMan!",
 			Expected: []Token{
-				{TokenTypeText, "KEKWKEKWFeelsGoodMan!", Emote{}},
+				{Type: TokenTypeText, Text: "KEKWKEKWFeelsGoodMan!", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "colonNoEffect",
 			Message: "Hey, you guys know about Gunz: The Duel?",
 			Expected: []Token{
-				{TokenTypeText, "Hey, you guys know about Gunz: The Duel?", Emote{}},
+				{Type: TokenTypeText, Text: "Hey, you guys know about Gunz: The Duel?", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "colonEffectTypo",
 			Message: "gren:This is green!",
 			Expected: []Token{
-				{TokenTypeText, "gren:This is green!", Emote{}},
+				{Type: TokenTypeText, Text: "gren:This is green!", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "emoteSolo",
 			Message: "Clap",
 			Expected: []Token{
-				{TokenTypeEmote, "Clap", tokenizer.EmoteCache["Clap"]},
+				{Type: TokenTypeEmote, Text: "Clap", Emote: emotes["Clap"]},
+			},
+		},
+	}
+
+	iterLinkTests := []Test{
+		{
+			Name:    "link",
+			Message: "check https://Example.com/a?b=c out",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "check ", Emote: Emote{}},
+				{Type: TokenTypeLink, Text: "https://Example.com/a?b=c", Emote: Emote{}},
+				{Type: TokenTypeText, Text: " out", Emote: Emote{}},
+			},
+		},
+		{
+			Name:    "linkTrailingPunctuation",
+			Message: "twitch.tv/dayoman!",
+			Expected: []Token{
+				{Type: TokenTypeLink, Text: "twitch.tv/dayoman", Emote: Emote{}},
+				{Type: TokenTypeText, Text: "!", Emote: Emote{}},
+			},
+		},
+		{
+			Name:    "notLink",
+			Message: "e.g. lol.jk",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "e.g. lol.jk", Emote: Emote{}},
 			},
 		},
 	}
@@ -258,55 +318,55 @@ func TestTokenizer(t *testing.T) {
 			Name:    "emote",
 			Message: ":goat-turqouise-white-horns:",
 			Expected: []Token{
-				{TokenTypeEmote, ":goat-turqouise-white-horns:", tokenizer.EmoteCache[":goat-turqouise-white-horns:"]},
+				{Type: TokenTypeEmote, Text: ":goat-turqouise-white-horns:", Emote: emotes[":goat-turqouise-white-horns:"]},
 			},
 		},
 		{
 			Name:    "emoteExtraColon",
 			Message: "::goat-turqouise-white-horns:",
 			Expected: []Token{
-				{TokenTypeText, ":", Emote{}},
-				{TokenTypeEmote, ":goat-turqouise-white-horns:", tokenizer.EmoteCache[":goat-turqouise-white-horns:"]},
+				{Type: TokenTypeText, Text: ":", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: ":goat-turqouise-white-horns:", Emote: emotes[":goat-turqouise-white-horns:"]},
 			},
 		},
 		{
 			Name:    "emoteManyColon",
 			Message: ":::slk:j::goat-turqouise-white-horns::fj::fd:::",
 			Expected: []Token{
-				{TokenTypeText, ":::slk:j:", Emote{}},
-				{TokenTypeEmote, ":goat-turqouise-white-horns:", tokenizer.EmoteCache[":goat-turqouise-white-horns:"]},
-				{TokenTypeText, ":fj::fd:::", Emote{}},
+				{Type: TokenTypeText, Text: ":::slk:j:", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: ":goat-turqouise-white-horns:", Emote: emotes[":goat-turqouise-white-horns:"]},
+				{Type: TokenTypeText, Text: ":fj::fd:::", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "emotes",
 			Message: ":_DayoHog::_DayoHog::_DayoHog:",
 			Expected: []Token{
-				{TokenTypeEmote, ":_DayoHog:", tokenizer.EmoteCache[":_DayoHog:"]},
-				{TokenTypeEmote, ":_DayoHog:", tokenizer.EmoteCache[":_DayoHog:"]},
-				{TokenTypeEmote, ":_DayoHog:", tokenizer.EmoteCache[":_DayoHog:"]},
+				{Type: TokenTypeEmote, Text: ":_DayoHog:", Emote: emotes[":_DayoHog:"]},
+				{Type: TokenTypeEmote, Text: ":_DayoHog:", Emote: emotes[":_DayoHog:"]},
+				{Type: TokenTypeEmote, Text: ":_DayoHog:", Emote: emotes[":_DayoHog:"]},
 			},
 		},
 		{
 			Name:    "effectEmotes",
 			Message: "patternq3q3q3q3:wave2::goat-turqouise-white-horns::_DayoHog:",
 			Expected: []Token{
-				{TokenTypePattern, "q3q3q3q3", Emote{}},
-				{TokenTypeEffect, "wave2", Emote{}},
-				{TokenTypeEmote, ":goat-turqouise-white-horns:", tokenizer.EmoteCache[":goat-turqouise-white-horns:"]},
-				{TokenTypeEmote, ":_DayoHog:", tokenizer.EmoteCache[":_DayoHog:"]},
+				{Type: TokenTypePattern, Text: "q3q3q3q3", Emote: Emote{}},
+				{Type: TokenTypeEffect, Text: "wave2", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: ":goat-turqouise-white-horns:", Emote: emotes[":goat-turqouise-white-horns:"]},
+				{Type: TokenTypeEmote, Text: ":_DayoHog:", Emote: emotes[":_DayoHog:"]},
 			},
 		},
 		{
 			Name:    "effectTextEmotes",
 			Message: "cyan:wave2: Lets Go! :goat-turqouise-white-horns: Woo :_DayoHog:",
 			Expected: []Token{
-				{TokenTypeColour, "cyan", Emote{}},
-				{TokenTypeEffect, "wave2", Emote{}},
-				{TokenTypeText, "Lets Go!", Emote{}},
-				{TokenTypeEmote, ":goat-turqouise-white-horns:", tokenizer.EmoteCache[":goat-turqouise-white-horns:"]},
-				{TokenTypeText, "Woo", Emote{}},
-				{TokenTypeEmote, ":_DayoHog:", tokenizer.EmoteCache[":_DayoHog:"]},
+				{Type: TokenTypeColour, Text: "cyan", Emote: Emote{}},
+				{Type: TokenTypeEffect, Text: "wave2", Emote: Emote{}},
+				{Type: TokenTypeText, Text: "Lets Go! ", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: ":goat-turqouise-white-horns:", Emote: emotes[":goat-turqouise-white-horns:"]},
+				{Type: TokenTypeText, Text: " Woo ", Emote: Emote{}},
+				{Type: TokenTypeEmote, Text: ":_DayoHog:", Emote: emotes[":_DayoHog:"]},
 			},
 		},
 	}
@@ -316,21 +376,121 @@ func TestTokenizer(t *testing.T) {
 			Name:    "emptyCommand",
 			Message: "!  ",
 			Expected: []Token{
-				{TokenTypeText, "!", Emote{}},
+				{Type: TokenTypeText, Text: "!  ", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "invalidCommand",
 			Message: "!anInvalidCommand",
 			Expected: []Token{
-				{TokenTypeText, "!anInvalidCommand", Emote{}},
+				{Type: TokenTypeText, Text: "!anInvalidCommand", Emote: Emote{}},
 			},
 		},
 		{
 			Name:    "colorCommand",
 			Message: "!color purple",
 			Expected: []Token{
-				{TokenTypeCommand, "color purple", Emote{}},
+				{Type: TokenTypeCommand, Text: "color purple", Emote: Emote{}},
+			},
+		},
+		{
+			Name:    "aliasCommand",
+			Message: "!colour purple",
+			Expected: []Token{
+				{Type: TokenTypeCommand, Text: "color purple", Emote: Emote{}},
+			},
+		},
+	}
+
+	iterSpanTests := []Test{
+		{
+			Name:    "span",
+			Message: "hi wave:[all of this] KEKW",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "hi "},
+				{Type: TokenTypeSpanStart, Text: "wave"},
+				{Type: TokenTypeText, Text: "all of this"},
+				{Type: TokenTypeSpanEnd, Text: "wave"},
+				{Type: TokenTypeText, Text: " "},
+				{Type: TokenTypeEmote, Text: "KEKW", Emote: Emote{ID: "3", Name: "KEKW"}},
+			},
+		},
+		{
+			Name:    "spanFirstWord",
+			Message: "red:wave:[both Clap] after",
+			Expected: []Token{
+				{Type: TokenTypeSpanStart, Text: "red"},
+				{Type: TokenTypeSpanStart, Text: "wave"},
+				{Type: TokenTypeText, Text: "both "},
+				{Type: TokenTypeEmote, Text: "Clap", Emote: Emote{ID: "1", Name: "Clap"}},
+				{Type: TokenTypeSpanEnd, Text: "wave"},
+				{Type: TokenTypeSpanEnd, Text: "red"},
+				{Type: TokenTypeText, Text: " after"},
+			},
+		},
+		{
+			Name:    "spanNested",
+			Message: "wave:[a red:[b] c]",
+			Expected: []Token{
+				{Type: TokenTypeSpanStart, Text: "wave"},
+				{Type: TokenTypeText, Text: "a "},
+				{Type: TokenTypeSpanStart, Text: "red"},
+				{Type: TokenTypeText, Text: "b"},
+				{Type: TokenTypeSpanEnd, Text: "red"},
+				{Type: TokenTypeText, Text: " c"},
+				{Type: TokenTypeSpanEnd, Text: "wave"},
+			},
+		},
+		{
+			Name:    "spanTooDeep",
+			Message: "wave:[a red:[b cyan:[c]]]",
+			Expected: []Token{
+				{Type: TokenTypeSpanStart, Text: "wave"},
+				{Type: TokenTypeText, Text: "a "},
+				{Type: TokenTypeSpanStart, Text: "red"},
+				{Type: TokenTypeText, Text: "b cyan:[c]"},
+				{Type: TokenTypeSpanEnd, Text: "red"},
+				{Type: TokenTypeSpanEnd, Text: "wave"},
+			},
+		},
+		{
+			Name:    "spanBrackets",
+			Message: "wave:[[x] y]",
+			Expected: []Token{
+				{Type: TokenTypeSpanStart, Text: "wave"},
+				{Type: TokenTypeText, Text: "[x] y"},
+				{Type: TokenTypeSpanEnd, Text: "wave"},
+			},
+		},
+		{
+			Name:    "spanUnterminated",
+			Message: "say wave:[never closed",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "say wave:[never closed"},
+			},
+		},
+		{
+			Name:    "spanUnterminatedFirstWord",
+			Message: "wave:[never closed",
+			Expected: []Token{
+				{Type: TokenTypeEffect, Text: "wave"},
+				{Type: TokenTypeText, Text: "[never closed"},
+			},
+		},
+		{
+			Name:    "spanUnknownEffect",
+			Message: "so wobble:[this] is text",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "so wobble:[this] is text"},
+			},
+		},
+		{
+			Name:    "spanPattern",
+			Message: "patternrw:[hey there]",
+			Expected: []Token{
+				{Type: TokenTypeSpanStart, Text: "rw"},
+				{Type: TokenTypeText, Text: "hey there"},
+				{Type: TokenTypeSpanEnd, Text: "rw"},
 			},
 		},
 	}
@@ -340,12 +500,26 @@ func TestTokenizer(t *testing.T) {
 		i := 0
 		fail := false
 		tokens := []Token{}
+		var rebuilt strings.Builder
 		for tok := range iterator {
+			// Source ranges must tile the message
+			if tok.Start != rebuilt.Len() || tok.End < tok.Start || tok.End > len(test.Message) {
+				t.Fatalf("Bad range [%d, %d) after %d bytes: %v", tok.Start, tok.End, rebuilt.Len(), tok)
+			}
+			rebuilt.WriteString(test.Message[tok.Start:tok.End])
+			if tok.RuneStart != utf8.RuneCountInString(test.Message[:tok.Start]) ||
+				tok.RuneEnd != utf8.RuneCountInString(test.Message[:tok.End]) {
+				t.Errorf("Bad rune range [%d, %d): %v", tok.RuneStart, tok.RuneEnd, tok)
+			}
+			if i >= len(test.Expected) {
+				t.Fatalf("\n\nMessage:  [ %s ]\nExpected: %v\nGot:      %v\n\n", test.Message, test.Expected, append(tokens, tok))
+			}
 			expected := test.Expected[i]
 			if (tok.Text != expected.Text) ||
 				(tok.Type != expected.Type) ||
 				(tok.Emote.ID != expected.Emote.ID) ||
 				(tok.Emote.Name != expected.Emote.Name) ||
+				((tok.Error != "") != (expected.Error != "")) ||
 				len(tok.Emote.Locations) != len(expected.Emote.Locations) {
 				fail = true
 			}
@@ -359,6 +533,12 @@ func TestTokenizer(t *testing.T) {
 			tokens = append(tokens, tok)
 			i++
 		}
+		if rebuilt.String() != test.Message {
+			t.Errorf("Rebuilt [ %q ] from tokens of [ %q ]", rebuilt.String(), test.Message)
+		}
+		if i != len(test.Expected) {
+			fail = true
+		}
 		if fail {
 			t.Logf("\n\nMessage:  [ %s ]\nExpected: %v\nGot:      %v\n\n", test.Message, test.Expected, tokens)
 			t.Fail()
@@ -375,11 +555,21 @@ func TestTokenizer(t *testing.T) {
 			RunIterTest(t, tokenizer.Iter(test.Message), test)
 		})
 	}
+	for _, test := range iterLinkTests {
+		t.Run("Iter-"+test.Name, func(t *testing.T) {
+			RunIterTest(t, tokenizer.Iter(test.Message), test)
+		})
+	}
 	for _, test := range iterYouTubeTests {
 		t.Run("Iter-"+test.Name, func(t *testing.T) {
 			RunIterTest(t, tokenizer.Iter(test.Message), test)
 		})
 	}
+	for _, test := range iterSpanTests {
+		t.Run("Iter-"+test.Name, func(t *testing.T) {
+			RunIterTest(t, tokenizer.Iter(test.Message), test)
+		})
+	}
 	for _, test := range iterCommandTests {
 		t.Run("Iter-"+test.Name, func(t *testing.T) {
 			RunIterTest(t, tokenizer.Iter(test.Message), test)
@@ -387,6 +577,423 @@ func TestTokenizer(t *testing.T) {
 	}
 }
 
+func TestTokenOffsets(t *testing.T) {
+	tokenizer := Tokenizer{
+		Emotes: NewEmoteRegistry(map[string]Emote{
+			"KEKW":       {ID: "3", Name: "KEKW"},
+			":_DayoHog:": {ID: "6", Name: ":_DayoHog:"},
+		}),
+		TextEffectSep:     ':',
+		TextCommandPrefix: '!',
+	}
+	message := " cyan:  héllo  KEKW\n\twörld:_DayoHog: "
+	expected := []Token{
+		{Type: TokenTypeColour, Text: "cyan", Start: 0, End: 8, RuneStart: 0, RuneEnd: 8},
+		{Type: TokenTypeText, Text: "héllo  ", Start: 8, End: 16, RuneStart: 8, RuneEnd: 15},
+		{Type: TokenTypeEmote, Text: "KEKW", Start: 16, End: 20, RuneStart: 15, RuneEnd: 19},
+		{Type: TokenTypeText, Text: "\n\twörld", Start: 20, End: 28, RuneStart: 19, RuneEnd: 26},
+		{Type: TokenTypeEmote, Text: ":_DayoHog:", Start: 28, End: 38, RuneStart: 26, RuneEnd: 36},
+		{Type: TokenTypeText, Text: " ", Start: 38, End: 39, RuneStart: 36, RuneEnd: 37},
+	}
+
+	i := 0
+	for tok := range tokenizer.Iter(message) {
+		if i >= len(expected) {
+			t.Fatalf("Unexpected token: %v", tok)
+		}
+		e := expected[i]
+		if tok.Type != e.Type || tok.Text != e.Text ||
+			tok.Start != e.Start || tok.End != e.End ||
+			tok.RuneStart != e.RuneStart || tok.RuneEnd != e.RuneEnd {
+			t.Errorf("\nExpected: %v\nGot:      %v", e, tok)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("Expected %d tokens, got %d", len(expected), i)
+	}
+}
+
+func TestSpanLimits(t *testing.T) {
+	tokenizer := Tokenizer{
+		TextEffectSep:     ':',
+		TextCommandPrefix: '!',
+		MaxSpanLen:        5,
+		MaxSpans:          1,
+	}
+	message := "wave:[short] wave:[again] red:[too long]"
+	expected := []string{
+		TokenTypeSpanStart, TokenTypeText, TokenTypeSpanEnd, TokenTypeText,
+	}
+
+	var got []string
+	depths := []int{}
+	for tok := range tokenizer.Iter(message) {
+		got = append(got, tok.Type)
+		if tok.Span != nil {
+			depths = append(depths, tok.Span.Depth)
+		}
+	}
+	if !slices.Equal(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if !slices.Equal(depths, []int{1, 1}) {
+		t.Errorf("Expected span depths [1 1], got %v", depths)
+	}
+}
+
+func TestParseLink(t *testing.T) {
+	tests := []struct {
+		Word     string
+		Expected Link
+		N        int
+	}{
+		{"HTTPS://WWW.Example.com:443/Path#frag", Link{URL: "https://www.example.com/Path", Domain: "example.com", Display: "www.example.com/Path"}, 37},
+		{"www.youtube.com/watch?v=abc).", Link{URL: "https://www.youtube.com/watch?v=abc", Domain: "youtube.com", Display: "www.youtube.com/watch"}, 27},
+		{"7tv.app", Link{URL: "https://7tv.app", Domain: "7tv.app", Display: "7tv.app"}, 7},
+	}
+	for _, test := range tests {
+		link, n, ok := ParseLink(test.Word)
+		if !ok || link != test.Expected || n != test.N {
+			t.Errorf("\nWord:     %s\nExpected: %v %d\nGot:      %v %d %v", test.Word, test.Expected, test.N, link, n, ok)
+		}
+	}
+	for _, word := range []string{"hello", "a.b", "https://", "file.txt", ":_DayoHog:"} {
+		if link, _, ok := ParseLink(word); ok {
+			t.Errorf("Not a link: %s -> %v", word, link)
+		}
+	}
+}
+
+func TestLinkPolicyMask(t *testing.T) {
+	tokenizer := Tokenizer{TextEffectSep: ':', TextCommandPrefix: '!'}
+	lp := LinkPolicy{
+		Mode:           LinkPolicyMask,
+		AllowedDomains: map[string]struct{}{"twitch.tv": {}},
+	}
+	m := Message{Message: "see bad.com and www.twitch.tv/x ok"}
+	for tok := range tokenizer.Iter(m.Message) {
+		m.Tokens = append(m.Tokens, tok)
+	}
+	m, ok := lp.Apply(m)
+	if !ok {
+		t.Fatal("Masked message should be published")
+	}
+	if m.Message != "see [link removed] and www.twitch.tv/x ok" {
+		t.Errorf("Unexpected masked message: %s", m.Message)
+	}
+	for _, tok := range m.Tokens {
+		if tok.Type != TokenTypeLink && m.Message[tok.Start:tok.End] != tok.Text {
+			t.Errorf("Token range out of sync: %v", tok)
+		}
+	}
+
+	// Links in command arguments are masked before the command runs
+	tokenizer.Commands = DefaultCommands()
+	cmd := Message{Message: "!help bad.com/x, twitch.tv"}
+	for tok := range tokenizer.Iter(cmd.Message) {
+		cmd.Tokens = append(cmd.Tokens, tok)
+	}
+	cmd, ok = lp.Apply(cmd)
+	if !ok || cmd.Message != "!help [link removed], twitch.tv" || cmd.Tokens[0].Text != "help [link removed], twitch.tv" {
+		t.Errorf("Unexpected masked command: %q %+v", cmd.Message, cmd.Tokens)
+	}
+
+	lp.Mode = LinkPolicyApproval
+	if _, ok := lp.Apply(Message{Tokens: []Token{{Type: TokenTypeLink, Link: &Link{Domain: "bad.com"}}}}); ok {
+		t.Error("Message with blocked link should be held")
+	}
+	if _, ok := lp.Apply(Message{Tokens: []Token{{Type: TokenTypeCommand, Text: "addquote see bad.com"}}}); ok {
+		t.Error("Command with blocked link should be held")
+	}
+}
+
+func TestMentions(t *testing.T) {
+	tokenizer := Tokenizer{
+		Authors:           NewAuthorCache(),
+		TextEffectSep:     ':',
+		TextCommandPrefix: '!',
+	}
+	tokenizer.Authors.Seen("Dayoman", "Twitch", "#FF0000")
+
+	var toks []Token
+	for tok := range tokenizer.Iter("hi @dayoman, @someone and a@b @") {
+		toks = append(toks, tok)
+	}
+	expected := []Token{
+		{Type: TokenTypeText, Text: "hi "},
+		{Type: TokenTypeMention, Text: "@dayoman", Mention: &Mention{Name: "Dayoman", Source: "Twitch", Colour: "#FF0000", Resolved: true}},
+		{Type: TokenTypeText, Text: ", "},
+		{Type: TokenTypeMention, Text: "@someone", Mention: &Mention{Name: "someone"}},
+		{Type: TokenTypeText, Text: " and a@b @"},
+	}
+	if len(toks) != len(expected) {
+		t.Fatalf("Expected %v\nGot %v", expected, toks)
+	}
+	for i, tok := range toks {
+		e := expected[i]
+		if tok.Type != e.Type || tok.Text != e.Text {
+			t.Errorf("\nExpected: %v\nGot:      %v", e, tok)
+		}
+		if e.Mention != nil && (tok.Mention == nil || *tok.Mention != *e.Mention) {
+			t.Errorf("\nExpected mention: %v\nGot:              %v", e.Mention, tok.Mention)
+		}
+	}
+
+	m := Message{Tokens: toks}
+	if !m.MentionsUser("DAYOMAN") || m.MentionsUser("hp_az") {
+		t.Error("MentionsUser mismatch")
+	}
+}
+
+func TestNativeEmotes(t *testing.T) {
+	emotes := map[string]Emote{
+		"KEKW": {ID: "3", Name: "KEKW"},
+	}
+	tokenizer := Tokenizer{
+		Emotes:            NewEmoteRegistry(emotes),
+		TextEffectSep:     ':',
+		TextCommandPrefix: '!',
+	}
+	lul := Emote{ID: "425618", Name: "LUL", Locations: []string{"2-4", "10-12", "100-102", "3-5"}}
+	hog := Emote{ID: "yt1", Name: ":_hog:"}
+	smile := Emote{ID: "1", Name: "\\:-?\\)", Locations: []string{"14-15"}}
+
+	type Test struct {
+		Name     string
+		Message  string
+		Emotes   []Emote
+		Expected []Token
+	}
+	tests := []Test{
+		{
+			Name:    "byPosition",
+			Message: "é LUL LUL LUL :) KEKW",
+			Emotes:  []Emote{lul, smile},
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "é "},
+				{Type: TokenTypeEmote, Text: "LUL", Emote: lul},
+				{Type: TokenTypeText, Text: " LUL "},
+				{Type: TokenTypeEmote, Text: "LUL", Emote: lul},
+				{Type: TokenTypeText, Text: " "},
+				{Type: TokenTypeEmote, Text: ":)", Emote: smile},
+				{Type: TokenTypeText, Text: " "},
+				{Type: TokenTypeEmote, Text: "KEKW", Emote: emotes["KEKW"]},
+			},
+		},
+		{
+			Name:    "noLeak",
+			Message: "LUL :_hog:",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "LUL :_hog:"},
+			},
+		},
+		{
+			Name:    "byNameWithoutLocations",
+			Message: "hi:_hog::_hog:",
+			Emotes:  []Emote{hog},
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "hi"},
+				{Type: TokenTypeEmote, Text: ":_hog:", Emote: hog},
+				{Type: TokenTypeEmote, Text: ":_hog:", Emote: hog},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run("IterEmotes-"+test.Name, func(t *testing.T) {
+			var toks []Token
+			for tok := range tokenizer.IterEmotes(test.Message, test.Emotes) {
+				toks = append(toks, tok)
+			}
+			if len(toks) != len(test.Expected) {
+				t.Fatalf("\nExpected: %v\nGot:      %v", test.Expected, toks)
+			}
+			for i, tok := range toks {
+				e := test.Expected[i]
+				if tok.Type != e.Type || tok.Text != e.Text || tok.Emote.ID != e.Emote.ID {
+					t.Errorf("\nExpected: %v\nGot:      %v", e, tok)
+				}
+			}
+		})
+	}
+}
+
+func TestZeroWidthEmotes(t *testing.T) {
+	tokenizer := Tokenizer{
+		Emotes: NewEmoteRegistry(map[string]Emote{
+			"KEKW":    {ID: "3", Name: "KEKW"},
+			"SoSnowy": {ID: "z1", Name: "SoSnowy", ZeroWidth: true},
+			"IceCold": {ID: "z2", Name: "IceCold", ZeroWidth: true},
+		}),
+		TextEffectSep:     ':',
+		TextCommandPrefix: '!',
+	}
+	message := "KEKW SoSnowy  IceCold hi SoSnowy KEKW wow IceCold"
+	type Expected struct {
+		Type     string
+		Text     string
+		Overlays []string
+		Start    int
+		End      int
+	}
+	expected := []Expected{
+		{TokenTypeEmote, "KEKW", []string{"SoSnowy", "IceCold"}, 0, 21},
+		{TokenTypeText, " hi ", nil, 21, 25},
+		{TokenTypeEmote, "SoSnowy", nil, 25, 32},
+		{TokenTypeText, " ", nil, 32, 33},
+		{TokenTypeEmote, "KEKW", nil, 33, 37},
+		{TokenTypeText, " wow ", nil, 37, 42},
+		{TokenTypeEmote, "IceCold", nil, 42, 49},
+	}
+
+	i := 0
+	for tok := range tokenizer.Iter(message) {
+		if i >= len(expected) {
+			t.Fatalf("Unexpected token: %v", tok)
+		}
+		e := expected[i]
+		overlays := []string{}
+		for _, o := range tok.Overlays {
+			overlays = append(overlays, o.Name)
+		}
+		if tok.Type != e.Type || tok.Text != e.Text || tok.Start != e.Start || tok.End != e.End ||
+			!slices.Equal(overlays, e.Overlays) {
+			t.Errorf("\nExpected: %v\nGot:      %v %v", e, tok, overlays)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("Expected %d tokens, got %d", len(expected), i)
+	}
+}
+
+func TestEmoji(t *testing.T) {
+	tokenizer := Tokenizer{
+		Emotes: NewEmoteRegistry(map[string]Emote{
+			":fire:": {ID: "yt", Name: ":fire:"},
+		}),
+		TextEffectSep:     ':',
+		TextCommandPrefix: '!',
+		EmojiURLTemplate:  "https://emoji.test/{codepoints}.svg",
+	}
+	type Test struct {
+		Name       string
+		Message    string
+		Expected   []Token
+		Codepoints []string
+	}
+	tests := []Test{
+		{
+			Name:    "adjacent",
+			Message: "lol😂😂",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "lol"},
+				{Type: TokenTypeEmoji, Text: "😂"},
+				{Type: TokenTypeEmoji, Text: "😂"},
+			},
+			Codepoints: []string{"1f602", "1f602"},
+		},
+		{
+			Name:    "skinToneZWJ",
+			Message: "👍🏽 👩🏻‍💻 ❤️ ♥ 123",
+			Expected: []Token{
+				{Type: TokenTypeEmoji, Text: "👍🏽"},
+				{Type: TokenTypeText, Text: " "},
+				{Type: TokenTypeEmoji, Text: "👩🏻‍💻"},
+				{Type: TokenTypeText, Text: " "},
+				{Type: TokenTypeEmoji, Text: "❤️"},
+				{Type: TokenTypeText, Text: " ♥ 123"},
+			},
+			Codepoints: []string{"1f44d-1f3fd", "1f469-1f3fb-200d-1f4bb", "2764"},
+		},
+		{
+			Name:    "flagsKeycap",
+			Message: "🇯🇵🇺🇸 1️⃣ 🏴󠁧󠁢󠁳󠁣󠁴󠁿",
+			Expected: []Token{
+				{Type: TokenTypeEmoji, Text: "🇯🇵"},
+				{Type: TokenTypeEmoji, Text: "🇺🇸"},
+				{Type: TokenTypeText, Text: " "},
+				{Type: TokenTypeEmoji, Text: "1️⃣"},
+				{Type: TokenTypeText, Text: " "},
+				{Type: TokenTypeEmoji, Text: "🏴󠁧󠁢󠁳󠁣󠁴󠁿"},
+			},
+			Codepoints: []string{"1f1ef-1f1f5", "1f1fa-1f1f8", "31-20e3", "1f3f4-e0067-e0062-e0073-e0063-e0074-e007f"},
+		},
+		{
+			Name:    "shortcodes",
+			Message: "gg :thumbsup::fire: :notacode:",
+			Expected: []Token{
+				{Type: TokenTypeText, Text: "gg "},
+				{Type: TokenTypeEmoji, Text: ":thumbsup:"},
+				{Type: TokenTypeEmote, Text: ":fire:"},
+				{Type: TokenTypeText, Text: " :notacode:"},
+			},
+			Codepoints: []string{"1f44d"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run("Emoji-"+test.Name, func(t *testing.T) {
+			var toks []Token
+			var codepoints []string
+			for tok := range tokenizer.Iter(test.Message) {
+				toks = append(toks, tok)
+				if tok.Type == TokenTypeEmoji {
+					codepoints = append(codepoints, tok.Emoji.Codepoints)
+					if tok.Emoji.URL != "https://emoji.test/"+tok.Emoji.Codepoints+".svg" {
+						t.Errorf("Bad URL: %s", tok.Emoji.URL)
+					}
+				}
+			}
+			if len(toks) != len(test.Expected) {
+				t.Fatalf("\nExpected: %v\nGot:      %v", test.Expected, toks)
+			}
+			for i, tok := range toks {
+				if tok.Type != test.Expected[i].Type || tok.Text != test.Expected[i].Text {
+					t.Errorf("\nExpected: %v\nGot:      %v", test.Expected[i], tok)
+				}
+			}
+			if strings.Join(codepoints, " ") != strings.Join(test.Codepoints, " ") {
+				t.Errorf("\nExpected codepoints: %v\nGot:                 %v", test.Codepoints, codepoints)
+			}
+		})
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	pattern, err := ParsePattern("q3r9w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PatternOp{
+		{Code: "q", Colour: PatternPalette['q'], Width: 3},
+		{Code: "r", Colour: PatternPalette['r'], Width: 9},
+		{Code: "w", Colour: PatternPalette['w'], Width: 1},
+	}
+	if len(pattern.Ops) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, pattern.Ops)
+	}
+	for i, op := range pattern.Ops {
+		if op != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], op)
+		}
+	}
+	if pattern.String() != "q3r9w" {
+		t.Errorf("Expected normalized q3r9w, got %s", pattern.String())
+	}
+
+	for _, ops := range []string{"", "3q", "q0", "qz", "Q", "q1q1q1q1q"} {
+		if _, err := ParsePattern(ops); err == nil {
+			t.Errorf("Expected error for %q", ops)
+		}
+	}
+
+	if help := PatternHelp(); !strings.HasSuffix(help, "Colours: b c e g k l o p q r s t v w y") {
+		t.Errorf("Expected colours in order, got %q", help)
+	}
+}
+
 func TestScanColon(t *testing.T) {
 	type Test struct {
 		Name     string
@@ -449,3 +1056,119 @@ func TestScanColon(t *testing.T) {
 		})
 	}
 }
+
+func TestEffectErrorsInProse(t *testing.T) {
+	tokenizer := Tokenizer{TextEffectSep: ':', TextCommandPrefix: '!'}
+	errors := func(s string) []string {
+		var errs []string
+		for tok := range tokenizer.Iter(s) {
+			if tok.Error != "" {
+				errs = append(errs, tok.Error)
+			}
+		}
+		return errs
+	}
+
+	for _, s := range []string{
+		"hello patternzz:foo world",
+		"note:this time:12",
+		"it is patternzz:[unclosed",
+		"hello patternzz: foo",
+		"patterning:[the bee]",
+		"patterned: stripes",
+	} {
+		if errs := errors(s); len(errs) != 0 {
+			t.Errorf("%q: expected no errors, got %q", s, errs)
+		}
+	}
+	if errs := errors("hello pattern0r:[foo]"); len(errs) != 1 || !strings.HasPrefix(errs[0], `invalid pattern "0r"`) || !strings.Contains(errs[0], PatternHelp()) {
+		t.Errorf("Expected invalid pattern span, got %q", errs)
+	}
+}
+
+func TestEffectRoles(t *testing.T) {
+	tokenizer := Tokenizer{
+		TextEffectSep:     ':',
+		TextCommandPrefix: '!',
+		EffectRoles:       map[string]Role{"rainbow": RoleSubscriber, "pattern": RoleModerator},
+	}
+	iter := func(s string, role Role) []Token {
+		var toks []Token
+		for tok := range tokenizer.IterMessage(Message{Message: s, Role: role}, "") {
+			toks = append(toks, tok)
+		}
+		return toks
+	}
+
+	toks := iter("rainbow:hi", RoleViewer)
+	if len(toks) != 1 || toks[0].Type != TokenTypeText || toks[0].Error != "rainbow requires the subscriber role" {
+		t.Errorf("Expected refused effect, got %+v", toks)
+	}
+	if toks := iter("rainbow:hi", RoleVIP); toks[0].Type != TokenTypeColour {
+		t.Errorf("Expected effect, got %+v", toks)
+	}
+	if toks := iter("wave:[hi]", RoleViewer); toks[0].Type != TokenTypeSpanStart {
+		t.Errorf("Expected unrestricted span, got %+v", toks)
+	}
+	if toks := iter("patternr1w2:[hi]", RoleVIP); toks[0].Type != TokenTypeText || toks[0].Error != "pattern requires the moderator role" {
+		t.Errorf("Expected refused pattern span, got %+v", toks)
+	}
+
+	// Restricted effects in prose are not applied, so they are not refused
+	for _, toks := range [][]Token{iter("I said rainbow:foo earlier", RoleViewer), iter("ok rainbow:[unclosed", RoleViewer)} {
+		for _, tok := range toks {
+			if tok.Error != "" {
+				t.Errorf("Expected no error, got %+v", toks)
+			}
+		}
+	}
+	if toks := iter("look rainbow:[here]", RoleViewer); toks[0].Error != "rainbow requires the subscriber role" {
+		t.Errorf("Expected refused span, got %+v", toks)
+	}
+}
+
+func TestRoleFromBadges(t *testing.T) {
+	tests := []struct {
+		Source   string
+		Badges   []Badge
+		Expected Role
+	}{
+		{"Twitch", nil, RoleViewer},
+		{"Twitch", []Badge{{Name: "subscriber", Title: "6-Month Subscriber"}, {Name: "vip", Title: "VIP"}}, RoleVIP},
+		{"Twitch", []Badge{{Name: "broadcaster", Title: "Broadcaster"}}, RoleBroadcaster},
+		{"Twitch", []Badge{{Name: "partner", Title: "Channel Owner Moderator"}}, RoleViewer},
+		{"YouTube", []Badge{{Title: "Member (2 months)"}}, RoleSubscriber},
+		{"YouTube", []Badge{{Title: "Verified"}, {Title: "Moderator"}}, RoleModerator},
+		{"YouTube", []Badge{{Title: "Owner"}}, RoleBroadcaster},
+		{"YouTube", []Badge{{Name: "moderator"}}, RoleViewer},
+	}
+	for _, test := range tests {
+		if got := RoleFromBadges(test.Source, test.Badges); got != test.Expected {
+			t.Errorf("%s %+v: expected %s, got %s", test.Source, test.Badges, test.Expected, got)
+		}
+	}
+}
+
+func TestMessageRole(t *testing.T) {
+	t.Setenv("WS_MOD_USERS", "")
+	if got := messageRole(Message{Author: "", Source: "YouTube"}); got != RoleViewer {
+		t.Errorf("Expected empty names not to match an empty list, got %s", got)
+	}
+
+	t.Setenv("WS_MOD_USERS", "Dayoman, ,")
+	tests := []struct {
+		Author   string
+		Source   string
+		Expected Role
+	}{
+		{"dayoman", "Twitch", RoleModerator},
+		{"Dayoman", "YouTube", RoleViewer},
+		{"", "Twitch", RoleViewer},
+		{"someone", "Twitch", RoleViewer},
+	}
+	for _, test := range tests {
+		if got := messageRole(Message{Author: test.Author, Source: test.Source}); got != test.Expected {
+			t.Errorf("%q on %s: expected %s, got %s", test.Author, test.Source, test.Expected, got)
+		}
+	}
+}
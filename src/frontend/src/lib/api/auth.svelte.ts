@@ -38,6 +38,27 @@ export function checkLoginStatus() {
     });
 }
 
+// Fetches a token for /ws/chat, required when the server sets
+// WS_REQUIRE_TOKEN. Resolves to null without a session.
+export async function fetchStreamToken(): Promise<string | null> {
+  try {
+    const response = await fetch(buildApiUrl('/ws/token'), {
+      method: 'POST',
+      credentials: 'include',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ scope: 'public' })
+    });
+    if (!response.ok) {
+      return null;
+    }
+    const data = await response.json();
+    return data.token ?? null;
+  } catch (error) {
+    console.error('Error fetching stream token:', error);
+    return null;
+  }
+}
+
 export function redirectToTwitchLogin() {
   window.location.href = buildApiUrl('/login/twitch');
 }
@@ -3,6 +3,9 @@ interface Image {
   url: string;
   width: number;
   height: number;
+  scale?: string;
+  format?: string;
+  animated?: boolean;
 }
 
 interface Badge {
@@ -18,6 +21,8 @@ export interface Emote {
   name: string;
   images: Image[];
   locations: unknown; // TODO: determine the correct type for this
+  provider?: string;
+  zeroWidth?: boolean;
 }
 
 export const enum FragmentType {
@@ -25,13 +30,73 @@ export const enum FragmentType {
   Emote = 'emote',
   Colour = 'colour',
   Effect = 'effect',
-  Pattern = 'pattern'
+  Pattern = 'pattern',
+  Link = 'link',
+  Mention = 'mention',
+  Emoji = 'emoji',
+  SpanStart = 'span_start',
+  SpanEnd = 'span_end'
+}
+
+export interface Span {
+  kind: 'colour' | 'effect' | 'pattern';
+  depth: number;
+}
+
+export interface PatternOp {
+  code: string;
+  colour: string;
+  width: number;
+}
+
+export interface Pattern {
+  ops: PatternOp[];
+}
+
+export interface Emoji {
+  codepoints: string;
+  shortcode?: string;
+  url: string;
+}
+
+export interface Mention {
+  name: string;
+  source: string;
+  colour: string;
+  resolved: boolean;
+}
+
+export interface Link {
+  url: string;
+  domain: string;
+  display: string;
+  masked: boolean;
 }
 
 export interface Fragment {
   type: FragmentType;
   text: string;
   emote: Emote | null;
+  link?: Link;
+  mention?: Mention;
+  emoji?: Emoji;
+  pattern?: Pattern;
+  span?: Span;
+  // Zero-width emotes drawn over this emote
+  overlays?: Emote[];
+  error?: string;
+  // Source range in the original message (end exclusive)
+  start?: number;
+  end?: number;
+  runeStart?: number;
+  runeEnd?: number;
+}
+
+// Username colour chosen with !color. More than one stop is a gradient.
+export interface ColourPreference {
+  stops: string[];
+  angle?: number;
+  adjusted?: boolean;
 }
 
 export interface Message {
@@ -42,6 +107,9 @@ export interface Message {
   fragments: Fragment[];
   emotes: Emote[];
   source: 'YouTube' | 'Twitch';
+  colourPreference?: ColourPreference;
+  role?: 'viewer' | 'subscriber' | 'vip' | 'moderator' | 'broadcaster';
+  mentionsMe?: boolean;
 }
 
 export interface Keymods {
@@ -1,5 +1,5 @@
 import { TextEffect } from '$lib/types/effects';
-import { FragmentType, type Emote, type Fragment } from '$lib/types/messages';
+import { FragmentType, type Emote, type Fragment, type Pattern } from '$lib/types/messages';
 import { buildApiUrl } from './misc';
 
 export const validNameColors = new Map<string, string>([
@@ -36,13 +36,84 @@ export function imageFromEmote(emote: Emote): HTMLImageElement {
   return emoteImg;
 }
 
+// Renders an emote with any zero-width overlays stacked on top of it
+export function emoteHTML(emote: Emote, overlays?: Emote[]): string {
+  const base = imageFromEmote(emote).outerHTML;
+  if (!overlays || overlays.length === 0) {
+    return base;
+  }
+  const stacked = overlays.map((overlay) => {
+    const img = imageFromEmote(overlay);
+    img.classList.add('emote-overlay');
+    return img.outerHTML;
+  });
+  return `<span class="emote-stack">${base}${stacked.join('')}</span>`;
+}
+
 function* fragmentGenerator(fragments: Fragment[]): Generator<Fragment, Fragment, boolean> {
   for (const fragment of fragments) {
+    // Emoji render as images the same way emotes do
+    if (fragment.type === FragmentType.Emoji && fragment.emoji) {
+      yield {
+        type: FragmentType.Emote,
+        text: fragment.text,
+        emote: {
+          id: fragment.emoji.codepoints,
+          name: fragment.text,
+          images: [{ id: fragment.emoji.codepoints, url: fragment.emoji.url, width: 72, height: 72 }],
+          locations: []
+        }
+      };
+      continue;
+    }
     yield fragment;
   }
   return { type: FragmentType.Text, text: '', emote: null };
 }
 
+// Effects which animate or colour each character separately
+function isCharEffect(effect: string): boolean {
+  switch (effect) {
+    case TextEffect.Wave:
+    case TextEffect.Wave2:
+    case TextEffect.Shake:
+    case TextEffect.Cheddar:
+      return true;
+    default:
+      return false;
+  }
+}
+
+// Colours of a pattern, one per character, and the next one to use
+interface PatternState {
+  colours: string[];
+  next: number;
+}
+
+function patternState(pattern: Pattern): PatternState {
+  const colours = pattern.ops.flatMap((op) =>
+    /^#[0-9a-f]{6}$/i.test(op.colour) ? Array<string>(op.width).fill(op.colour) : []
+  );
+  return { colours, next: 0 };
+}
+
+// Colours each character in turn, continuing where the pattern left off.
+// Spaces do not use a colour.
+function patternChars(text: string, state: PatternState): string {
+  if (state.colours.length === 0) {
+    return sanitizeMessage(text);
+  }
+  return Array.from(text)
+    .map((c) => {
+      if (c === ' ') {
+        return '&nbsp';
+      }
+      const colour = state.colours[state.next++ % state.colours.length];
+      return `<span style="color: ${colour}">${sanitizeMessage(c)}</span>`;
+    })
+    .join('');
+}
+
 // Formats message fragments into HTML and returns style classes.
 // Parses chat effects with recursive descent following the OSRS wiki spec.
 export function formatMessageFragments(fragments: Fragment[]): {
@@ -53,6 +124,58 @@ export function formatMessageFragments(fragments: Fragment[]): {
   const messageList: string[] = [];
   const fragmentGen = fragmentGenerator(fragments);
 
+  // Number of open spans with effects that require wrapping characters
+  let charSpans = 0;
+
+  // Patterns in effect, innermost last
+  const patterns: PatternState[] = [];
+
+  function wrapChars(text: string): string {
+    return sanitizeMessage(text)
+      .split('')
+      .map((c) => (c === ' ' ? '&nbsp' : `<span>${c}</span>`))
+      .join('');
+  }
+
+  // Renders text in the innermost pattern, or wrapping each character if
+  // an effect needs it
+  function renderText(text: string, wrap: boolean): string {
+    if (patterns.length > 0) {
+      return patternChars(text, patterns[patterns.length - 1]);
+    }
+    return wrap ? wrapChars(text) : sanitizeMessage(text);
+  }
+
+  // Rule for handling multi-word effect spans, returns false for other fragments
+  function handleSpan(fragment: Fragment): boolean {
+    if (fragment.type !== FragmentType.SpanStart && fragment.type !== FragmentType.SpanEnd) {
+      return false;
+    }
+    const charEffect = fragment.span?.kind === 'effect' && isCharEffect(fragment.text);
+    if (fragment.type === FragmentType.SpanStart) {
+      let style = 'effect-' + fragment.text;
+      if (fragment.span?.kind === 'colour') {
+        style = 'color-' + fragment.text;
+      } else if (fragment.span?.kind === 'pattern') {
+        style = 'pattern';
+        patterns.push(patternState(fragment.pattern ?? { ops: [] }));
+      }
+      messageList.push(`<span class="${style}">`);
+      if (charEffect) {
+        charSpans++;
+      }
+    } else {
+      messageList.push('</span>');
+      if (charEffect) {
+        charSpans--;
+      }
+      if (fragment.span?.kind === 'pattern') {
+        patterns.pop();
+      }
+    }
+    return true;
+  }
+
   // Rule for handling text and emotes in the typical case
   function handleTextEmote() {
     const nextFrag = fragmentGen.next();
@@ -60,10 +183,12 @@ export function formatMessageFragments(fragments: Fragment[]): {
       return;
     }
     const fragment = nextFrag.value;
-    if (fragment.type === FragmentType.Emote && !!fragment.emote) {
-      messageList.push(imageFromEmote(fragment.emote).outerHTML);
+    if (handleSpan(fragment)) {
+      // Span tags pushed
+    } else if (fragment.type === FragmentType.Emote && !!fragment.emote) {
+      messageList.push(emoteHTML(fragment.emote, fragment.overlays));
     } else {
-      messageList.push(sanitizeMessage(fragment.text));
+      messageList.push(renderText(fragment.text, charSpans > 0));
     }
     handleTextEmote();
   }
@@ -75,30 +200,22 @@ export function formatMessageFragments(fragments: Fragment[]): {
       return;
     }
     const fragment = nextFrag.value;
-    if (fragment.type === FragmentType.Emote && !!fragment.emote) {
-      messageList.push(imageFromEmote(fragment.emote).outerHTML);
+    if (handleSpan(fragment)) {
+      // Span tags pushed
+    } else if (fragment.type === FragmentType.Emote && !!fragment.emote) {
+      messageList.push(emoteHTML(fragment.emote, fragment.overlays));
     } else {
-      const msg = sanitizeMessage(fragment.text)
-        .split('')
-        .map((c) => (c === ' ' ? '&nbsp' : `<span>${c}</span>`))
-        .join('');
-      messageList.push(msg);
+      messageList.push(renderText(fragment.text, true));
     }
     handleSpanEffect();
   }
 
   // Rule for handling effects
   function handleEffect(effect: string) {
-    switch (effect) {
-      case TextEffect.Wave:
-      case TextEffect.Wave2:
-      case TextEffect.Shake:
-      case TextEffect.Cheddar:
-        handleSpanEffect();
-        break;
-      default:
-        handleTextEmote();
-        break;
+    if (isCharEffect(effect)) {
+      handleSpanEffect();
+    } else {
+      handleTextEmote();
     }
   }
 
@@ -113,10 +230,12 @@ export function formatMessageFragments(fragments: Fragment[]): {
       effectList.push('effect-' + fragment.text);
       handleEffect(fragment.text);
     } else {
-      if (fragment.type === FragmentType.Emote && !!fragment.emote) {
-        messageList.push(imageFromEmote(fragment.emote).outerHTML);
+      if (handleSpan(fragment)) {
+        // Span tags pushed
+      } else if (fragment.type === FragmentType.Emote && !!fragment.emote) {
+        messageList.push(emoteHTML(fragment.emote, fragment.overlays));
       } else {
-        messageList.push(sanitizeMessage(fragment.text));
+        messageList.push(renderText(fragment.text, false));
       }
       handleTextEmote();
     }
@@ -130,13 +249,20 @@ export function formatMessageFragments(fragments: Fragment[]): {
     }
     const fragment = nextFrag.value;
     switch (fragment.type) {
+      case FragmentType.SpanStart:
+      case FragmentType.SpanEnd:
+        handleSpan(fragment);
+        handleTextEmote();
+        break;
       case FragmentType.Text:
+      case FragmentType.Link:
+      case FragmentType.Mention:
         messageList.push(sanitizeMessage(fragment.text));
         handleTextEmote();
         break;
       case FragmentType.Emote:
         if (fragment.emote) {
-          messageList.push(imageFromEmote(fragment.emote).outerHTML);
+          messageList.push(emoteHTML(fragment.emote, fragment.overlays));
           handleTextEmote();
           break;
         }
@@ -149,7 +275,10 @@ export function formatMessageFragments(fragments: Fragment[]): {
         handleEffect(fragment.text);
         break;
       case FragmentType.Pattern:
-        // TODO: Handle custom patterns
+        // Applies to the rest of the message
+        if (fragment.pattern) {
+          patterns.push(patternState(fragment.pattern));
+        }
         handleColor();
         break;
     }